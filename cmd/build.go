@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"m-docker/libcontainer/build"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker build 命令
+var BuildCommand = cli.Command{
+	Name:      "build",
+	Usage:     `build an image from a Dockerfile`,
+	UsageText: `m-docker build [OPTIONS] -t NAME PATH`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "t, tag", // 镜像名称
+			Usage: "name of the image.	eg: -t my-app:latest",
+		},
+		cli.StringFlag{
+			Name:  "f, file", // Dockerfile 路径
+			Usage: "name of the Dockerfile (default: PATH/Dockerfile)",
+		},
+		cli.StringSliceFlag{
+			Name:  "build-arg", // 构建参数
+			Usage: "set build-time variables.	eg: --build-arg VERSION=1.0",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache", // 禁用构建缓存
+			Usage: "do not use cache when building the image",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return fmt.Errorf("\"m-docker build\" requires exactly 1 argument")
+		}
+		tag := context.String("tag")
+		if tag == "" {
+			return fmt.Errorf("missing image name, use -t to specify it")
+		}
+
+		contextDir, err := filepath.Abs(context.Args().First())
+		if err != nil {
+			return fmt.Errorf("invalid build context: %v", err)
+		}
+		dockerfile := context.String("file")
+		if dockerfile == "" {
+			dockerfile = filepath.Join(contextDir, "Dockerfile")
+		}
+
+		// 解析构建参数
+		buildArgs := make(map[string]string)
+		for _, arg := range context.StringSlice("build-arg") {
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				// 只指定了名称时，使用宿主机上的同名环境变量
+				value, ok = os.LookupEnv(name)
+				if !ok {
+					continue
+				}
+			}
+			buildArgs[name] = value
+		}
+
+		if _, err := build.Build(&build.Options{
+			ContextDir: contextDir,
+			Dockerfile: dockerfile,
+			Tag:        tag,
+			BuildArgs:  buildArgs,
+			NoCache:    context.Bool("no-cache"),
+			Out:        os.Stdout,
+		}); err != nil {
+			return fmt.Errorf("build image error: %v", err)
+		}
+		return nil
+	},
+}
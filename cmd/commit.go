@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"m-docker/libcontainer"
+	"m-docker/libcontainer/config"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker commit 命令
+var CommitCommand = cli.Command{
+	Name:      "commit",
+	Usage:     `create a new image from a container's changes`,
+	UsageText: `m-docker commit [-m message] CONTAINER [IMAGE]`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "m, message", // 提交信息
+			Usage: "commit message, recorded in the image history",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 || context.NArg() > 2 {
+			return fmt.Errorf("\"m-docker commit\" requires 1 or 2 arguments")
+		}
+
+		conf, err := config.GetConfigFromNameOrPrefix(context.Args().Get(0))
+		if err != nil {
+			return fmt.Errorf("failed to get container: %v", err)
+		}
+		img, err := libcontainer.Commit(conf, context.Args().Get(1), context.String("message"))
+		if err != nil {
+			return fmt.Errorf("failed to commit container %s: %v", conf.Name, err)
+		}
+		fmt.Println(img.Name)
+		return nil
+	},
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"m-docker/libcontainer"
+	"m-docker/libcontainer/config"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// m-docker cp 命令
+var CopyCommand = cli.Command{
+	Name:  "cp",
+	Usage: `copy files/folders between a container and the local filesystem`,
+	UsageText: `m-docker cp CONTAINER:SRC_PATH DEST_PATH|-
+   m-docker cp SRC_PATH|- CONTAINER:DEST_PATH`,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 2 {
+			return fmt.Errorf("\"m-docker cp\" requires exactly 2 arguments")
+		}
+
+		src, dst := context.Args().Get(0), context.Args().Get(1)
+		srcContainer, srcPath := splitCopyArg(src)
+		dstContainer, dstPath := splitCopyArg(dst)
+		switch {
+		case srcContainer != "" && dstContainer == "":
+			conf, err := config.GetConfigFromNameOrPrefix(srcContainer)
+			if err != nil {
+				return fmt.Errorf("failed to get container: %v", err)
+			}
+			if err := libcontainer.CopyFromContainer(conf, srcPath, dstPath, os.Stdout); err != nil {
+				return fmt.Errorf("failed to copy from container %s: %v", conf.Name, err)
+			}
+		case srcContainer == "" && dstContainer != "":
+			conf, err := config.GetConfigFromNameOrPrefix(dstContainer)
+			if err != nil {
+				return fmt.Errorf("failed to get container: %v", err)
+			}
+			if err := libcontainer.CopyToContainer(conf, srcPath, dstPath, os.Stdin); err != nil {
+				return fmt.Errorf("failed to copy to container %s: %v", conf.Name, err)
+			}
+		default:
+			return fmt.Errorf("exactly one of source and destination must be a container path")
+		}
+		return nil
+	},
+}
+
+// m-docker cp-helper 命令（它不可以被显式调用）
+// 由 cp 命令启动，在 chroot 到容器 rootfs 之后打包或解压容器中的路径
+var CopyHelperCommand = cli.Command{
+	Name:   "cp-helper",
+	Usage:  `Copy files inside the container rootfs, do not call it outside!`,
+	Hidden: true, // 隐藏该命令，避免被显式调用
+
+	Action: func(context *cli.Context) error {
+		// 标准输出用于传输 tar 流，日志和错误只能写入标准错误
+		log.SetOutput(os.Stderr)
+		if err := libcontainer.CopyHelper(context.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
+// 将 CONTAINER:PATH 形式的参数拆分为容器和路径，本地路径返回的容器为空
+// 与 docker 一致，以 / 或 . 开头的参数总是视为本地路径，以便本地路径中包含 ':'
+func splitCopyArg(arg string) (string, string) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg
+	}
+	container, p, ok := strings.Cut(arg, ":")
+	if !ok || container == "" {
+		return "", arg
+	}
+	return container, p
+}
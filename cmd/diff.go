@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"m-docker/libcontainer"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/storage"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker diff 命令
+var DiffCommand = cli.Command{
+	Name:      "diff",
+	Usage:     `inspect changes to files or directories on a container's filesystem`,
+	UsageText: `m-docker diff [--json] CONTAINER`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json", // 以 json 格式输出
+			Usage: "print changes as a json array",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return fmt.Errorf("\"m-docker diff\" requires exactly 1 argument")
+		}
+
+		conf, err := config.GetConfigFromNameOrPrefix(context.Args().First())
+		if err != nil {
+			return fmt.Errorf("failed to get container: %v", err)
+		}
+		changes, err := libcontainer.Changes(conf)
+		if err != nil {
+			return fmt.Errorf("failed to get changes of container %s: %v", conf.Name, err)
+		}
+
+		if context.Bool("json") {
+			if changes == nil {
+				changes = []storage.Change{}
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(changes)
+		}
+		for _, change := range changes {
+			fmt.Printf("%s %s\n", change.Kind, change.Path)
+		}
+		return nil
+	},
+}
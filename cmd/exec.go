@@ -86,6 +86,9 @@ func getExecConfig(ctx *cli.Context) (*config.Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get container config: %v", err)
 	}
+	if conf.Status != constant.ContainerRunning {
+		return nil, fmt.Errorf("container %s is not running", prefixOrName)
+	}
 
 	// 修改 Config
 	conf.Status = ""
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"m-docker/libcontainer"
+	"m-docker/libcontainer/config"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker export 命令
+var ExportCommand = cli.Command{
+	Name:      "export",
+	Usage:     `export a container's filesystem as a tar archive`,
+	UsageText: `m-docker export CONTAINER [-o file.tar]`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "o, output", // 输出文件
+			Usage: "write to a file, instead of STDOUT",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return fmt.Errorf("\"m-docker export\" requires exactly 1 argument")
+		}
+
+		conf, err := config.GetConfigFromNameOrPrefix(context.Args().First())
+		if err != nil {
+			return fmt.Errorf("failed to get container: %v", err)
+		}
+
+		// 默认输出到标准输出
+		var out io.Writer = os.Stdout
+		if output := context.String("output"); output != "" {
+			file, err := os.Create(output)
+			if err != nil {
+				return fmt.Errorf("failed to create file %s: %v", output, err)
+			}
+			defer file.Close()
+			out = file
+		}
+
+		if err := libcontainer.Export(conf, out); err != nil {
+			return fmt.Errorf("failed to export container %s: %v", conf.Name, err)
+		}
+		return nil
+	},
+}
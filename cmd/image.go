@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"m-docker/libcontainer/image"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker image 命令，管理镜像的子命令
+var ImageCommand = cli.Command{
+	Name:  "image",
+	Usage: `manage images`,
+	Subcommands: []cli.Command{
+		imageHistoryCommand,
+		imageInspectCommand,
+		TagCommand,
+	},
+}
+
+// m-docker tag 命令
+var TagCommand = cli.Command{
+	Name:      "tag",
+	Usage:     `create a tag TARGET_IMAGE that refers to SOURCE_IMAGE`,
+	UsageText: `m-docker tag SOURCE_IMAGE TARGET_IMAGE`,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 2 {
+			return fmt.Errorf("\"m-docker tag\" requires exactly 2 arguments")
+		}
+		if err := image.Tag(context.Args().Get(0), context.Args().Get(1)); err != nil {
+			return fmt.Errorf("failed to tag image: %v", err)
+		}
+		return nil
+	},
+}
+
+// m-docker image history 命令
+var imageHistoryCommand = cli.Command{
+	Name:      "history",
+	Usage:     `show the history of an image`,
+	UsageText: `m-docker image history [--no-trunc] IMAGE`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-trunc", // 不截断输出
+			Usage: "don't truncate output",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return fmt.Errorf("\"m-docker image history\" requires exactly 1 argument")
+		}
+		if err := showHistory(context.Args().First(), context.Bool("no-trunc")); err != nil {
+			return fmt.Errorf("failed to show history: %v", err)
+		}
+		return nil
+	},
+}
+
+// m-docker image inspect 命令
+var imageInspectCommand = cli.Command{
+	Name:      "inspect",
+	Usage:     `display detailed information on one or more images`,
+	UsageText: `m-docker image inspect IMAGE [IMAGE...]`,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("\"m-docker image inspect\" requires at least 1 argument")
+		}
+		var result []interface{}
+		for _, name := range context.Args() {
+			info, err := inspectImage(name)
+			if err != nil {
+				return err
+			}
+			result = append(result, info)
+		}
+		return printJSON(result)
+	},
+}
+
+// 按照从新到旧的顺序打印镜像的构建历史，以及每个步骤所生成的镜像层及其大小
+func showHistory(name string, noTrunc bool) error {
+	img, err := image.GetImage(name)
+	if err != nil {
+		return err
+	}
+
+	// 依次将生成了镜像层的步骤与镜像层对应起来
+	history := img.LayerHistory()
+	chainIDs := img.ChainIDs()
+	layers := make([]*image.Layer, len(history))
+	next := 0
+	for i, h := range history {
+		if h.EmptyLayer {
+			continue
+		}
+		layer, err := image.GetLayer(chainIDs[next])
+		if err != nil {
+			return err
+		}
+		layers[i] = layer
+		next++
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	for i := len(history) - 1; i >= 0; i-- {
+		h := history[i]
+		id, size := "<none>", "0B"
+		if layers[i] != nil {
+			hexStr, _ := image.ParseDigest(layers[i].DiffID)
+			id, size = hexStr[:12], formatSize(layers[i].Size)
+		}
+		createdBy := strings.ReplaceAll(h.CreatedBy, "\t", " ")
+		if !noTrunc && len(createdBy) > 45 {
+			createdBy = createdBy[:44] + "…"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", id, formatTime(h.Created), createdBy, size, h.Comment)
+	}
+	return w.Flush()
+}
+
+// image inspect 输出的镜像信息
+type imageInfo struct {
+	Name    string             `json:"name"`
+	Created *time.Time         `json:"created,omitempty"`
+	Config  *image.ImageConfig `json:"config"`
+	RootFS  image.RootFS       `json:"rootfs"`
+
+	// 镜像层链，按照自底向上的顺序排列
+	Layers []*layerInfo `json:"layers"`
+
+	History []image.History `json:"history"`
+}
+
+// 镜像层的信息
+type layerInfo struct {
+	*image.Layer
+
+	// 镜像层解压后的目录
+	Dir string `json:"dir"`
+}
+
+// 获取镜像的完整配置以及镜像层链
+func inspectImage(name string) (*imageInfo, error) {
+	img, err := image.GetImage(name)
+	if err != nil {
+		return nil, err
+	}
+	info := &imageInfo{
+		Name:    img.Name,
+		Created: img.Created,
+		Config:  img.Config,
+		RootFS:  image.RootFS{Type: "layers", DiffIDs: img.Layers},
+		History: img.LayerHistory(),
+	}
+	for _, chainID := range img.ChainIDs() {
+		layer, err := image.GetLayer(chainID)
+		if err != nil {
+			return nil, err
+		}
+		info.Layers = append(info.Layers, &layerInfo{Layer: layer, Dir: image.LayerDir(chainID)})
+	}
+	return info, nil
+}
+
+// 以缩进的 json 格式打印到标准输出
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(v)
+}
+
+// 将字节数转换为便于阅读的形式，如 1.5MB
+func formatSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}
+
+// 格式化时间，与 ps 中容器的创建时间格式一致
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "<unknown>"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
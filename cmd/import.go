@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"m-docker/libcontainer/image"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker import 命令
+var ImportCommand = cli.Command{
+	Name:      "import",
+	Usage:     `import the contents from a tarball to create a single-layer image`,
+	UsageText: `m-docker import file.tar|- [IMAGE]`,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 || context.NArg() > 2 {
+			return fmt.Errorf("\"m-docker import\" requires 1 or 2 arguments")
+		}
+
+		// - 表示从标准输入读取
+		var in io.Reader = os.Stdin
+		if input := context.Args().Get(0); input != "-" {
+			file, err := os.Open(input)
+			if err != nil {
+				return fmt.Errorf("failed to open file %s: %v", input, err)
+			}
+			defer file.Close()
+			in = file
+		}
+
+		img, err := image.Import(in, context.Args().Get(1))
+		if err != nil {
+			return fmt.Errorf("failed to import image: %v", err)
+		}
+		fmt.Printf("Imported image: %s\n", img.Name)
+		return nil
+	},
+}
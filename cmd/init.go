@@ -1,17 +1,19 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 	"syscall"
 
+	"m-docker/libcontainer/config"
 	"m-docker/libcontainer/constant"
 	_ "m-docker/libcontainer/nsenter" // 导入 nsenter 包，触发 init 函数
+	"m-docker/libcontainer/user"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -51,12 +53,40 @@ func initContainer() error {
 	// 若不挂载，会导致容器内部无法访问和使用许多设备，这可能导致系统无法正常工作
 	syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
 
-	// 读取管道中的 command 参数
-	cmdArray := readPipeCommand()
+	// 读取管道中的用户进程参数
+	process, err := readPipeProcess()
+	if err != nil {
+		return err
+	}
+	cmdArray := process.Args
 	if len(cmdArray) == 0 {
 		return errors.New("get user command error, cmdArray is nil")
 	}
 
+	// 设置容器的主机名，容器拥有独立的 UTS namespace，不会影响宿主机
+	if process.Hostname != "" {
+		if err := syscall.Sethostname([]byte(process.Hostname)); err != nil {
+			return fmt.Errorf("set hostname error: %v", err)
+		}
+	}
+
+	// 切换到用户进程的工作目录，目录不存在时自动创建
+	if process.Cwd != "" {
+		if err := os.MkdirAll(process.Cwd, 0755); err != nil {
+			return fmt.Errorf("create working dir %s error: %v", process.Cwd, err)
+		}
+		if err := os.Chdir(process.Cwd); err != nil {
+			return fmt.Errorf("change dir to %s error: %v", process.Cwd, err)
+		}
+	}
+
+	// 切换到运行用户进程的用户
+	if process.User != "" {
+		if err := setupUser(process.User); err != nil {
+			return fmt.Errorf("setup user %s error: %v", process.User, err)
+		}
+	}
+
 	// 判断用户指定的 command 的可执行文件路径是否存在
 	path, err := exec.LookPath(cmdArray[0])
 	if err != nil {
@@ -135,7 +165,7 @@ func pivotRoot(newRoot string) error {
 
 const readPipefdIndex = 3
 
-func readPipeCommand() []string {
+func readPipeProcess() (*config.Process, error) {
 	// uintPtr(3) 就是指 index 为 3 的文件描述符，至于为什么是3，具体解释一下：
 	// 每个进程在创建的时候默认有3个文件描述符，分别是：
 	// 0: 标准输入
@@ -147,10 +177,38 @@ func readPipeCommand() []string {
 
 	msg, err := io.ReadAll(pipe)
 	if err != nil {
-		log.Errorf("read pipe error: %v", err)
-		return nil
+		return nil, fmt.Errorf("read pipe error: %v", err)
+	}
+
+	process := new(config.Process)
+	if err := json.Unmarshal(msg, process); err != nil {
+		return nil, fmt.Errorf("unmarshal process error: %v", err)
+	}
+	return process, nil
+}
+
+// 切换当前进程的用户和用户组
+// 必须在 pivot_root 之后调用，因为用户信息需要从容器内的 /etc/passwd 和 /etc/group 中读取
+func setupUser(spec string) error {
+	execUser, err := user.GetExecUser(spec)
+	if err != nil {
+		return err
 	}
 
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
+	// 需要先设置附加用户组和用户组，因为切换用户之后就没有权限再修改了
+	if err := syscall.Setgroups(execUser.Sgids); err != nil {
+		return fmt.Errorf("setgroups error: %v", err)
+	}
+	if err := syscall.Setgid(execUser.Gid); err != nil {
+		return fmt.Errorf("setgid error: %v", err)
+	}
+	if err := syscall.Setuid(execUser.Uid); err != nil {
+		return fmt.Errorf("setuid error: %v", err)
+	}
+
+	// 若没有设置 HOME 环境变量，则使用用户的家目录
+	if os.Getenv("HOME") == "" {
+		os.Setenv("HOME", execUser.Home)
+	}
+	return nil
 }
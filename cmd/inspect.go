@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"m-docker/libcontainer/config"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker inspect 命令
+var InspectCommand = cli.Command{
+	Name:      "inspect",
+	Usage:     `display detailed information on containers or images`,
+	UsageText: `m-docker inspect [--type container|image] NAME [NAME...]`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type", // 只查找指定类型的对象
+			Usage: "only inspect objects of the given type: container or image",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("\"m-docker inspect\" requires at least 1 argument")
+		}
+		objType := context.String("type")
+		if objType != "" && objType != "container" && objType != "image" {
+			return fmt.Errorf("invalid type %s: must be container or image", objType)
+		}
+
+		var result []interface{}
+		for _, name := range context.Args() {
+			info, err := inspectObject(name, objType)
+			if err != nil {
+				return err
+			}
+			result = append(result, info)
+		}
+		return printJSON(result)
+	},
+}
+
+// 获取容器或镜像的详细信息，未指定类型时优先查找容器
+func inspectObject(name string, objType string) (interface{}, error) {
+	if objType != "image" {
+		conf, err := config.GetConfigFromNameOrPrefix(name)
+		if err == nil {
+			return conf, nil
+		}
+		if objType == "container" {
+			return nil, err
+		}
+	}
+	info, err := inspectImage(name)
+	if err != nil {
+		if objType == "" {
+			return nil, fmt.Errorf("no such object: %s", name)
+		}
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"m-docker/libcontainer/image"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker load 命令
+var LoadCommand = cli.Command{
+	Name:      "load",
+	Usage:     `load an image from a tar archive in OCI image layout or docker save format`,
+	UsageText: `m-docker load [-i file.tar]`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "i, input", // 输入文件
+			Usage: "read from a tar archive file, instead of STDIN",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		// 默认从标准输入读取
+		var in io.Reader = os.Stdin
+		if input := context.String("input"); input != "" {
+			file, err := os.Open(input)
+			if err != nil {
+				return fmt.Errorf("failed to open file %s: %v", input, err)
+			}
+			defer file.Close()
+			in = file
+		}
+
+		names, err := image.Load(in)
+		if err != nil {
+			return fmt.Errorf("failed to load image: %v", err)
+		}
+		for _, name := range names {
+			fmt.Printf("Loaded image: %s\n", name)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"fmt"
+	"m-docker/libcontainer"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/network"
+	"net"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker network 命令，管理网络的子命令
+var NetworkCommand = cli.Command{
+	Name:  "network",
+	Usage: `manage networks`,
+	Subcommands: []cli.Command{
+		networkCreateCommand,
+		networkListCommand,
+		networkRemoveCommand,
+		networkInspectCommand,
+		networkConnectCommand,
+		networkDisconnectCommand,
+	},
+}
+
+// m-docker network create 命令
+var networkCreateCommand = cli.Command{
+	Name:      "create",
+	Usage:     `create a network`,
+	UsageText: `m-docker network create [OPTIONS] NETWORK`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "d, driver", // 网络驱动
+			Value: network.DriverBridge,
+			Usage: "driver to manage the network, only bridge is supported",
+		},
+		cli.StringSliceFlag{
+			Name:  "subnet", // 子网，IPv4 和 IPv6 各一个
+			Usage: "subnet in CIDR format, at most one for each address family.	eg: --subnet 172.30.0.0/16 --subnet fd00:30::/64",
+		},
+		cli.StringSliceFlag{
+			Name:  "gateway", // 网关，IPv4 和 IPv6 各一个
+			Usage: "gateway for the subnet of the same address family.	eg: --gateway 172.30.0.1",
+		},
+		cli.BoolFlag{
+			Name:  "ipv6", // 启用 IPv6
+			Usage: "enable IPv6, a ULA subnet is allocated if no IPv6 subnet is specified",
+		},
+		cli.StringFlag{
+			Name:  "ipv6-mode", // IPv6 流量的转发方式
+			Usage: "how IPv6 traffic leaves the network: nat (NAT66) or routed",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return fmt.Errorf("\"m-docker network create\" requires exactly 1 argument")
+		}
+		if driver := context.String("driver"); driver != network.DriverBridge {
+			return fmt.Errorf("unsupported network driver: %s", driver)
+		}
+		opts := &network.NetworkOptions{IPv6: context.Bool("ipv6"), IPv6Mode: context.String("ipv6-mode")}
+		if err := splitByFamily(context.StringSlice("subnet"), "subnet", &opts.Subnet, &opts.Subnet6); err != nil {
+			return err
+		}
+		if err := splitByFamily(context.StringSlice("gateway"), "gateway", &opts.Gateway, &opts.Gateway6); err != nil {
+			return err
+		}
+		nw, err := network.CreateNetwork(context.Args().First(), opts)
+		if err != nil {
+			return fmt.Errorf("failed to create network: %v", err)
+		}
+		fmt.Println(nw.ID)
+		return nil
+	},
+}
+
+// m-docker network ls 命令
+var networkListCommand = cli.Command{
+	Name:      "ls",
+	Usage:     `list networks`,
+	UsageText: `m-docker network ls`,
+
+	Action: func(context *cli.Context) error {
+		networks, err := network.ListNetworks()
+		if err != nil {
+			return fmt.Errorf("failed to list networks: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprintf(w, "NETWORK ID\tNAME\tDRIVER\tSUBNET\tGATEWAY\n")
+		for _, nw := range networks {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", shortNetworkID(nw.ID), nw.Name, nw.Driver, nw.Subnet, nw.Gateway)
+		}
+		return w.Flush()
+	},
+}
+
+// m-docker network rm 命令
+var networkRemoveCommand = cli.Command{
+	Name:      "rm",
+	Usage:     `remove one or more networks`,
+	UsageText: `m-docker network rm NETWORK [NETWORK...]`,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("\"m-docker network rm\" requires at least 1 argument")
+		}
+		var failed bool
+		for _, name := range context.Args() {
+			if err := libcontainer.RemoveNetwork(name); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to remove network %s: %v\n", name, err)
+				failed = true
+				continue
+			}
+			fmt.Println(name)
+		}
+		if failed {
+			return fmt.Errorf("failed to remove some networks")
+		}
+		return nil
+	},
+}
+
+// m-docker network connect 命令
+var networkConnectCommand = cli.Command{
+	Name:      "connect",
+	Usage:     `connect a running container to a network`,
+	UsageText: `m-docker network connect NETWORK CONTAINER`,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 2 {
+			return fmt.Errorf("\"m-docker network connect\" requires exactly 2 arguments")
+		}
+		conf, err := config.GetConfigFromNameOrPrefix(context.Args().Get(1))
+		if err != nil {
+			return fmt.Errorf("failed to get container: %v", err)
+		}
+		if err := libcontainer.ConnectNetwork(conf, context.Args().Get(0)); err != nil {
+			return fmt.Errorf("failed to connect container to network: %v", err)
+		}
+		return nil
+	},
+}
+
+// m-docker network disconnect 命令
+var networkDisconnectCommand = cli.Command{
+	Name:      "disconnect",
+	Usage:     `disconnect a running container from a network`,
+	UsageText: `m-docker network disconnect NETWORK CONTAINER`,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 2 {
+			return fmt.Errorf("\"m-docker network disconnect\" requires exactly 2 arguments")
+		}
+		conf, err := config.GetConfigFromNameOrPrefix(context.Args().Get(1))
+		if err != nil {
+			return fmt.Errorf("failed to get container: %v", err)
+		}
+		if err := libcontainer.DisconnectNetwork(conf, context.Args().Get(0)); err != nil {
+			return fmt.Errorf("failed to disconnect container from network: %v", err)
+		}
+		return nil
+	},
+}
+
+// network inspect 输出的网络信息
+type networkInfo struct {
+	*network.Network
+
+	// 连接到网络的容器，key 为容器 ID
+	Containers map[string]*networkContainer `json:"containers"`
+}
+
+// 连接到网络的容器
+type networkContainer struct {
+	Name        string `json:"name"`
+	IPAddress   string `json:"ipAddress"`
+	IPv6Address string `json:"ipv6Address,omitempty"`
+	MacAddress  string `json:"macAddress"`
+}
+
+// m-docker network inspect 命令
+var networkInspectCommand = cli.Command{
+	Name:      "inspect",
+	Usage:     `display detailed information on one or more networks`,
+	UsageText: `m-docker network inspect NETWORK [NETWORK...]`,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("\"m-docker network inspect\" requires at least 1 argument")
+		}
+		var result []interface{}
+		for _, name := range context.Args() {
+			info, err := inspectNetwork(name)
+			if err != nil {
+				return err
+			}
+			result = append(result, info)
+		}
+		return printJSON(result)
+	},
+}
+
+// 获取网络的详细信息，只列出正在使用该网络的容器
+func inspectNetwork(name string) (*networkInfo, error) {
+	nw, err := network.GetNetwork(name)
+	if err != nil {
+		return nil, err
+	}
+	confs, err := libcontainer.NetworkContainers(name)
+	if err != nil {
+		return nil, err
+	}
+	info := &networkInfo{Network: nw, Containers: make(map[string]*networkContainer)}
+	for _, conf := range confs {
+		for _, ep := range conf.Endpoints {
+			if ep.Network == name && (ep.IPAddress != "" || ep.IPv6Address != "") {
+				info.Containers[conf.ID] = &networkContainer{
+					Name:        conf.Name,
+					IPAddress:   ep.IPAddress,
+					IPv6Address: ep.IPv6Address,
+					MacAddress:  ep.MacAddress,
+				}
+			}
+		}
+	}
+	return info, nil
+}
+
+// 将 --subnet 或 --gateway 指定的多个值按地址族分开，每个地址族最多只能指定一个
+func splitByFamily(values []string, flag string, v4 *string, v6 *string) error {
+	for _, value := range values {
+		ip, _, err := net.ParseCIDR(value)
+		if err != nil {
+			ip = net.ParseIP(value)
+		}
+		if ip == nil {
+			return fmt.Errorf("invalid %s: %s", flag, value)
+		}
+		target := v6
+		if ip.To4() != nil {
+			target = v4
+		}
+		if *target != "" {
+			return fmt.Errorf("only one %s is allowed for each address family", flag)
+		}
+		*target = value
+	}
+	return nil
+}
+
+// 网络 ID 的前 12 位
+func shortNetworkID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/constant"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker port 命令
+var PortCommand = cli.Command{
+	Name:      "port",
+	Usage:     `list port mappings or a specific mapping for the container`,
+	UsageText: `m-docker port CONTAINER [PRIVATE_PORT[/PROTO]]`,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 || context.NArg() > 2 {
+			return fmt.Errorf("\"m-docker port\" requires 1 or 2 arguments")
+		}
+
+		conf, err := config.GetConfigFromNameOrPrefix(context.Args().First())
+		if err != nil {
+			return fmt.Errorf("failed to get container: %v", err)
+		}
+		// 端口只在容器运行期间发布
+		if conf.Status != constant.ContainerRunning {
+			return nil
+		}
+
+		port := context.Args().Get(1)
+		if port != "" && !strings.Contains(port, "/") {
+			port += "/tcp"
+		}
+		found := false
+		for _, pm := range conf.Ports {
+			key := fmt.Sprintf("%d/%s", pm.ContainerPort, pm.Protocol)
+			for _, binding := range portBindings(conf, pm) {
+				if port == "" {
+					fmt.Println(binding)
+					continue
+				}
+				if key == port {
+					found = true
+					fmt.Println(strings.TrimPrefix(binding, key+" -> "))
+				}
+			}
+		}
+		if port != "" && !found {
+			return fmt.Errorf("no public port '%s' published for %s", port, context.Args().First())
+		}
+		return nil
+	},
+}
+
+// 端口映射实际监听的地址，没有指定宿主机地址且容器有 IPv6 地址时，端口同时发布在 IPv4 和 IPv6 上
+func portBindings(conf *config.Config, pm *config.PortMapping) []string {
+	if pm.HostIP != "" || len(conf.Endpoints) == 0 {
+		return []string{pm.String()}
+	}
+	var bindings []string
+	ep := conf.Endpoints[0]
+	if ep.IPAddress != "" {
+		bindings = append(bindings, pm.String())
+	}
+	if ep.IPv6Address != "" {
+		pm6 := *pm
+		pm6.HostIP = "::"
+		bindings = append(bindings, pm6.String())
+	}
+	return bindings
+}
@@ -8,7 +8,6 @@ import (
 	"strings"
 	"text/tabwriter"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
@@ -34,20 +33,13 @@ var ContainerListCommand = cli.Command{
 
 // 查询 m-docker 状态目录下的所有目录，根据 config.json 文件获取容器信息
 func listContainers(ctx *cli.Context) error {
-	// 读取状态目录下的所有容器目录
-	files, err := os.ReadDir(constant.StatePath)
+	configs, err := config.ListConfigs()
 	if err != nil {
-		return fmt.Errorf("read dir %s error: %v", constant.StatePath, err)
+		return err
 	}
 
-	// 遍历所有容器目录，获取容器 Config
-	containersConfigs := make([]*config.Config, 0, len(files))
-	for _, file := range files {
-		conf, err := config.GetConfigFromID(file.Name())
-		if err != nil {
-			log.Warningf("get config from id %s error: %v", file.Name(), err)
-			continue
-		}
+	containersConfigs := make([]*config.Config, 0, len(configs))
+	for _, conf := range configs {
 		if ctx.Bool("all") || conf.Status == constant.ContainerRunning {
 			containersConfigs = append(containersConfigs, conf)
 		}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"m-docker/libcontainer/registry"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+// 访问 registry 的命令共用的参数
+var registryFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "u, username",
+		Usage: "username for the registry",
+	},
+	cli.StringFlag{
+		Name:  "p, password",
+		Usage: "password for the registry",
+	},
+	cli.BoolFlag{
+		Name:  "insecure", // 用于本地搭建的 registry
+		Usage: "access the registry over plain HTTP",
+	},
+}
+
+// 根据命令行参数创建 registry 客户端
+func newRegistryClient(context *cli.Context) *registry.Client {
+	client := registry.NewClient()
+	client.Username = context.String("username")
+	client.Password = context.String("password")
+	client.PlainHTTP = context.Bool("insecure")
+	client.Out = os.Stdout
+	return client
+}
+
+// m-docker pull 命令
+var PullCommand = cli.Command{
+	Name:      "pull",
+	Usage:     `pull an image from a registry`,
+	UsageText: `m-docker pull [OPTIONS] NAME[:TAG|@DIGEST]`,
+	Flags:     registryFlags,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return fmt.Errorf("\"m-docker pull\" requires exactly 1 argument")
+		}
+
+		name := context.Args().First()
+		if _, err := newRegistryClient(context).Pull(name); err != nil {
+			return fmt.Errorf("failed to pull image %s: %v", name, err)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker push 命令
+var PushCommand = cli.Command{
+	Name:      "push",
+	Usage:     `push an image to a registry`,
+	UsageText: `m-docker push [OPTIONS] NAME[:TAG]`,
+	Flags:     registryFlags,
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return fmt.Errorf("\"m-docker push\" requires exactly 1 argument")
+		}
+
+		name := context.Args().First()
+		if err := newRegistryClient(context).Push(name); err != nil {
+			return fmt.Errorf("failed to push image %s: %v", name, err)
+		}
+		return nil
+	},
+}
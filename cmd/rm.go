@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"m-docker/libcontainer"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/constant"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// 强制删除运行中的容器时，等待容器进程退出的最长时间
+const removeWaitTimeout = 10 * time.Second
+
+// m-docker rm 命令
+var RemoveCommand = cli.Command{
+	Name:      "rm",
+	Usage:     `remove one or more containers`,
+	UsageText: `m-docker rm [-f] CONTAINER [CONTAINER...]`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "f, force", // 强制删除运行中的容器
+			Usage: "force the removal of a running container (uses SIGKILL)",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("\"m-docker rm\" requires at least 1 argument")
+		}
+
+		var failed bool
+		for _, name := range context.Args() {
+			if err := removeContainer(name, context.Bool("force")); err != nil {
+				log.Errorf("failed to remove container %s: %v", name, err)
+				failed = true
+				continue
+			}
+			fmt.Println(name)
+		}
+		// 顺便清理异常退出的容器残留的端口映射规则
+		libcontainer.CleanupStalePorts()
+		if failed {
+			return fmt.Errorf("failed to remove some containers")
+		}
+		return nil
+	},
+}
+
+// 删除容器，运行中的容器只有在 force 为 true 时才会被杀死后删除
+func removeContainer(nameOrID string, force bool) error {
+	conf, err := config.GetConfigFromNameOrPrefix(nameOrID)
+	if err != nil {
+		return err
+	}
+
+	if conf.Status == constant.ContainerRunning {
+		if !force {
+			return fmt.Errorf("container is running, use -f to force the removal")
+		}
+		if conf, err = killContainer(conf); err != nil {
+			return err
+		}
+	}
+
+	container, err := libcontainer.NewContainer(conf, false)
+	if err != nil {
+		return err
+	}
+	container.Remove()
+	return nil
+}
+
+// 杀死容器进程，并等待管理容器的 m-docker 进程释放容器的运行环境
+func killContainer(conf *config.Config) (*config.Config, error) {
+	if err := syscall.Kill(conf.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return nil, fmt.Errorf("failed to kill process %d: %v", conf.Pid, err)
+	}
+
+	deadline := time.Now().Add(removeWaitTimeout)
+	for time.Now().Before(deadline) {
+		current, err := config.GetConfigFromID(conf.ID)
+		if err != nil {
+			return nil, err
+		}
+		if current.Status != constant.ContainerRunning {
+			return current, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// 管理容器的进程可能已经不存在了，此时由当前进程完成清理
+	if err := syscall.Kill(conf.Pid, 0); err == syscall.ESRCH {
+		log.Warnf("container %s was not released, cleaning up", conf.ID)
+		return conf, nil
+	}
+	return nil, fmt.Errorf("timed out waiting for container to stop")
+}
@@ -14,7 +14,7 @@ import (
 var RunCommand = cli.Command{
 	Name:      "run",
 	Usage:     `create and run a container`,
-	UsageText: `m-docker run -it [command]`,
+	UsageText: `m-docker run [OPTIONS] IMAGE [COMMAND]`,
 	Flags: []cli.Flag{
 		cli.BoolFlag{
 			Name:  "it", // 简单起见，这里把 -i 和 -t 合并了
@@ -32,6 +32,18 @@ var RunCommand = cli.Command{
 			Name:  "cpu", // CPU 使用率限制
 			Usage: "cpu limit.	eg: -cpu 0.5",
 		},
+		cli.StringFlag{
+			Name:  "net-ingress-rate", // 网络入站带宽限制
+			Usage: "limit inbound network bandwidth.	eg: --net-ingress-rate 10mbit",
+		},
+		cli.StringFlag{
+			Name:  "net-egress-rate", // 网络出站带宽限制
+			Usage: "limit outbound network bandwidth.	eg: --net-egress-rate 10mbit",
+		},
+		cli.BoolFlag{
+			Name:  "rm", // 容器退出后自动删除
+			Usage: "automatically remove the container when it exits",
+		},
 		cli.StringFlag{
 			Name:  "name", // 容器名称
 			Usage: "container name.	eg: -name my-ubuntu-env",
@@ -40,11 +52,51 @@ var RunCommand = cli.Command{
 			Name:  "v", // 挂载目录
 			Usage: "bind mount a volume.	eg: -v /host:/container",
 		},
+		cli.StringSliceFlag{
+			Name:  "e", // 环境变量
+			Usage: "set environment variables.	eg: -e KEY=VALUE",
+		},
+		cli.StringFlag{
+			Name:  "entrypoint", // 覆盖镜像的 Entrypoint
+			Usage: "overwrite the default entrypoint of the image.	eg: --entrypoint /bin/sh",
+		},
+		cli.StringFlag{
+			Name:  "network", // 网络模式
+			Usage: "connect a container to a network: bridge, none, host, container:<name|id> or a user-defined network.	eg: --network host",
+		},
+		cli.StringSliceFlag{
+			Name:  "p, publish", // 端口映射
+			Usage: "publish a container's port to the host.	eg: -p 8080:80/tcp",
+		},
+		cli.BoolFlag{
+			Name:  "P, publish-all", // 发布镜像中声明的所有端口
+			Usage: "publish all exposed ports to random ports",
+		},
+		cli.StringFlag{
+			Name:  "hostname", // 主机名
+			Usage: "container host name.	eg: --hostname web",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns", // DNS 服务器
+			Usage: "set custom dns servers.	eg: --dns 8.8.8.8",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-search", // DNS 搜索域
+			Usage: "set custom dns search domains.	eg: --dns-search example.com",
+		},
+		cli.StringSliceFlag{
+			Name:  "add-host", // 添加 hosts 记录
+			Usage: "add a custom host-to-IP mapping.	eg: --add-host db:10.0.0.2",
+		},
+		cli.StringSliceFlag{
+			Name:  "egress-allow", // 放行的出站流量，其余出站流量被拒绝
+			Usage: "deny outbound traffic except the listed destinations or protocols, dns servers must be allowed explicitly, 'none' denies all.	eg: --egress-allow 10.0.0.0/8,tcp:443",
+		},
 	},
 
 	// m-docker run 命令的入口点
-	// 1. 判断参数是否含有 command
-	// 2. 获取 command
+	// 1. 判断参数是否含有 image 和 command
+	// 2. 获取 image 和 command
 	// 3. 调用 run 函数去创建和运行容器
 	Action: func(context *cli.Context) error {
 		// 生成容器的配置信息
@@ -87,18 +139,24 @@ func run(conf *config.Config) error {
 	if err != nil {
 		return fmt.Errorf("Create container object error: %v", err)
 	}
-	// 函数结束后释放容器资源
-	defer container.Remove()
-
 	// 创建容器运行环境
 	if err := container.Create(); err != nil {
+		container.Remove()
 		return fmt.Errorf("setup container environment error: %v", err)
 	}
 
 	// 启动容器
 	if err := container.Start(); err != nil {
+		container.Remove()
 		return fmt.Errorf("Start container error: %v", err)
 	}
 
+	// 容器退出后，指定了 --rm 时直接删除容器，否则保留容器以便之后访问
+	if conf.AutoRemove {
+		container.Remove()
+	} else {
+		container.Release()
+	}
+
 	return nil
 }
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"m-docker/libcontainer/image"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker save 命令
+var SaveCommand = cli.Command{
+	Name:      "save",
+	Usage:     `save an image to a tar archive in OCI image layout format`,
+	UsageText: `m-docker save IMAGE [-o file.tar]`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "o, output", // 输出文件
+			Usage: "write to a file, instead of STDOUT",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return fmt.Errorf("\"m-docker save\" requires exactly 1 argument")
+		}
+
+		// 默认输出到标准输出
+		var out io.Writer = os.Stdout
+		if output := context.String("output"); output != "" {
+			file, err := os.Create(output)
+			if err != nil {
+				return fmt.Errorf("failed to create file %s: %v", output, err)
+			}
+			defer file.Close()
+			out = file
+		}
+
+		if err := image.Save(context.Args().First(), out); err != nil {
+			return fmt.Errorf("failed to save image: %v", err)
+		}
+		return nil
+	},
+}
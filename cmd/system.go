@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"m-docker/libcontainer"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// m-docker system 命令，管理 m-docker 数据的子命令
+var SystemCommand = cli.Command{
+	Name:  "system",
+	Usage: `manage m-docker`,
+	Subcommands: []cli.Command{
+		systemDfCommand,
+		systemPruneCommand,
+	},
+}
+
+// m-docker system df 命令
+var systemDfCommand = cli.Command{
+	Name:      "df",
+	Usage:     `show m-docker disk usage`,
+	UsageText: `m-docker system df`,
+
+	Action: func(context *cli.Context) error {
+		usages, err := libcontainer.GetDiskUsage()
+		if err != nil {
+			return fmt.Errorf("failed to get disk usage: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprintf(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE\n")
+		for _, u := range usages {
+			reclaimable := formatSize(u.Reclaimable)
+			if u.Size > 0 {
+				reclaimable += fmt.Sprintf(" (%d%%)", u.Reclaimable*100/u.Size)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", u.Type, u.Total, u.Active, formatSize(u.Size), reclaimable)
+		}
+		return w.Flush()
+	},
+}
+
+// m-docker system prune 命令
+var systemPruneCommand = cli.Command{
+	Name:      "prune",
+	Usage:     `remove unused data`,
+	UsageText: `m-docker system prune [-a] [-f] [--filter until=TIMESTAMP]`,
+	Description: `Remove all stopped containers, dangling images (all unused images with -a),
+   unreferenced layers and blobs. Volumes bind-mounted with -v are host
+   directories and are never removed.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "all, a", // 删除所有没有被容器使用的镜像
+			Usage: "remove all unused images not just dangling ones",
+		},
+		cli.BoolFlag{
+			Name:  "force, f", // 不进行确认
+			Usage: "do not prompt for confirmation",
+		},
+		cli.StringSliceFlag{
+			Name:  "filter", // 目前只支持 until
+			Usage: "provide filter values (e.g. 'until=24h')",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		opts := libcontainer.PruneOptions{All: context.Bool("all")}
+		for _, filter := range context.StringSlice("filter") {
+			key, value, _ := strings.Cut(filter, "=")
+			if key != "until" {
+				return fmt.Errorf("invalid filter %q", filter)
+			}
+			until, err := parseTimestamp(value, time.Now())
+			if err != nil {
+				return fmt.Errorf("invalid filter %q: %v", filter, err)
+			}
+			opts.Until = until
+		}
+
+		if !context.Bool("force") {
+			images := "dangling images"
+			if opts.All {
+				images = "images without at least one container associated to them\n  - all build cache"
+			}
+			fmt.Printf("WARNING! This will remove:\n  - all stopped containers\n  - all %s\n  - all unreferenced layers and blobs\n\nVolumes bind-mounted with -v are never removed.\n\nAre you sure you want to continue? [y/N] ", images)
+			if !confirm() {
+				return nil
+			}
+		}
+
+		report, err := libcontainer.Prune(opts)
+		if err != nil {
+			return fmt.Errorf("failed to prune: %v", err)
+		}
+		if len(report.Containers) > 0 {
+			fmt.Println("Deleted Containers:")
+			for _, id := range report.Containers {
+				fmt.Println(id)
+			}
+			fmt.Println()
+		}
+		if len(report.Images) > 0 {
+			fmt.Println("Deleted Images:")
+			for _, name := range report.Images {
+				fmt.Println(name)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("Deleted %d layers and %d blobs\n", report.Layers, report.Blobs)
+		fmt.Printf("Total reclaimed space: %s\n", formatSize(report.SpaceReclaimed))
+		return nil
+	},
+}
+
+// 纯数字的时间戳，可以带有小数部分
+var unixTimestampRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// 解析时间，支持相对于 now 的时长（如 24h）、Unix 时间戳、RFC3339 以及本地时间的日期和时间
+func parseTimestamp(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if unixTimestampRegexp.MatchString(value) {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unsupported timestamp %q", value)
+}
+
+// 从标准输入读取用户的确认
+func confirm() bool {
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
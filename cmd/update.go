@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"m-docker/libcontainer"
+	"m-docker/libcontainer/config"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// m-docker update 命令
+var UpdateCommand = cli.Command{
+	Name:      "update",
+	Usage:     `update resource limits of one or more containers`,
+	UsageText: `m-docker update [OPTIONS] CONTAINER [CONTAINER...]`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "mem", // 内存限制
+			Usage: "memory limit, max for no limit.	eg: -mem 100m",
+		},
+		cli.StringFlag{
+			Name:  "cpu", // CPU 使用率限制
+			Usage: "cpu limit, 0 for no limit.	eg: -cpu 0.5",
+		},
+		cli.StringFlag{
+			Name:  "net-ingress-rate", // 网络入站带宽限制
+			Usage: "limit inbound network bandwidth, 0 for no limit.	eg: --net-ingress-rate 10mbit",
+		},
+		cli.StringFlag{
+			Name:  "net-egress-rate", // 网络出站带宽限制
+			Usage: "limit outbound network bandwidth, 0 for no limit.	eg: --net-egress-rate 10mbit",
+		},
+	},
+
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("\"m-docker update\" requires at least 1 argument")
+		}
+		if context.NumFlags() == 0 {
+			return fmt.Errorf("you must provide one or more flags when using this command")
+		}
+
+		var failed bool
+		for _, name := range context.Args() {
+			if err := updateContainer(context, name); err != nil {
+				log.Errorf("failed to update container %s: %v", name, err)
+				failed = true
+				continue
+			}
+			fmt.Println(name)
+		}
+		if failed {
+			return fmt.Errorf("failed to update some containers")
+		}
+		return nil
+	},
+}
+
+// 在容器当前的资源限制的基础上修改命令行中指定的限制
+func updateContainer(context *cli.Context, nameOrID string) error {
+	conf, err := config.GetConfigFromNameOrPrefix(nameOrID)
+	if err != nil {
+		return err
+	}
+	var res config.Resources
+	if conf.Cgroup != nil && conf.Cgroup.Resources != nil {
+		res = *conf.Cgroup.Resources
+	}
+	if err := config.UpdateResources(context, &res); err != nil {
+		return err
+	}
+	return libcontainer.UpdateContainer(conf, &res)
+}
@@ -5,6 +5,8 @@ go 1.20
 require (
 	github.com/sirupsen/logrus v1.9.3
 	github.com/urfave/cli v1.22.15
+	github.com/vishvananda/netlink v1.1.0
+	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df
 	golang.org/x/exp v0.0.0-20240719175910-8a7402abbf56
 	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8
 )
@@ -0,0 +1,602 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// OCI 镜像层中 whiteout 文件的前缀，.wh.[name] 表示删除下层的 [name]
+	WhiteoutPrefix = ".wh."
+
+	// OCI 镜像层中的 opaque whiteout 文件，表示其所在目录会屏蔽下层的同名目录
+	WhiteoutOpaqueDir = ".wh..wh..opq"
+
+	// overlay 使用该 xattr 标记 opaque 目录
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+
+	// overlay 内部使用的 xattr 前缀，这些 xattr 不应该被打包
+	overlayXattrPrefix = "trusted.overlay."
+
+	// PAX 扩展头中记录 xattr 的前缀，与 GNU tar 和 docker 一致
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// 打包选项
+type TarOptions struct {
+	// 将 overlay 格式的 whiteout 转换为 OCI 格式，打包镜像层时使用
+	ConvertWhiteouts bool
+
+	// 不进入挂载在 src 之下的其他文件系统，类似于 tar --one-file-system
+	// 打包已经挂载的容器 rootfs 时，用于跳过 volume 等挂载点的内容
+	OneFileSystem bool
+
+	// src 自身在 tar 包中的名称，其中的文件以 [Name]/ 为前缀
+	// 为空时不打包 src 自身，只打包其中的内容，此时 src 必须是目录
+	Name string
+
+	// 只打包其中列出的路径，路径相对于 src 并以 / 开头，目录不会被递归打包
+	// 为 nil 时打包 src 下的所有内容
+	IncludePaths []string
+
+	// 在 tar 包中为这些路径写入 OCI 格式的 whiteout，表示它们被删除了，路径格式与 IncludePaths 相同
+	Whiteouts []string
+}
+
+// 解压选项
+type UntarOptions struct {
+	// 将 OCI 格式的 whiteout 转换为 overlay 格式，解压镜像层时使用
+	ConvertWhiteouts bool
+
+	// 直接删除 OCI 格式的 whiteout 所表示的文件，将镜像层应用到完整的文件系统上时使用
+	ApplyWhiteouts bool
+}
+
+// 符号链接的最大解析次数，与内核的限制一致
+const maxSymlinks = 40
+
+// 将镜像层的 tar 流解压到 dest 目录下
+// 解压时会将 OCI 格式的 whiteout 文件转换为 overlay 格式：
+// .wh.[name] 转换为设备号为 0/0 的字符设备 [name]，.wh..wh..opq 转换为所在目录上的 trusted.overlay.opaque=y
+func Untar(r io.Reader, dest string) error {
+	return UntarWithOptions(r, dest, &UntarOptions{ConvertWhiteouts: true})
+}
+
+// 按照指定的选项将 tar 流解压到 dest 目录下
+// 通过 ../ 指向 dest 之外的条目会被拒绝，条目路径中的符号链接则被限制在 dest 之内解析，因此 tar 包无法写入 dest 之外的文件
+func UntarWithOptions(r io.Reader, dest string, opts *UntarOptions) error {
+	tr := tar.NewReader(r)
+	// 目录的修改时间在创建其中的文件时会被更新，因此最后再设置
+	var dirs []*tar.Header
+	var dirTargets []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			for i := len(dirs) - 1; i >= 0; i-- {
+				if err := setModTime(dirTargets[i], dirs[i]); err != nil {
+					return fmt.Errorf("failed to set mtime of %s: %v", dirs[i].Name, err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %v", err)
+		}
+
+		if err := checkEntryName(hdr.Name); err != nil {
+			return err
+		}
+		target, err := resolveEntry(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == dest {
+			// dest 自身，如 ./
+			continue
+		}
+		dir, base := filepath.Split(target)
+
+		if opts.ApplyWhiteouts && strings.HasPrefix(base, WhiteoutPrefix) {
+			if err := applyWhiteout(dir, base); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !opts.ConvertWhiteouts {
+			if err := extractEntry(tr, hdr, dest, target); err != nil {
+				return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+			}
+			if hdr.Typeflag == tar.TypeDir {
+				dirs, dirTargets = append(dirs, hdr), append(dirTargets, target)
+			}
+			continue
+		}
+
+		// opaque whiteout，将所在目录标记为 opaque
+		if base == WhiteoutOpaqueDir {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create dir %s: %v", dir, err)
+			}
+			if err := unix.Setxattr(dir, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+				return fmt.Errorf("failed to set opaque xattr on %s: %v", dir, err)
+			}
+			continue
+		}
+		// 普通 whiteout，转换为 0/0 字符设备
+		if strings.HasPrefix(base, WhiteoutPrefix) {
+			target = filepath.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to remove %s: %v", target, err)
+			}
+			if err := unix.Mknod(target, unix.S_IFCHR, 0); err != nil {
+				return fmt.Errorf("failed to create whiteout %s: %v", target, err)
+			}
+			continue
+		}
+
+		if err := extractEntry(tr, hdr, dest, target); err != nil {
+			return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs, dirTargets = append(dirs, hdr), append(dirTargets, target)
+		}
+	}
+}
+
+// 删除 whiteout 所表示的文件，opaque whiteout 则清空其所在目录中已有的内容
+// 镜像层中 opaque whiteout 位于同一目录下的其他文件之前，因此不会删除本层的文件
+func applyWhiteout(dir string, base string) error {
+	if base == WhiteoutOpaqueDir {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read dir %s: %v", dir, err)
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+				return fmt.Errorf("failed to remove %s: %v", entry.Name(), err)
+			}
+		}
+		return nil
+	}
+	target := filepath.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+	if err := os.RemoveAll(target); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", target, err)
+	}
+	return nil
+}
+
+// 按照 tar 头设置文件的修改时间，符号链接本身的时间也会被设置
+func setModTime(target string, hdr *tar.Header) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(hdr.AccessTime.UnixNano()),
+		unix.NsecToTimespec(hdr.ModTime.UnixNano()),
+	}
+	if hdr.AccessTime.IsZero() {
+		ts[0] = ts[1]
+	}
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+	// 部分文件系统不支持设置符号链接的时间
+	if err == unix.ENOTSUP && hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	return err
+}
+
+// 解压 tar 包中的单个条目
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dest string, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	// 除目录外，已存在的同名文件需要先删除，上层的文件会覆盖下层
+	if hdr.Typeflag != tar.TypeDir {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, os.FileMode(mode)); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, tr); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		if err := checkEntryName(hdr.Linkname); err != nil {
+			return err
+		}
+		source, err := resolveEntry(dest, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	case tar.TypeChar:
+		if err := unix.Mknod(target, unix.S_IFCHR|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+			return err
+		}
+	case tar.TypeBlock:
+		if err := unix.Mknod(target, unix.S_IFBLK|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+			return err
+		}
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(target, mode); err != nil {
+			return err
+		}
+	default:
+		// 其余类型（如 PAX 全局头）直接忽略
+		return nil
+	}
+
+	// 先 chown 再 chmod，因为 chown 会清除 setuid/setgid 位
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	// 符号链接本身没有权限，chmod 会作用到它指向的文件上
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(target, os.FileMode(mode)|tarModeBits(mode)); err != nil {
+			return err
+		}
+	}
+
+	// xattr 最后设置，因为 chown 同样会清除 security.capability
+	for key, value := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(target, name, []byte(value), 0); err != nil {
+			// 目标文件系统不支持 xattr 时忽略
+			if err == unix.ENOTSUP {
+				continue
+			}
+			return fmt.Errorf("failed to set xattr %s: %v", name, err)
+		}
+	}
+
+	if hdr.Typeflag != tar.TypeDir {
+		return setModTime(target, hdr)
+	}
+	return nil
+}
+
+// 将 tar 中的 setuid、setgid、sticky 位转换为 os.FileMode 中对应的位
+func tarModeBits(mode uint32) os.FileMode {
+	var m os.FileMode
+	if mode&unix.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// 将镜像层目录 src 打包为 tar 流写入 w
+// 打包时会将 overlay 格式的 whiteout 转换回 OCI 格式，是 Untar 的逆过程
+func Tar(src string, w io.Writer) error {
+	return TarWithOptions(src, w, &TarOptions{ConvertWhiteouts: true})
+}
+
+// 按照指定的选项将 src 目录打包为 tar 流写入 w
+// 文件的属主、权限、xattr 以及设备号都会被保留，socket 文件则会被忽略
+func TarWithOptions(src string, w io.Writer, opts *TarOptions) error {
+	tw := tar.NewWriter(w)
+	// 记录已经打包过的 inode，用于还原硬链接
+	inodes := make(map[uint64]string)
+
+	var rootDev uint64
+	if opts.OneFileSystem {
+		var st unix.Stat_t
+		if err := unix.Lstat(src, &st); err != nil {
+			return fmt.Errorf("failed to stat %s: %v", src, err)
+		}
+		rootDev = st.Dev
+	}
+
+	addEntry := func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if opts.Name != "" {
+			rel = filepath.Join(opts.Name, rel)
+		} else if rel == "." {
+			return nil
+		}
+		stat, _ := fi.Sys().(*syscall.Stat_t)
+
+		// socket 无法被打包
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		// 设备号为 0/0 的字符设备是 overlay 的 whiteout，转换为 .wh.[name]
+		if opts.ConvertWhiteouts && IsWhiteout(fi) {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(filepath.Dir(rel), WhiteoutPrefix+fi.Name()),
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			})
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		// 容器内的用户名与宿主机无关，只保留 uid 和 gid
+		hdr.Uname, hdr.Gname = "", ""
+		if err := readXattrs(p, hdr); err != nil {
+			return err
+		}
+
+		// 硬链接只打包一次文件内容，其余的链接记录为 TypeLink
+		if fi.Mode().IsRegular() && stat != nil && stat.Nlink > 1 {
+			if first, ok := inodes[stat.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				inodes[stat.Ino] = rel
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			file, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		// 其他文件系统的挂载点只打包目录本身，不打包其中的内容
+		if fi.IsDir() && opts.OneFileSystem && stat != nil && stat.Dev != rootDev {
+			return filepath.SkipDir
+		}
+
+		// overlay 的 opaque 目录，转换为目录下的 .wh..wh..opq
+		if opts.ConvertWhiteouts && fi.IsDir() && IsOpaqueDir(p) {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(rel, WhiteoutOpaqueDir),
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			})
+		}
+		return nil
+	}
+
+	var err error
+	if opts.IncludePaths == nil && opts.Whiteouts == nil {
+		err = filepath.Walk(src, addEntry)
+	} else {
+		err = tarIncludedPaths(tw, src, opts, addEntry)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to tar %s: %v", src, err)
+	}
+
+	return tw.Close()
+}
+
+// 只打包 IncludePaths 中列出的路径，并写入 Whiteouts 中的 whiteout
+// 路径按字典序排列后打包，保证目录出现在其中的文件之前
+func tarIncludedPaths(tw *tar.Writer, src string, opts *TarOptions, addEntry filepath.WalkFunc) error {
+	paths := append([]string{}, opts.IncludePaths...)
+	sort.Strings(paths)
+	for _, p := range paths {
+		full := filepath.Join(src, filepath.Clean("/"+p))
+		fi, err := os.Lstat(full)
+		if err := addEntry(full, fi, err); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+
+	whiteouts := append([]string{}, opts.Whiteouts...)
+	sort.Strings(whiteouts)
+	for _, p := range whiteouts {
+		rel := strings.TrimPrefix(filepath.Clean("/"+p), "/")
+		if rel == "" {
+			return fmt.Errorf("can not whiteout the root")
+		}
+		if opts.Name != "" {
+			rel = filepath.Join(opts.Name, rel)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.Join(filepath.Dir(rel), WhiteoutPrefix+filepath.Base(rel)),
+			Mode:     0600,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读取文件的 xattr，记录到 tar 的 PAX 扩展头中
+// overlay 内部使用的 xattr 不会被记录
+func readXattrs(p string, hdr *tar.Header) error {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil
+		}
+		return fmt.Errorf("failed to list xattrs of %s: %v", p, err)
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return fmt.Errorf("failed to list xattrs of %s: %v", p, err)
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" || strings.HasPrefix(name, overlayXattrPrefix) {
+			continue
+		}
+		value, err := getXattr(p, name)
+		if err != nil {
+			return fmt.Errorf("failed to get xattr %s of %s: %v", name, p, err)
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattrPrefix+name] = string(value)
+	}
+	return nil
+}
+
+// 读取单个 xattr 的值
+func getXattr(p string, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(p, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(p, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// 判断文件是否为 overlay 的 whiteout，即设备号为 0/0 的字符设备
+func IsWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// 判断目录是否被 overlay 标记为 opaque
+func IsOpaqueDir(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, overlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// 拒绝通过 .. 指向解压目录之外的条目名称，绝对路径视为相对于解压目录
+func checkEntryName(name string) error {
+	cleaned := filepath.Clean(strings.TrimLeft(name, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("invalid path in archive %s: outside of the destination", name)
+	}
+	return nil
+}
+
+// 获取 tar 包中的条目在 dest 下的路径
+// 父目录中的符号链接限制在 dest 之内解析，条目自身则不解析，因为它将被覆盖
+func resolveEntry(dest string, name string) (string, error) {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return dest, nil
+	}
+	dir, err := ResolvePath(dest, filepath.Dir(name))
+	if err != nil {
+		return "", fmt.Errorf("invalid path in archive %s: %v", name, err)
+	}
+	return filepath.Join(dir, filepath.Base(name)), nil
+}
+
+// 将 unsafePath 视为以 root 为根目录的路径进行解析，返回其在宿主机上的路径
+// 路径中的 .. 和符号链接都被限制在 root 之内，与在 chroot 到 root 之后解析的结果相同，
+// 因此可以安全地用于访问容器文件系统中的路径；不存在的部分按字面拼接
+func ResolvePath(root string, unsafePath string) (string, error) {
+	resolved := "/"
+	remaining := filepath.Clean("/" + unsafePath)
+	links := 0
+	for remaining != "" {
+		remaining = strings.TrimLeft(remaining, "/")
+		if remaining == "" {
+			break
+		}
+		part, rest, _ := strings.Cut(remaining, "/")
+		remaining = rest
+
+		switch part {
+		case ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		// 符号链接的目标替换当前部分，绝对路径的目标从 root 重新开始解析
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", unsafePath)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		remaining = link + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
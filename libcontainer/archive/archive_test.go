@@ -0,0 +1,307 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// tar 包中的一个条目，Body 为普通文件的内容
+type testEntry struct {
+	Name     string
+	Typeflag byte
+	Body     string
+	Linkname string
+}
+
+// 将条目打包为 tar 流
+func makeTar(t *testing.T, entries ...testEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Typeflag: e.Typeflag, Linkname: e.Linkname, Mode: 0644, Size: int64(len(e.Body))}
+		if e.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// tar 流中所有条目的名称，按字典序排列
+func tarNames(t *testing.T, r io.Reader) []string {
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 创建和读取 overlay 格式的 whiteout 需要 root 权限以及支持 trusted.* xattr 的文件系统
+func requireWhiteoutSupport(t *testing.T, dir string) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create whiteouts")
+	}
+	if err := unix.Setxattr(dir, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("trusted xattrs are not supported: %v", err)
+	}
+	if err := unix.Removexattr(dir, overlayOpaqueXattr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUntarConvertsWhiteouts(t *testing.T) {
+	dest := t.TempDir()
+	requireWhiteoutSupport(t, dest)
+	// 下层中已经存在的文件被 whiteout 替换
+	if err := os.WriteFile(filepath.Join(dest, "deleted"), []byte("lower"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := makeTar(t,
+		testEntry{Name: "dir/", Typeflag: tar.TypeDir},
+		testEntry{Name: "dir/.wh..wh..opq", Typeflag: tar.TypeReg},
+		testEntry{Name: "dir/file", Typeflag: tar.TypeReg, Body: "upper"},
+		testEntry{Name: ".wh.deleted", Typeflag: tar.TypeReg},
+	)
+	if err := Untar(layer, dest); err != nil {
+		t.Fatalf("Untar: %v", err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dest, "deleted"))
+	if err != nil || !IsWhiteout(fi) {
+		t.Errorf("deleted is not converted to a whiteout: %v", err)
+	}
+	if !IsOpaqueDir(filepath.Join(dest, "dir")) {
+		t.Error("dir is not marked opaque")
+	}
+	for _, name := range []string{".wh.deleted", "dir/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is extracted as a file: %v", name, err)
+		}
+	}
+	if content, err := os.ReadFile(filepath.Join(dest, "dir/file")); err != nil || string(content) != "upper" {
+		t.Errorf("dir/file = %q, %v", content, err)
+	}
+
+	// 打包时转换回 OCI 格式
+	var buf bytes.Buffer
+	if err := Tar(dest, &buf); err != nil {
+		t.Fatalf("Tar: %v", err)
+	}
+	want := []string{".wh.deleted", "dir/", "dir/.wh..wh..opq", "dir/file"}
+	if got := tarNames(t, &buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("tar entries = %q, want %q", got, want)
+	}
+}
+
+func TestTarWithoutConvertingWhiteouts(t *testing.T) {
+	src := t.TempDir()
+	requireWhiteoutSupport(t, src)
+	if err := unix.Mknod(filepath.Join(src, "deleted"), unix.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := TarWithOptions(src, &buf, &TarOptions{}); err != nil {
+		t.Fatalf("TarWithOptions: %v", err)
+	}
+	if got := tarNames(t, &buf); !reflect.DeepEqual(got, []string{"deleted"}) {
+		t.Errorf("tar entries = %q, want the whiteout device itself", got)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"usr/lib", "etc"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"abs":         "/etc",
+		"rel":         "usr/lib",
+		"up":          "../../../../etc",
+		"usr/lib/dot": "..",
+		"chain":       "abs",
+		"loop1":       "loop2",
+		"loop2":       "loop1",
+		"usr/escape":  "/../../..",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]string{
+		"/":                  "/",
+		"etc/passwd":         "/etc/passwd",
+		"../../etc":          "/etc",
+		"/usr/./lib/../lib":  "/usr/lib",
+		"abs/passwd":         "/etc/passwd",
+		"rel/x":              "/usr/lib/x",
+		"up/passwd":          "/etc/passwd",
+		"usr/lib/dot/lib":    "/usr/lib",
+		"chain/x":            "/etc/x",
+		"usr/escape/etc":     "/etc",
+		"missing/../etc":     "/etc",
+		"missing/child/file": "/missing/child/file",
+		// 最后一部分是符号链接时同样会被解析
+		"abs": "/etc",
+	}
+	for p, want := range tests {
+		got, err := ResolvePath(root, p)
+		if err != nil {
+			t.Errorf("ResolvePath(%q): %v", p, err)
+			continue
+		}
+		if got != filepath.Join(root, want) {
+			t.Errorf("ResolvePath(%q) = %s, want %s", p, got, filepath.Join(root, want))
+		}
+	}
+
+	if _, err := ResolvePath(root, "loop1/x"); err == nil {
+		t.Error("ResolvePath of a symlink loop succeeded")
+	}
+}
+
+func TestUntarThroughSymlinkStaysInDest(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to chown extracted files")
+	}
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "dest")
+	outside := filepath.Join(parent, "outside")
+	for _, dir := range []string{dest, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// dest 中已经存在指向外部的符号链接，如容器 rootfs 中的恶意链接
+	if err := os.Symlink(outside, filepath.Join(dest, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := makeTar(t,
+		testEntry{Name: "link/file", Typeflag: tar.TypeReg, Body: "data"},
+		// tar 包中先创建符号链接，再通过它写入文件
+		testEntry{Name: "link2", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+		testEntry{Name: "link2/file2", Typeflag: tar.TypeReg, Body: "data"},
+	)
+	if err := UntarWithOptions(layer, dest, &UntarOptions{}); err != nil {
+		t.Fatalf("UntarWithOptions: %v", err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("files are written outside of dest: %v", entries)
+	}
+	// 绝对路径的链接从 dest 开始解析
+	for _, name := range []string{filepath.Join(outside, "file"), "outside/file2"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("%s is not extracted inside dest: %v", name, err)
+		}
+	}
+}
+
+func TestUntarRejectsEscapingEntries(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to chown extracted files")
+	}
+	parent := t.TempDir()
+	secret := filepath.Join(parent, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]testEntry{
+		"dotdot name":      {{Name: "../escaped", Typeflag: tar.TypeReg, Body: "x"}},
+		"nested dotdot":    {{Name: "a/../../escaped", Typeflag: tar.TypeReg, Body: "x"}},
+		"dotdot hardlink":  {{Name: "link", Typeflag: tar.TypeLink, Linkname: "../secret"}},
+		"nested hardlink":  {{Name: "link", Typeflag: tar.TypeLink, Linkname: "a/../../secret"}},
+		"dotdot whiteout":  {{Name: "../.wh.secret", Typeflag: tar.TypeReg}},
+		"dotdot directory": {{Name: "../escaped/", Typeflag: tar.TypeDir}},
+	}
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			dest := filepath.Join(parent, "dest")
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dest)
+			err := UntarWithOptions(makeTar(t, entries...), dest, &UntarOptions{ApplyWhiteouts: true})
+			if err == nil || !strings.Contains(err.Error(), "outside of the destination") {
+				t.Errorf("UntarWithOptions error = %v", err)
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "escaped")); !os.IsNotExist(err) {
+				t.Errorf("file is written outside of dest: %v", err)
+			}
+			if _, err := os.Stat(secret); err != nil {
+				t.Errorf("file outside of dest is removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestUntarHardlinkThroughSymlinkStaysInDest(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to chown extracted files")
+	}
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(parent, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 硬链接的源文件同样限制在 dest 之内解析，符号链接 up 指向的是 dest 自身
+	layer := makeTar(t,
+		testEntry{Name: "up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		testEntry{Name: "link", Typeflag: tar.TypeLink, Linkname: "up/secret"},
+	)
+	err := UntarWithOptions(layer, dest, &UntarOptions{})
+	if err == nil {
+		t.Error("hardlink to a file outside of dest succeeded")
+	}
+	if content, err := os.ReadFile(filepath.Join(dest, "link")); err == nil {
+		t.Errorf("link points to %q", content)
+	}
+
+	// 指向 dest 中已有文件的硬链接
+	layer = makeTar(t,
+		testEntry{Name: "file", Typeflag: tar.TypeReg, Body: "data"},
+		testEntry{Name: "link", Typeflag: tar.TypeLink, Linkname: "/up/file"},
+	)
+	if err := UntarWithOptions(layer, dest, &UntarOptions{}); err != nil {
+		t.Fatalf("UntarWithOptions: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dest, "link")); err != nil || string(content) != "data" {
+		t.Errorf("link = %q, %v", content, err)
+	}
+}
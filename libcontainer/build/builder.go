@@ -0,0 +1,408 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"m-docker/libcontainer"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/image"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 构建镜像的选项
+type Options struct {
+	// 构建上下文目录，COPY 和 ADD 的源路径都相对于该目录
+	ContextDir string
+
+	// Dockerfile 的路径
+	Dockerfile string
+
+	// 构建出的镜像名称
+	Tag string
+
+	// 通过 --build-arg 指定的构建参数
+	BuildArgs map[string]string
+
+	// 是否禁用构建缓存
+	NoCache bool
+
+	// 构建进度的输出
+	Out io.Writer
+}
+
+// 构建过程中镜像的状态
+type builder struct {
+	opts *Options
+
+	// 已经执行过 FROM 指令
+	fromDone bool
+
+	// 当前镜像的所有镜像层的 diffID，按照自底向上的顺序排列
+	layers []string
+
+	// 当前镜像最上层的 chainID
+	chainID string
+
+	// 当前镜像的默认运行配置
+	config *image.ImageConfig
+
+	// 当前 Dockerfile 中是否设置过 CMD
+	cmdSet bool
+
+	// 已经声明的构建参数
+	args map[string]string
+
+	// 镜像的构建历史，包括从基础镜像继承的部分
+	history []image.History
+}
+
+// 根据 Dockerfile 构建镜像
+func Build(opts *Options) (*image.Image, error) {
+	file, err := os.Open(opts.Dockerfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dockerfile: %v", err)
+	}
+	instructions, err := Parse(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// 构建过程中创建的镜像层在保存镜像之前没有被引用，需要一直持有镜像存储的共享锁
+	unlock, err := image.LockStore()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	b := &builder{
+		opts:   opts,
+		config: &image.ImageConfig{},
+		args:   make(map[string]string),
+	}
+	for i, inst := range instructions {
+		fmt.Fprintf(opts.Out, "Step %d/%d : %s\n", i+1, len(instructions), inst.Original)
+		layers := len(b.layers)
+		if err := b.dispatch(inst); err != nil {
+			return nil, fmt.Errorf("line %d: %v", inst.Line, err)
+		}
+		b.recordHistory(inst, len(b.layers) == layers)
+	}
+	if !b.fromDone {
+		return nil, fmt.Errorf("no FROM instruction in dockerfile")
+	}
+	if len(b.layers) == 0 {
+		return nil, fmt.Errorf("image has no layers")
+	}
+
+	now := time.Now().UTC()
+	img := &image.Image{
+		Name:    opts.Tag,
+		Layers:  b.layers,
+		Config:  b.config,
+		Created: &now,
+		History: b.history,
+	}
+	if err := image.SaveImage(img); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(opts.Out, "Successfully built %s\n", opts.Tag)
+	return img, nil
+}
+
+// 将指令记录到镜像的构建历史中，FROM 和 ARG 指令不会被记录
+func (b *builder) recordHistory(inst *Instruction, emptyLayer bool) {
+	if inst.Command == "FROM" || inst.Command == "ARG" {
+		return
+	}
+	now := time.Now().UTC()
+	b.history = append(b.history, image.History{
+		Created:    &now,
+		CreatedBy:  inst.Original,
+		EmptyLayer: emptyLayer,
+	})
+}
+
+// 执行单条指令
+func (b *builder) dispatch(inst *Instruction) error {
+	if !b.fromDone && inst.Command != "FROM" && inst.Command != "ARG" {
+		return fmt.Errorf("%s before FROM", inst.Command)
+	}
+
+	switch inst.Command {
+	case "FROM":
+		return b.from(inst)
+	case "ARG":
+		return b.arg(inst)
+	case "ENV":
+		return b.env(inst)
+	case "LABEL":
+		return b.label(inst)
+	case "WORKDIR":
+		b.config.WorkingDir = b.resolvePath(b.expand(inst.Args[0]))
+		return nil
+	case "USER":
+		b.config.User = b.expand(inst.Args[0])
+		return nil
+	case "CMD":
+		b.config.Cmd = commandArgs(inst)
+		b.cmdSet = true
+		return nil
+	case "ENTRYPOINT":
+		b.config.Entrypoint = commandArgs(inst)
+		// 与 docker 一致，设置 ENTRYPOINT 时会清空从基础镜像继承的 CMD
+		if !b.cmdSet {
+			b.config.Cmd = nil
+		}
+		return nil
+	case "RUN":
+		return b.run(inst)
+	case "COPY", "ADD":
+		return b.copy(inst)
+	}
+	return fmt.Errorf("unsupported instruction %s", inst.Command)
+}
+
+// FROM 指令，以指定的镜像为基础镜像
+func (b *builder) from(inst *Instruction) error {
+	if b.fromDone {
+		return fmt.Errorf("multi-stage builds are not supported")
+	}
+	b.fromDone = true
+
+	name := b.expand(inst.Args[0])
+	// scratch 表示空镜像
+	if name == "scratch" {
+		return nil
+	}
+
+	img, err := image.GetImage(name)
+	if err != nil {
+		return err
+	}
+	if _, err := img.LayerDirs(); err != nil {
+		return err
+	}
+	chainIDs := img.ChainIDs()
+	b.layers = append([]string{}, img.Layers...)
+	b.chainID = chainIDs[len(chainIDs)-1]
+	b.history = img.LayerHistory()
+	if img.Config != nil {
+		// 深拷贝基础镜像的配置，避免修改基础镜像
+		data, _ := json.Marshal(img.Config)
+		_ = json.Unmarshal(data, b.config)
+	}
+	return nil
+}
+
+// ARG 指令，声明构建参数，格式为 name[=default]
+func (b *builder) arg(inst *Instruction) error {
+	for _, arg := range inst.Args {
+		name, value, hasDefault := strings.Cut(arg, "=")
+		if name == "" {
+			return fmt.Errorf("invalid ARG: %s", arg)
+		}
+		if v, ok := b.opts.BuildArgs[name]; ok {
+			b.args[name] = v
+		} else if hasDefault {
+			b.args[name] = b.expand(value)
+		} else {
+			b.args[name] = ""
+		}
+	}
+	return nil
+}
+
+// ENV 指令，设置环境变量，支持 ENV key=value ... 和 ENV key value 两种格式
+func (b *builder) env(inst *Instruction) error {
+	pairs, err := parsePairs(inst.Args)
+	if err != nil {
+		return err
+	}
+	for _, kv := range pairs {
+		b.config.Env = setEnv(b.config.Env, kv[0], b.expand(kv[1]))
+	}
+	return nil
+}
+
+// LABEL 指令，设置镜像的标签
+func (b *builder) label(inst *Instruction) error {
+	pairs, err := parsePairs(inst.Args)
+	if err != nil {
+		return err
+	}
+	if b.config.Labels == nil {
+		b.config.Labels = make(map[string]string)
+	}
+	for _, kv := range pairs {
+		b.config.Labels[b.expand(kv[0])] = b.expand(kv[1])
+	}
+	return nil
+}
+
+// RUN 指令，在临时容器中运行命令，并将容器读写层的变化作为新的镜像层
+func (b *builder) run(inst *Instruction) error {
+	if len(b.layers) == 0 {
+		return fmt.Errorf("RUN can not be used on an empty image")
+	}
+	cmdArray := commandArgs(inst)
+
+	// 构建参数也以环境变量的形式传递给命令，但同名时以 ENV 为准，且不会保存到镜像中
+	env := append([]string{}, b.config.Env...)
+	for name, value := range b.args {
+		if _, ok := lookupEnv(env, name); !ok {
+			env = append(env, name+"="+value)
+		}
+	}
+
+	key := cacheKey(b.chainID, "RUN", cmdArray, env, b.config.WorkingDir, b.config.User)
+	if b.useCache(key) {
+		return nil
+	}
+
+	dirs, err := (&image.Image{Layers: b.layers}).LayerDirs()
+	if err != nil {
+		return err
+	}
+	conf := config.CreateBuildConfig(dirs, cmdArray, env, b.config.WorkingDir, b.config.User)
+	fmt.Fprintf(b.opts.Out, " ---> Running in %s\n", conf.ID[:12])
+	if err := b.runContainer(conf); err != nil {
+		return err
+	}
+	return b.saveCache(key)
+}
+
+// 运行临时容器，结束后将其读写层提交为新的镜像层
+func (b *builder) runContainer(conf *config.Config) error {
+	container, err := libcontainer.NewContainer(conf, false)
+	if err != nil {
+		return fmt.Errorf("failed to create container object: %v", err)
+	}
+	defer container.Remove()
+
+	if err := container.Create(); err != nil {
+		return fmt.Errorf("failed to setup container environment: %v", err)
+	}
+	if err := container.Start(); err != nil {
+		return fmt.Errorf("failed to start container: %v", err)
+	}
+	if conf.ExitCode != 0 {
+		return fmt.Errorf("the command '%s' returned a non-zero code: %d", strings.Join(conf.CmdArray, " "), conf.ExitCode)
+	}
+
+	// 读写层中的修改即为命令对文件系统的修改
+	layer, err := libcontainer.CommitLayer(conf, b.chainID)
+	if err != nil {
+		return err
+	}
+	b.addLayer(layer)
+	return nil
+}
+
+// 将目录打包为新的镜像层，叠加到当前镜像之上
+func (b *builder) commitDir(dir string) error {
+	layer, err := image.CreateLayerFromDir(b.chainID, dir)
+	if err != nil {
+		return fmt.Errorf("failed to create layer: %v", err)
+	}
+
+	b.addLayer(layer)
+	return nil
+}
+
+// 将镜像层叠加到当前镜像之上
+func (b *builder) addLayer(layer *image.Layer) {
+	b.layers = append(b.layers, layer.DiffID)
+	b.chainID = layer.ChainID
+	fmt.Fprintf(b.opts.Out, " ---> %s\n", shortID(layer.ChainID))
+}
+
+// 将 RUN 等指令中的命令转换为参数数组，shell 形式的命令使用 /bin/sh -c 运行
+func commandArgs(inst *Instruction) []string {
+	if inst.JSONForm {
+		return inst.Args
+	}
+	return []string{"/bin/sh", "-c", inst.Args[0]}
+}
+
+// 将 WORKDIR 等指令中的相对路径转换为绝对路径
+func (b *builder) resolvePath(p string) string {
+	if !path.IsAbs(p) {
+		base := b.config.WorkingDir
+		if base == "" {
+			base = "/"
+		}
+		p = path.Join(base, p)
+	}
+	return path.Clean(p)
+}
+
+// 展开参数中的 $VAR 和 ${VAR}，ENV 设置的环境变量优先于 ARG 声明的构建参数
+func (b *builder) expand(s string) string {
+	return os.Expand(s, func(name string) string {
+		if value, ok := lookupEnv(b.config.Env, name); ok {
+			return value
+		}
+		return b.args[name]
+	})
+}
+
+// 解析 key=value ... 或 key value 格式的参数
+func parsePairs(args []string) ([][2]string, error) {
+	if !strings.Contains(args[0], "=") {
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s requires a value", args[0])
+		}
+		return [][2]string{{args[0], strings.Join(args[1:], " ")}}, nil
+	}
+
+	pairs := make([][2]string, 0, len(args))
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid key=value pair: %s", arg)
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	return pairs, nil
+}
+
+// 在环境变量列表中查找变量
+func lookupEnv(env []string, name string) (string, bool) {
+	for _, kv := range env {
+		if key, value, _ := strings.Cut(kv, "="); key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// 设置环境变量列表中的变量，已经存在时替换
+func setEnv(env []string, name string, value string) []string {
+	for i, kv := range env {
+		if key, _, _ := strings.Cut(kv, "="); key == name {
+			env[i] = name + "=" + value
+			return env
+		}
+	}
+	return append(env, name+"="+value)
+}
+
+// 将上下文中的相对路径转换为宿主机上的绝对路径，且不允许跳出上下文目录
+func (b *builder) contextPath(p string) string {
+	return filepath.Join(b.opts.ContextDir, filepath.Clean("/"+p))
+}
+
+// 将镜像层的 chainID 缩写为 12 位，用于输出
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,189 @@
+package build
+
+import (
+	"io"
+	"m-docker/libcontainer/image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 已经执行过 FROM 的构建状态，基础镜像的配置为 base
+func newTestBuilder(base *image.ImageConfig, buildArgs map[string]string) *builder {
+	if base == nil {
+		base = &image.ImageConfig{}
+	}
+	return &builder{
+		opts:     &Options{BuildArgs: buildArgs, Out: io.Discard},
+		fromDone: true,
+		config:   base,
+		args:     make(map[string]string),
+	}
+}
+
+// 依次执行 Dockerfile 中除 FROM 之外的不会创建镜像层的指令
+func dispatchAll(t *testing.T, b *builder, dockerfile string) {
+	instructions, err := Parse(strings.NewReader("FROM scratch\n" + dockerfile))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	for _, inst := range instructions[1:] {
+		if err := b.dispatch(inst); err != nil {
+			t.Fatalf("line %d: %v", inst.Line, err)
+		}
+	}
+}
+
+func TestParsePairs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want [][2]string
+		err  string
+	}{
+		{args: []string{"A", "1"}, want: [][2]string{{"A", "1"}}},
+		{args: []string{"A", "two", "words"}, want: [][2]string{{"A", "two words"}}},
+		{args: []string{"A=1", "B=", "C=x=y"}, want: [][2]string{{"A", "1"}, {"B", ""}, {"C", "x=y"}}},
+		{args: []string{"A"}, err: "A requires a value"},
+		{args: []string{"A=1", "B"}, err: "invalid key=value pair: B"},
+		{args: []string{"=1"}, err: "invalid key=value pair: =1"},
+	}
+	for _, tt := range tests {
+		got, err := parsePairs(tt.args)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parsePairs(%q) error = %v, want %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePairs(%q) = %q, %v, want %q", tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	b := newTestBuilder(&image.ImageConfig{Env: []string{"NAME=env", "EMPTY="}}, nil)
+	b.args = map[string]string{"NAME": "arg", "VERSION": "1.0", "EMPTY": "arg"}
+	tests := map[string]string{
+		"$VERSION":           "1.0",
+		"${VERSION}-x":       "1.0-x",
+		"$NAME":              "env",
+		"[$EMPTY]":           "[]",
+		"$UNDEFINED":         "",
+		"no variables":       "no variables",
+		"/opt/app-${NAME}/x": "/opt/app-env/x",
+	}
+	for s, want := range tests {
+		if got := b.expand(s); got != want {
+			t.Errorf("expand(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestArgAndEnv(t *testing.T) {
+	b := newTestBuilder(&image.ImageConfig{Env: []string{"PATH=/bin"}}, map[string]string{"VERSION": "2.0"})
+	dispatchAll(t, b, `ARG VERSION=1.0 DIR=/opt
+ARG UNSET
+ENV APP=$DIR/app PATH=$DIR/bin:$PATH
+ENV GREETING hello world
+LABEL version=$VERSION "a b"=c
+`)
+	if !reflect.DeepEqual(b.args, map[string]string{"VERSION": "2.0", "DIR": "/opt", "UNSET": ""}) {
+		t.Errorf("args = %v", b.args)
+	}
+	want := []string{"PATH=/opt/bin:/bin", "APP=/opt/app", "GREETING=hello world"}
+	if !reflect.DeepEqual(b.config.Env, want) {
+		t.Errorf("env = %q, want %q", b.config.Env, want)
+	}
+	if !reflect.DeepEqual(b.config.Labels, map[string]string{"version": "2.0", "a b": "c"}) {
+		t.Errorf("labels = %v", b.config.Labels)
+	}
+}
+
+func TestWorkdirAndUser(t *testing.T) {
+	b := newTestBuilder(nil, nil)
+	dispatchAll(t, b, `ARG USERNAME=app
+WORKDIR app
+WORKDIR ../srv/./data
+USER $USERNAME
+`)
+	if b.config.WorkingDir != "/srv/data" {
+		t.Errorf("working dir = %q", b.config.WorkingDir)
+	}
+	if b.config.User != "app" {
+		t.Errorf("user = %q", b.config.User)
+	}
+}
+
+func TestEntrypointAndCmd(t *testing.T) {
+	tests := []struct {
+		name       string
+		base       *image.ImageConfig
+		dockerfile string
+		entrypoint []string
+		cmd        []string
+	}{
+		{
+			name:       "entrypoint resets inherited cmd",
+			base:       &image.ImageConfig{Cmd: []string{"sh"}},
+			dockerfile: `ENTRYPOINT ["/app"]`,
+			entrypoint: []string{"/app"},
+		},
+		{
+			name:       "cmd set before entrypoint is kept",
+			base:       &image.ImageConfig{Cmd: []string{"sh"}},
+			dockerfile: "CMD [\"--help\"]\nENTRYPOINT [\"/app\"]",
+			entrypoint: []string{"/app"},
+			cmd:        []string{"--help"},
+		},
+		{
+			name:       "cmd after entrypoint",
+			base:       &image.ImageConfig{Entrypoint: []string{"/old"}, Cmd: []string{"sh"}},
+			dockerfile: "ENTRYPOINT /app -v\nCMD [\"run\"]",
+			entrypoint: []string{"/bin/sh", "-c", "/app -v"},
+			cmd:        []string{"run"},
+		},
+		{
+			name:       "cmd keeps inherited entrypoint",
+			base:       &image.ImageConfig{Entrypoint: []string{"/app"}, Cmd: []string{"sh"}},
+			dockerfile: "CMD echo $HOME",
+			entrypoint: []string{"/app"},
+			cmd:        []string{"/bin/sh", "-c", "echo $HOME"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBuilder(tt.base, nil)
+			dispatchAll(t, b, tt.dockerfile)
+			if !reflect.DeepEqual(b.config.Entrypoint, tt.entrypoint) || !reflect.DeepEqual(b.config.Cmd, tt.cmd) {
+				t.Errorf("entrypoint = %q, cmd = %q, want %q, %q", b.config.Entrypoint, b.config.Cmd, tt.entrypoint, tt.cmd)
+			}
+		})
+	}
+}
+
+func TestDispatchBeforeFrom(t *testing.T) {
+	b := &builder{opts: &Options{Out: io.Discard}, config: &image.ImageConfig{}, args: make(map[string]string)}
+	if err := b.dispatch(&Instruction{Command: "ARG", Args: []string{"A=1"}}); err != nil {
+		t.Errorf("ARG before FROM: %v", err)
+	}
+	if err := b.dispatch(&Instruction{Command: "ENV", Args: []string{"A=1"}}); err == nil || err.Error() != "ENV before FROM" {
+		t.Errorf("ENV before FROM error = %v", err)
+	}
+}
+
+func TestContextPath(t *testing.T) {
+	b := &builder{opts: &Options{ContextDir: "/ctx"}}
+	tests := map[string]string{
+		"a/b":          "/ctx/a/b",
+		"/a":           "/ctx/a",
+		"../../etc":    "/ctx/etc",
+		"a/../../../b": "/ctx/b",
+		".":            "/ctx",
+	}
+	for p, want := range tests {
+		if got := b.contextPath(p); got != want {
+			t.Errorf("contextPath(%q) = %q, want %q", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"m-docker/libcontainer/constant"
+	"m-docker/libcontainer/image"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 构建缓存中的一条记录，描述某个构建步骤所生成的镜像层
+type cacheEntry struct {
+	// 构建步骤所生成镜像层的 diffID
+	DiffID string `json:"diffID"`
+}
+
+// 计算构建步骤的缓存键
+// 缓存键由父镜像层、指令以及影响指令执行结果的所有状态共同决定，任何一项变化都会使缓存失效
+func cacheKey(parent string, parts ...interface{}) string {
+	data, _ := json.Marshal(append([]interface{}{parent}, parts...))
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// 尝试使用缓存的镜像层，命中时将其叠加到当前镜像之上
+func (b *builder) useCache(key string) bool {
+	if b.opts.NoCache {
+		return false
+	}
+
+	content, err := os.ReadFile(path.Join(constant.BuildCachePath, key))
+	if err != nil {
+		return false
+	}
+	entry := new(cacheEntry)
+	if err := json.Unmarshal(content, entry); err != nil {
+		log.Warnf("invalid build cache entry %s: %v", key, err)
+		return false
+	}
+	// 缓存的镜像层可能已经被清理了
+	layer, err := image.GetLayer(image.ChainID(b.chainID, entry.DiffID))
+	if err != nil {
+		return false
+	}
+
+	fmt.Fprintf(b.opts.Out, " ---> Using cache\n")
+	b.addLayer(layer)
+	return true
+}
+
+// 记录构建步骤所生成的镜像层，即当前镜像的最上层
+func (b *builder) saveCache(key string) error {
+	if err := os.MkdirAll(constant.BuildCachePath, 0755); err != nil {
+		return fmt.Errorf("failed to create dir %s: %v", constant.BuildCachePath, err)
+	}
+	data, err := json.Marshal(&cacheEntry{DiffID: b.layers[len(b.layers)-1]})
+	if err != nil {
+		return err
+	}
+
+	// 先写入临时文件再重命名，避免留下不完整的缓存记录
+	tmpFile, err := os.CreateTemp(constant.BuildCachePath, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path.Join(constant.BuildCachePath, key))
+}
@@ -0,0 +1,29 @@
+package build
+
+import "testing"
+
+func TestCacheKey(t *testing.T) {
+	base := cacheKey("sha256:parent", "RUN echo", []string{"A=1"})
+	if len(base) != 64 {
+		t.Fatalf("cache key %q is not a sha256 hex digest", base)
+	}
+	if cacheKey("sha256:parent", "RUN echo", []string{"A=1"}) != base {
+		t.Error("cache key is not deterministic")
+	}
+
+	// 父镜像层、指令以及指令所依赖的状态任何一项变化都会得到不同的缓存键
+	tests := map[string]string{
+		"parent":      cacheKey("sha256:other", "RUN echo", []string{"A=1"}),
+		"instruction": cacheKey("sha256:parent", "RUN echo 2", []string{"A=1"}),
+		"env":         cacheKey("sha256:parent", "RUN echo", []string{"A=2"}),
+		"no env":      cacheKey("sha256:parent", "RUN echo"),
+		"empty":       cacheKey("", "RUN echo", []string{"A=1"}),
+		// 各部分之间有分隔，不能通过移动内容得到相同的键
+		"boundary": cacheKey("sha256:parentRUN echo", "", []string{"A=1"}),
+	}
+	for name, key := range tests {
+		if key == base {
+			t.Errorf("changing the %s does not change the cache key", name)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/archive"
+	"m-docker/libcontainer/constant"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// COPY 和 ADD 指令，将构建上下文中的文件复制到镜像中
+// ADD 还会将本地的 tar 包（可以经过 gzip 压缩）解压到目标目录中
+func (b *builder) copy(inst *Instruction) error {
+	args := make([]string, 0, len(inst.Args))
+	for _, arg := range inst.Args {
+		if strings.HasPrefix(arg, "--") {
+			return fmt.Errorf("%s flag %s is not supported", inst.Command, arg)
+		}
+		args = append(args, b.expand(arg))
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("%s requires at least two arguments", inst.Command)
+	}
+	dest := args[len(args)-1]
+
+	// 展开源路径中的通配符
+	var srcs []string
+	for _, pattern := range args[:len(args)-1] {
+		matches, err := filepath.Glob(b.contextPath(pattern))
+		if err != nil {
+			return fmt.Errorf("invalid source %s: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("source %s not found in build context", pattern)
+		}
+		srcs = append(srcs, matches...)
+	}
+
+	// 多个源路径或者目标路径以 '/' 结尾时，目标路径是一个目录
+	destIsDir := strings.HasSuffix(dest, "/") || len(srcs) > 1
+	destPath := b.resolvePath(dest)
+
+	srcHash, err := hashPaths(srcs)
+	if err != nil {
+		return err
+	}
+	key := cacheKey(b.chainID, inst.Command, srcHash, destPath, destIsDir)
+	if b.useCache(key) {
+		return nil
+	}
+
+	// 在临时目录中按照镜像中的路径组织好文件，之后将其打包为新的镜像层
+	stagingDir, err := os.MkdirTemp(constant.RootPath, ".build-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	for _, src := range srcs {
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(stagingDir, destPath)
+
+		switch {
+		case inst.Command == "ADD" && fi.Mode().IsRegular() && isArchive(src):
+			err = extractArchive(src, target)
+		case fi.IsDir():
+			// 复制目录时只复制目录中的内容，而不是目录本身
+			err = copyPath(src, target)
+		case destIsDir:
+			err = copyPath(src, filepath.Join(target, filepath.Base(src)))
+		default:
+			err = copyPath(src, target)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %v", src, err)
+		}
+	}
+
+	if err := b.commitDir(stagingDir); err != nil {
+		return err
+	}
+	return b.saveCache(key)
+}
+
+// 计算源路径的摘要，包括其中所有文件的路径、权限、链接目标以及内容
+func hashPaths(srcs []string) (string, error) {
+	hash := sha256.New()
+	for _, src := range srcs {
+		err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(filepath.Dir(src), p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00%o\x00", rel, fi.Mode())
+
+			switch {
+			case fi.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(hash, "%s\x00", link)
+			case fi.Mode().IsRegular():
+				file, err := os.Open(p)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(hash, file)
+				file.Close()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %v", src, err)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// 将 src 复制到 dst，src 为目录时递归复制其中的内容
+// 复制后的文件保留原有的权限和修改时间，属主统一为 root，这与 docker 的行为一致
+func copyPath(src string, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			_ = os.RemoveAll(target)
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return os.Lchown(target, 0, 0)
+		case fi.Mode().IsRegular():
+			if err := copyFile(p, target, fi.Mode()); err != nil {
+				return err
+			}
+		default:
+			// 设备文件、管道等特殊文件不会被复制
+			return nil
+		}
+
+		if err := os.Lchown(target, 0, 0); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+}
+
+// 复制单个普通文件
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// 判断文件是否为 tar 包，可以经过 gzip 压缩
+func isArchive(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	r, err := decompress(file)
+	if err != nil {
+		return false
+	}
+	_, err = tar.NewReader(r).Next()
+	return err == nil
+}
+
+// 将 tar 包解压到 dest 目录中
+func extractArchive(filePath string, dest string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := decompress(file)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	return archive.Untar(r, dest)
+}
+
+// 若数据经过了 gzip 压缩，则返回解压后的数据流
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
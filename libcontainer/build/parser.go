@@ -0,0 +1,189 @@
+package build
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dockerfile 中的一条指令
+type Instruction struct {
+	// 指令名称，统一为大写，如 RUN、COPY
+	Command string
+
+	// 指令的参数
+	// 对于 exec 形式（json 数组）的 RUN、CMD、ENTRYPOINT，为数组中的各个元素
+	// 对于其余指令，为按空白分割后的各个参数
+	Args []string
+
+	// 参数是否为 json 数组形式
+	JSONForm bool
+
+	// 指令的原始文本，用于输出构建进度以及计算缓存
+	Original string
+
+	// 指令所在的行号
+	Line int
+}
+
+// 支持的指令
+var supportedCommands = map[string]bool{
+	"FROM":       true,
+	"RUN":        true,
+	"COPY":       true,
+	"ADD":        true,
+	"ENV":        true,
+	"WORKDIR":    true,
+	"CMD":        true,
+	"ENTRYPOINT": true,
+	"USER":       true,
+	"LABEL":      true,
+	"ARG":        true,
+}
+
+// 可以使用 json 数组形式的指令
+var jsonFormCommands = map[string]bool{
+	"RUN":        true,
+	"CMD":        true,
+	"ENTRYPOINT": true,
+}
+
+// 解析 Dockerfile，返回其中的所有指令
+func Parse(r io.Reader) ([]*Instruction, error) {
+	var instructions []*Instruction
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	var current strings.Builder
+	startLine := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		// 忽略空行和注释
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			startLine = lineNo
+		}
+
+		// 以 '\' 结尾的行与下一行拼接
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+
+		inst, err := parseLine(current.String(), startLine)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, inst)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dockerfile: %v", err)
+	}
+	if current.Len() != 0 {
+		return nil, fmt.Errorf("line %d: unexpected end of file after line continuation", startLine)
+	}
+
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("dockerfile is empty")
+	}
+	if instructions[0].Command != "FROM" && instructions[0].Command != "ARG" {
+		return nil, fmt.Errorf("line %d: dockerfile must begin with FROM", instructions[0].Line)
+	}
+	return instructions, nil
+}
+
+// 解析单条指令
+func parseLine(line string, lineNo int) (*Instruction, error) {
+	command, rest, _ := strings.Cut(line, " ")
+	command = strings.ToUpper(command)
+	rest = strings.TrimSpace(rest)
+	if !supportedCommands[command] {
+		return nil, fmt.Errorf("line %d: unsupported instruction %s", lineNo, command)
+	}
+	if rest == "" {
+		return nil, fmt.Errorf("line %d: %s requires at least one argument", lineNo, command)
+	}
+
+	inst := &Instruction{
+		Command:  command,
+		Original: command + " " + rest,
+		Line:     lineNo,
+	}
+
+	// json 数组形式的参数
+	if jsonFormCommands[command] && strings.HasPrefix(rest, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(rest), &args); err == nil {
+			inst.Args = args
+			inst.JSONForm = true
+			return inst, nil
+		}
+		// 解析失败时按照 shell 形式处理，这与 docker 的行为一致
+	}
+
+	// RUN、CMD、ENTRYPOINT 的 shell 形式将整行作为一个参数
+	if jsonFormCommands[command] {
+		inst.Args = []string{rest}
+		return inst, nil
+	}
+
+	args, err := splitArgs(rest)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", lineNo, err)
+	}
+	inst.Args = args
+	return inst, nil
+}
+
+// 按空白分割参数，支持单引号、双引号以及 '\' 转义
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in: %s", s)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,89 @@
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	dockerfile := `# comment
+ARG BASE=busybox
+from $BASE
+
+RUN ["echo", "hello"]
+RUN echo a && \
+    echo b
+CMD [not json
+ENV A=1 B="two words"
+COPY 'a b' c\ d /dst/
+`
+	instructions, err := Parse(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []*Instruction{
+		{Command: "ARG", Args: []string{"BASE=busybox"}, Original: "ARG BASE=busybox", Line: 2},
+		{Command: "FROM", Args: []string{"$BASE"}, Original: "FROM $BASE", Line: 3},
+		{Command: "RUN", Args: []string{"echo", "hello"}, JSONForm: true, Original: `RUN ["echo", "hello"]`, Line: 5},
+		{Command: "RUN", Args: []string{"echo a &&  echo b"}, Original: "RUN echo a &&  echo b", Line: 6},
+		// 无法解析为 json 数组时按照 shell 形式处理
+		{Command: "CMD", Args: []string{"[not json"}, Original: "CMD [not json", Line: 8},
+		{Command: "ENV", Args: []string{"A=1", "B=two words"}, Original: `ENV A=1 B="two words"`, Line: 9},
+		{Command: "COPY", Args: []string{"a b", "c d", "/dst/"}, Original: `COPY 'a b' c\ d /dst/`, Line: 10},
+	}
+	if len(instructions) != len(want) {
+		t.Fatalf("got %d instructions, want %d", len(instructions), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(instructions[i], want[i]) {
+			t.Errorf("instruction %d = %+v, want %+v", i, instructions[i], want[i])
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		dockerfile string
+		err        string
+	}{
+		{"", "dockerfile is empty"},
+		{"# only a comment\n", "dockerfile is empty"},
+		{"RUN echo\n", "line 1: dockerfile must begin with FROM"},
+		{"FROM busybox\nHEALTHCHECK NONE\n", "line 2: unsupported instruction HEALTHCHECK"},
+		{"FROM busybox\nRUN\n", "line 2: RUN requires at least one argument"},
+		{"FROM busybox\nRUN echo \\\n", "line 2: unexpected end of file after line continuation"},
+		{"FROM busybox\nENV A=\"1\n", "line 2: unterminated quote"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.dockerfile))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%q) error = %v, want %q", tt.dockerfile, err, tt.err)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"a  b\tc", []string{"a", "b", "c"}},
+		{`"a b" 'c d'`, []string{"a b", "c d"}},
+		{`a\ b c`, []string{"a b", "c"}},
+		// 单引号中的 '\' 不是转义字符
+		{`'a\b' "c\"d"`, []string{`a\b`, `c"d`}},
+		{`""`, []string{""}},
+		{`key="a b"c`, []string{"key=a bc"}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.s)
+		if err != nil {
+			t.Errorf("splitArgs(%q): %v", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
@@ -16,8 +16,8 @@ type CgroupManager interface {
 	// 将进程 pid 添加至 cgroup 中
 	Apply(pid int) error
 
-	// 设置 cgroup 的资源限制
-	Set(res *config.Resources)
+	// 设置 cgroup 的资源限制，任意一个 controller 设置失败时返回错误
+	Set(res *config.Resources) error
 
 	// 销毁 cgroup
 	Destroy()
@@ -7,8 +7,6 @@ import (
 	"path"
 	"strconv"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type CgroupV2Manager struct {
@@ -52,14 +50,20 @@ func (c *CgroupV2Manager) Apply(pid int) error {
 	return nil
 }
 
-func (c *CgroupV2Manager) Set(resConf *config.Resources) {
+func (c *CgroupV2Manager) Set(resConf *config.Resources) error {
 	c.resource = resConf
 	// 遍历所有的 cgroup controller，调用 controller 的 Set 方法来设置 cgroup 的资源限制
+	// 某个 controller 失败时仍然设置其余的 controller，最后返回所有的错误
+	var errs []string
 	for _, controller := range c.controllers {
 		if err := controller.Set(c.dirPath, resConf); err != nil {
-			log.Warnf("set cgroup controller %v  fail: %v", controller.Name(), err)
+			errs = append(errs, fmt.Sprintf("set cgroup controller %v fail: %v", controller.Name(), err))
 		}
 	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 func (c *CgroupV2Manager) Destroy() {
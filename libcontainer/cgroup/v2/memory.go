@@ -17,11 +17,16 @@ func (s *MemoryController) Name() string {
 }
 
 func (s *MemoryController) Set(cgroupPath string, resConf *config.Resources) error {
-	// 将内存限制写入 memory.max 文件
-	if err := os.WriteFile(path.Join(cgroupPath, "memory.max"), []byte(resConf.Memory), 0644); err != nil {
+	memoryLimit := resConf.Memory
+	if memoryLimit == "" { // 如果没有设置内存限制，则默认为最大值
+		memoryLimit = "max"
+	}
+
+	// 将内存限制写入 memory.max 文件，新的限制低于当前的内存使用量且无法回收时，内核返回 EBUSY
+	if err := os.WriteFile(path.Join(cgroupPath, "memory.max"), []byte(memoryLimit), 0644); err != nil {
 		return fmt.Errorf("os.WriteFile() to file %v fail:  %v", path.Join(cgroupPath, "memory.max"), err)
 	}
 
-	log.Debugf("Set cgroup memory.max: %v", resConf.Memory)
+	log.Debugf("Set cgroup memory.max: %v", memoryLimit)
 	return nil
 }
@@ -0,0 +1,93 @@
+package libcontainer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/image"
+	"m-docker/libcontainer/storage"
+	"strings"
+	"time"
+)
+
+// 将容器读写层中的修改提交为新的镜像层，叠加在容器所使用的镜像层之上，生成名为 name 的镜像
+// 新镜像继承原镜像的运行配置和构建历史，环境变量则使用容器的环境变量
+func Commit(conf *config.Config, name string, comment string) (*image.Image, error) {
+	// 新的镜像层在保存镜像之前没有被引用，需要一直持有镜像存储的共享锁
+	unlock, err := image.LockStore()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// 根据容器的镜像层目录找到对应的镜像层
+	var diffIDs []string
+	parent := ""
+	for _, dir := range conf.Layers {
+		layer, err := image.LayerFromDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		diffIDs = append(diffIDs, layer.DiffID)
+		parent = layer.ChainID
+	}
+
+	// 容器创建之后，原镜像名称可能已经指向了其他镜像，此时不再继承它的配置
+	base := &image.Image{Layers: diffIDs}
+	if img, err := image.GetImage(conf.Image); err == nil && strings.Join(img.Layers, ",") == strings.Join(diffIDs, ",") {
+		base = img
+	}
+	imageConf := &image.ImageConfig{}
+	if base.Config != nil {
+		data, _ := json.Marshal(base.Config)
+		_ = json.Unmarshal(data, imageConf)
+	}
+	imageConf.Env = conf.Env
+
+	layer, err := CommitLayer(conf, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	img := &image.Image{
+		Name:    name,
+		Layers:  append(diffIDs, layer.DiffID),
+		Config:  imageConf,
+		Created: &now,
+		History: append(base.LayerHistory(), image.History{
+			Created:   &now,
+			CreatedBy: strings.Join(conf.CmdArray, " "),
+			Comment:   comment,
+		}),
+	}
+	// 没有指定名称时，与 import 一致使用镜像层摘要的前 12 位作为名称
+	if name == "" {
+		img.Name = image.DefaultName(layer.ChainID)
+		img.Untagged = true
+	}
+	if err := image.SaveImage(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// 将容器读写层中的修改提交为新的镜像层，叠加在 parent 之上
+func CommitLayer(conf *config.Config, parent string) (*image.Layer, error) {
+	driver, err := storage.NewStorageDriver(conf.StorageDriver)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(driver.Commit(conf.RwLayer, conf.Layers, pw))
+	}()
+	layer, err := image.CreateLayerFromTar(parent, pr)
+	pr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create layer: %v", err)
+	}
+	return layer, nil
+}
@@ -1,5 +1,11 @@
 package config
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type Cgroup struct {
 	// cgroup 名称
 	Name string `json:"name"`
@@ -20,4 +26,41 @@ type Resources struct {
 
 	// 在 CPU 硬限制的调度周期内，期望使用的 CPU 时间
 	CpuQuota uint64 `json:"cpuQuota"`
+
+	// 容器网络的入站带宽限制，单位为 bit/s，为 0 时不限制，通过 tc 而不是 cgroup 实现
+	NetIngressRate uint64 `json:"netIngressRate,omitempty"`
+
+	// 容器网络的出站带宽限制，单位为 bit/s，为 0 时不限制
+	NetEgressRate uint64 `json:"netEgressRate,omitempty"`
+}
+
+// 带宽的单位，与 tc 一致，bit 为比特每秒，bps 为字节每秒
+var rateUnits = []struct {
+	suffix string
+	factor uint64
+}{
+	{"tbit", 1000 * 1000 * 1000 * 1000}, {"gbit", 1000 * 1000 * 1000}, {"mbit", 1000 * 1000}, {"kbit", 1000}, {"bit", 1},
+	{"tbps", 8 * 1000 * 1000 * 1000 * 1000}, {"gbps", 8 * 1000 * 1000 * 1000}, {"mbps", 8 * 1000 * 1000}, {"kbps", 8 * 1000}, {"bps", 8},
+	{"t", 1000 * 1000 * 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000},
+}
+
+// 解析带宽限制，如 10mbit、1gbit、500kbps，没有单位或单位只有 k、m、g 时以 bit/s 为单位，0 表示不限制
+func parseRate(rate string) (uint64, error) {
+	s := strings.ToLower(strings.TrimSpace(rate))
+	factor := uint64(1)
+	for _, unit := range rateUnits {
+		if number, ok := strings.CutSuffix(s, unit.suffix); ok {
+			s, factor = number, unit.factor
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate: %s", rate)
+	}
+	bits := uint64(value * float64(factor))
+	if bits > 0 && bits < 8 {
+		return 0, fmt.Errorf("rate %s is too small", rate)
+	}
+	return bits, nil
 }
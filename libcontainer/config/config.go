@@ -8,18 +8,30 @@ type Config struct {
 	// 容器的进程在宿主机上的 PID
 	Pid int `json:"pid"`
 
+	// 容器进程的退出码，容器进程结束后记录
+	ExitCode int `json:"exitCode"`
+
 	// 容器的唯一标识符
 	ID string `json:"ID"`
 
 	// 容器名称
 	Name string `json:"name"`
 
+	// 容器所使用的镜像名称
+	Image string `json:"image"`
+
+	// 容器所使用的镜像层目录，按照自底向上的顺序排列
+	Layers []string `json:"layers"`
+
 	// 容器的 rootfs 路径
 	Rootfs string `json:"rootfs"`
 
 	// 容器的读写层路径
 	RwLayer string `json:"rwLayer"`
 
+	// 容器所使用的存储驱动，为空时表示 overlay
+	StorageDriver string `json:"storageDriver"`
+
 	// 容器的状态信息路径
 	StateDir string `json:"stateDir"`
 
@@ -29,12 +41,45 @@ type Config struct {
 	// 容器与宿主机的挂载
 	Mounts []*Mount `json:"mounts"`
 
+	// 容器的网络模式：bridge、none、host、container:[id] 或用户创建的网络名称，为空时表示 bridge
+	NetworkMode string `json:"networkMode"`
+
+	// 容器所连接的网络
+	Endpoints []*Endpoint `json:"endpoints"`
+
+	// 发布到宿主机上的端口
+	Ports []*PortMapping `json:"ports"`
+
+	// 容器的主机名
+	Hostname string `json:"hostname"`
+
+	// 容器使用的 DNS 服务器，为空时使用宿主机的配置
+	DNS []string `json:"dns"`
+
+	// 容器的 DNS 搜索域，为空时使用宿主机的配置
+	DNSSearch []string `json:"dnsSearch"`
+
+	// 额外添加到容器 /etc/hosts 中的记录，格式为 [host]:[ip]
+	ExtraHosts []string `json:"extraHosts"`
+
+	// 容器的出站流量策略，为空时不限制出站流量
+	Egress *EgressPolicy `json:"egress,omitempty"`
+
 	// 容器是否启用 tty
 	TTY bool `json:"tty"`
 
-	// 容器的运行命令
+	// 容器进程退出后是否自动删除容器
+	AutoRemove bool `json:"autoRemove"`
+
+	// 容器的运行命令，由镜像或用户指定的 entrypoint 和 cmd 拼接而成
 	CmdArray []string `json:"CmdArray"`
 
+	// 容器进程的工作目录
+	WorkingDir string `json:"workingDir"`
+
+	// 运行容器进程的用户
+	User string `json:"user"`
+
 	// 容器的 Cgroup 配置
 	Cgroup *Cgroup `json:"cgroup"`
 
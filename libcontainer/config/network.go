@@ -0,0 +1,354 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"m-docker/libcontainer/constant"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Endpoint 容器连接到某个网络的端点
+type Endpoint struct {
+	// 网络名称
+	Network string `json:"network"`
+
+	// veth 设备在宿主机一端的名称，连接到网络的网桥上
+	HostVeth string `json:"hostVeth,omitempty"`
+
+	// veth 设备在容器内一端的名称
+	IfName string `json:"ifName,omitempty"`
+
+	// 容器的 IP 地址，带有子网掩码，如 172.29.0.2/16
+	IPAddress string `json:"ipAddress,omitempty"`
+
+	// 网关地址，即网桥的 IP 地址
+	Gateway string `json:"gateway,omitempty"`
+
+	// 容器的 IPv6 地址，带有前缀长度，网络没有启用 IPv6 时为空
+	IPv6Address string `json:"ipv6Address,omitempty"`
+
+	// IPv6 网关地址
+	IPv6Gateway string `json:"ipv6Gateway,omitempty"`
+
+	// 容器网卡的 MAC 地址
+	MacAddress string `json:"macAddress,omitempty"`
+
+	// 通过 CNI 插件连接网络时的状态，删除网络时需要使用
+	CNI *CNIState `json:"cni,omitempty"`
+}
+
+// CNIState 记录了调用 CNI 插件时使用的配置和插件返回的结果
+// 删除网络时需要使用与添加时相同的配置，因此保存配置本身而不是配置文件的路径
+type CNIState struct {
+	// 网络的 conflist 配置
+	ConfigList json.RawMessage `json:"configList"`
+
+	// 插件所在的目录，即 CNI_PATH
+	BinDir string `json:"binDir"`
+
+	// 容器的 network namespace 路径，即 CNI_NETNS
+	Netns string `json:"netns"`
+
+	// ADD 命令返回的结果
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// 解析 --network 参数，得到容器的网络模式和需要连接的网络，除了 none、host 和 container:[name] 外都视为网络名称
+// container:[name] 模式中的容器名称会被解析为完整的容器 ID，且该容器必须正在运行
+func parseNetworkMode(mode string) (string, []*Endpoint, error) {
+	switch {
+	case mode == "" || mode == constant.NetworkModeBridge:
+		return constant.NetworkModeBridge, []*Endpoint{{Network: constant.DefaultNetwork}}, nil
+	case mode == constant.NetworkModeNone || mode == constant.NetworkModeHost:
+		return mode, nil, nil
+	case strings.HasPrefix(mode, constant.NetworkModeContainerPrefix):
+		nameOrID := strings.TrimPrefix(mode, constant.NetworkModeContainerPrefix)
+		if nameOrID == "" {
+			return "", nil, fmt.Errorf("invalid network mode: %s", mode)
+		}
+		conf, err := GetConfigFromNameOrPrefix(nameOrID)
+		if err != nil {
+			return "", nil, err
+		}
+		if conf.Status != constant.ContainerRunning {
+			return "", nil, fmt.Errorf("container %s is not running", nameOrID)
+		}
+		return constant.NetworkModeContainerPrefix + conf.ID, nil, nil
+	default:
+		// 其它值为用户创建的网络的名称，网络是否存在在创建容器时检查
+		return mode, []*Endpoint{{Network: mode}}, nil
+	}
+}
+
+// PortMapping 将宿主机上的端口映射到容器的端口
+type PortMapping struct {
+	// 宿主机上监听的地址，为空时监听所有地址
+	HostIP string `json:"hostIP,omitempty"`
+
+	// 宿主机上的端口，为 0 时在发布时随机分配
+	HostPort int `json:"hostPort"`
+
+	// 容器的端口
+	ContainerPort int `json:"containerPort"`
+
+	// 协议，tcp 或 udp
+	Protocol string `json:"protocol"`
+}
+
+// 按照 docker 的格式输出端口映射，如 80/tcp -> 0.0.0.0:8080
+func (pm *PortMapping) String() string {
+	hostIP := pm.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%d/%s -> %s", pm.ContainerPort, pm.Protocol, net.JoinHostPort(hostIP, strconv.Itoa(pm.HostPort)))
+}
+
+// 解析 -p 参数所指定的端口映射，支持以下格式，省略宿主机端口时随机分配：
+// [containerPort]、[hostPort]:[containerPort]、[ip]:[hostPort]:[containerPort]、[ip]::[containerPort]
+// IPv6 地址需要放在方括号中，如 [::1]:8080:80
+// 以上格式之后都可以加上 /tcp 或 /udp 指定协议，默认为 tcp
+// publishAll 为 true 时，镜像中声明的所有端口都会随机映射到宿主机上
+func parsePortMappings(specs []string, publishAll bool, exposedPorts map[string]struct{}) ([]*PortMapping, error) {
+	var mappings []*PortMapping
+	published := make(map[string]bool)
+	for _, spec := range specs {
+		pm, err := parsePortMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, pm)
+		published[fmt.Sprintf("%d/%s", pm.ContainerPort, pm.Protocol)] = true
+	}
+
+	if publishAll {
+		exposed := make([]string, 0, len(exposedPorts))
+		for port := range exposedPorts {
+			exposed = append(exposed, port)
+		}
+		sort.Strings(exposed)
+		for _, port := range exposed {
+			pm, err := parsePortMapping(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exposed port in image: %v", err)
+			}
+			// 已经通过 -p 指定的端口以 -p 为准
+			if published[fmt.Sprintf("%d/%s", pm.ContainerPort, pm.Protocol)] {
+				continue
+			}
+			mappings = append(mappings, pm)
+		}
+	}
+	return mappings, nil
+}
+
+// 解析单个端口映射
+func parsePortMapping(spec string) (*PortMapping, error) {
+	pm := &PortMapping{Protocol: "tcp"}
+	ports := spec
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		ports, pm.Protocol = spec[:i], strings.ToLower(spec[i+1:])
+		if pm.Protocol != "tcp" && pm.Protocol != "udp" {
+			return nil, fmt.Errorf("invalid protocol in port mapping %s: %s", spec, pm.Protocol)
+		}
+	}
+
+	var hostIP, hostPort, containerPort string
+	if strings.HasPrefix(ports, "[") {
+		end := strings.Index(ports, "]:")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid port mapping: %s", spec)
+		}
+		hostIP, ports = ports[1:end], ports[end+2:]
+		if hostIP == "" {
+			return nil, fmt.Errorf("invalid port mapping: %s", spec)
+		}
+	}
+	parts := strings.Split(ports, ":")
+	if hostIP != "" {
+		// 方括号中的地址之后只能是 [hostPort]:[containerPort]
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid port mapping: %s", spec)
+		}
+		parts = append([]string{hostIP}, parts...)
+	}
+	switch len(parts) {
+	case 1:
+		containerPort = parts[0]
+	case 2:
+		hostPort, containerPort = parts[0], parts[1]
+	case 3:
+		hostIP, hostPort, containerPort = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("invalid port mapping: %s", spec)
+	}
+
+	if hostIP != "" {
+		ip := net.ParseIP(hostIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host ip in port mapping %s: %s", spec, hostIP)
+		}
+		pm.HostIP = ip.String()
+	}
+	var err error
+	if pm.ContainerPort, err = parsePort(containerPort); err != nil || pm.ContainerPort == 0 {
+		return nil, fmt.Errorf("invalid container port in port mapping %s: %s", spec, containerPort)
+	}
+	if hostPort != "" {
+		if pm.HostPort, err = parsePort(hostPort); err != nil {
+			return nil, fmt.Errorf("invalid host port in port mapping %s: %s", spec, hostPort)
+		}
+	}
+	return pm, nil
+}
+
+// 解析端口号
+func parsePort(port string) (int, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > 65535 {
+		return 0, fmt.Errorf("port out of range: %d", n)
+	}
+	return n, nil
+}
+
+// 校验 --dns 参数指定的 DNS 服务器地址
+func parseDNS(servers []string) ([]string, error) {
+	var result []string
+	for _, server := range servers {
+		ip := net.ParseIP(server)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid dns server: %s", server)
+		}
+		result = append(result, ip.String())
+	}
+	return result, nil
+}
+
+// 校验 --add-host 参数，格式为 [host]:[ip]，ip 可以是 IPv6 地址，因此只按第一个冒号分割
+func parseExtraHosts(hosts []string) ([]string, error) {
+	var result []string
+	for _, h := range hosts {
+		host, ip, ok := strings.Cut(h, ":")
+		if !ok || host == "" || strings.ContainsAny(host, " \t") {
+			return nil, fmt.Errorf("invalid host: %s, the format is host:ip", h)
+		}
+		parsed := net.ParseIP(strings.Trim(ip, "[]"))
+		if parsed == nil {
+			return nil, fmt.Errorf("invalid ip address in host %s: %s", h, ip)
+		}
+		result = append(result, host+":"+parsed.String())
+	}
+	return result, nil
+}
+
+// 容器默认的主机名，与 docker 一致：
+// host 模式使用宿主机的主机名，container:[id] 模式使用目标容器的主机名，其它模式使用容器 ID 的前 12 位
+func defaultHostname(containerID string, networkMode string) string {
+	switch {
+	case networkMode == constant.NetworkModeHost:
+		if hostname, err := os.Hostname(); err == nil {
+			return hostname
+		}
+	case strings.HasPrefix(networkMode, constant.NetworkModeContainerPrefix):
+		target, err := GetConfigFromID(strings.TrimPrefix(networkMode, constant.NetworkModeContainerPrefix))
+		if err == nil && target.Hostname != "" {
+			return target.Hostname
+		}
+	}
+	return containerID[:12]
+}
+
+// EgressPolicy 容器的出站流量策略，默认拒绝，只放行 Allow 中的流量
+// 回环设备上的流量以及已建立连接的回复流量总是放行
+type EgressPolicy struct {
+	// 默认的处理方式，目前只支持 deny
+	Default string `json:"default"`
+
+	// 放行的出站流量
+	Allow []*EgressRule `json:"allow"`
+}
+
+// EgressRule 放行的一类出站流量，Destination 与 Protocol 只会设置其中一个
+type EgressRule struct {
+	// 目的地址，为 CIDR 格式
+	Destination string `json:"destination,omitempty"`
+
+	// 协议，tcp、udp 或 icmp
+	Protocol string `json:"protocol,omitempty"`
+
+	// 目的端口或端口范围，如 443 或 8000-8080，只对 tcp 和 udp 有效，为空时表示所有端口
+	Ports string `json:"ports,omitempty"`
+}
+
+// 解析 --egress-allow 参数，每个参数可以包含多个以逗号分隔的规则，支持以下格式：
+// [cidr]、[ip]、[protocol]、[protocol]:[port]、[protocol]:[port]-[port]
+// none 表示不放行任何出站流量，没有指定参数时不限制出站流量
+func parseEgressPolicy(specs []string) (*EgressPolicy, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	policy := &EgressPolicy{Default: "deny", Allow: []*EgressRule{}}
+	for _, spec := range specs {
+		for _, entry := range strings.Split(spec, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "none" {
+				continue
+			}
+			rule, err := parseEgressRule(entry)
+			if err != nil {
+				return nil, err
+			}
+			policy.Allow = append(policy.Allow, rule)
+		}
+	}
+	return policy, nil
+}
+
+// 解析单个出站规则
+func parseEgressRule(entry string) (*EgressRule, error) {
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		return &EgressRule{Destination: ipNet.String()}, nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &EgressRule{Destination: (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String()}, nil
+	}
+
+	protocol, ports, hasPorts := strings.Cut(strings.ToLower(entry), ":")
+	rule := &EgressRule{Protocol: protocol}
+	switch protocol {
+	case "tcp", "udp":
+	case "icmp":
+		if hasPorts {
+			return nil, fmt.Errorf("invalid egress rule %s: icmp has no ports", entry)
+		}
+	default:
+		return nil, fmt.Errorf("invalid egress rule: %s", entry)
+	}
+	if hasPorts {
+		start, end, isRange := strings.Cut(ports, "-")
+		first, err := parsePort(start)
+		if err != nil || first == 0 {
+			return nil, fmt.Errorf("invalid port in egress rule %s: %s", entry, start)
+		}
+		rule.Ports = strconv.Itoa(first)
+		if isRange {
+			last, err := parsePort(end)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid port range in egress rule %s: %s", entry, ports)
+			}
+			rule.Ports += "-" + strconv.Itoa(last)
+		}
+	}
+	return rule, nil
+}
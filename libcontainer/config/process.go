@@ -0,0 +1,16 @@
+package config
+
+// 容器 init 进程最终需要运行的用户进程，通过匿名管道传递给 init 进程
+type Process struct {
+	// 用户进程的命令及参数
+	Args []string `json:"args"`
+
+	// 用户进程的工作目录，为空时使用容器的根目录
+	Cwd string `json:"cwd"`
+
+	// 运行用户进程的用户，格式为 user[:group]，user 和 group 可以是名称或者 ID
+	User string `json:"user"`
+
+	// 容器的主机名，为空时不设置
+	Hostname string `json:"hostname"`
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"m-docker/libcontainer/constant"
+	"m-docker/libcontainer/image"
+	"m-docker/libcontainer/storage"
 	"os"
 	"path"
 	"strings"
@@ -42,15 +44,80 @@ func CreateConfig(ctx *cli.Context) (*Config, error) {
 		return nil, fmt.Errorf("failed to extract volume mounts: %v", err)
 	}
 
-	// 获取容器的运行命令
-	var cmdArray []string
+	// 获取容器的网络模式
+	networkMode, endpoints, err := parseNetworkMode(ctx.String("network"))
+	if err != nil {
+		return nil, err
+	}
+
+	// 获取容器所使用的镜像
 	if ctx.NArg() < 1 {
+		return nil, fmt.Errorf("missing image name")
+	}
+	imageName := ctx.Args().First()
+	img, err := image.GetImage(imageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image: %v", err)
+	}
+	imageConf := img.Config
+	if imageConf == nil {
+		imageConf = &image.ImageConfig{}
+	}
+
+	// 获取需要发布到宿主机上的端口
+	ports, err := parsePortMappings(ctx.StringSlice("p"), ctx.Bool("P"), imageConf.ExposedPorts)
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) > 0 && len(endpoints) == 0 {
+		// 与 docker 一致，host 模式下容器直接使用宿主机的端口，忽略端口映射
+		if networkMode != constant.NetworkModeHost {
+			return nil, fmt.Errorf("port publishing is not supported in network mode %s", networkMode)
+		}
+		log.Warnf("published ports are discarded when using host network mode")
+		ports = nil
+	}
+
+	// 获取容器的 DNS 配置和额外的 hosts 记录
+	dns, err := parseDNS(ctx.StringSlice("dns"))
+	if err != nil {
+		return nil, err
+	}
+	extraHosts, err := parseExtraHosts(ctx.StringSlice("add-host"))
+	if err != nil {
+		return nil, err
+	}
+	// 获取容器的出站流量策略，规则安装在容器自己的 network namespace 中
+	egress, err := parseEgressPolicy(ctx.StringSlice("egress-allow"))
+	if err != nil {
+		return nil, err
+	}
+	if egress != nil && (networkMode == constant.NetworkModeHost || strings.HasPrefix(networkMode, constant.NetworkModeContainerPrefix)) {
+		return nil, fmt.Errorf("egress policy is not supported in network mode %s", networkMode)
+	}
+	resources, err := createCgroupResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if (resources.NetIngressRate > 0 || resources.NetEgressRate > 0) && len(endpoints) == 0 {
+		return nil, fmt.Errorf("network bandwidth limits are not supported in network mode %s", networkMode)
+	}
+	hostname := ctx.String("hostname")
+	if hostname == "" {
+		hostname = defaultHostname(containerID, networkMode)
+	}
+
+	// 获取容器的运行命令
+	cmdArray := resolveCommand(ctx, imageConf)
+	if len(cmdArray) == 0 {
 		log.Warnf("missing container command, filling with '/bin/bash' ")
 		cmdArray = append(cmdArray, string("/bin/bash"))
-	} else {
-		for _, arg := range ctx.Args() {
-			cmdArray = append(cmdArray, arg)
-		}
+	}
+
+	// 获取容器的环境变量
+	env, err := mergeEnv(imageConf.Env, ctx.StringSlice("e"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse env: %v", err)
 	}
 
 	// 判断容器在前台运行还是后台运行
@@ -62,20 +129,112 @@ func CreateConfig(ctx *cli.Context) (*Config, error) {
 	// 这里并不需要判断 detach 为 true 的情况，因为 detach 为 true 时，tty 必为 false
 
 	return &Config{
-		ID:          containerID,
-		Name:        containerName,
-		Rootfs:      path.Join(constant.RootPath, "rootfs", containerID),
-		RwLayer:     path.Join(constant.RootPath, "layers", containerID),
-		StateDir:    path.Join(constant.StatePath, containerID),
-		LogPath:     path.Join(constant.StatePath, containerID, constant.LogFileName),
-		Mounts:      mounts,
-		TTY:         tty,
-		CmdArray:    cmdArray,
-		Cgroup:      createCgroupConfig(ctx, containerID),
-		CreatedTime: createdTime,
+		ID:            containerID,
+		Name:          containerName,
+		Image:         imageName,
+		Rootfs:        path.Join(constant.RootPath, "rootfs", containerID),
+		RwLayer:       path.Join(constant.ContainerPath, containerID),
+		StorageDriver: storage.DefaultDriver(),
+		StateDir:      path.Join(constant.StatePath, containerID),
+		LogPath:       path.Join(constant.StatePath, containerID, constant.LogFileName),
+		Mounts:        mounts,
+		NetworkMode:   networkMode,
+		Endpoints:     endpoints,
+		Ports:         ports,
+		Hostname:      hostname,
+		DNS:           dns,
+		DNSSearch:     ctx.StringSlice("dns-search"),
+		ExtraHosts:    extraHosts,
+		Egress:        egress,
+		TTY:           tty,
+		AutoRemove:    ctx.Bool("rm"),
+		CmdArray:      cmdArray,
+		WorkingDir:    imageConf.WorkingDir,
+		User:          imageConf.User,
+		Cgroup:        createCgroupConfig(containerID, resources),
+		CreatedTime:   createdTime,
+		Env:           env,
 	}, nil
 }
 
+// 根据镜像的默认配置和用户指定的参数，确定容器的运行命令，规则与 docker 一致：
+// 1. 指定了 --entrypoint 时，使用它替换镜像的 Entrypoint，同时忽略镜像的 Cmd
+// 2. 用户在镜像名称之后指定了命令时，使用它替换镜像的 Cmd
+// 3. 最终的命令为 Entrypoint + Cmd
+func resolveCommand(ctx *cli.Context, imageConf *image.ImageConfig) []string {
+	entrypoint := imageConf.Entrypoint
+	cmd := imageConf.Cmd
+	if ctx.IsSet("entrypoint") {
+		entrypoint = nil
+		cmd = nil
+		// --entrypoint "" 表示清空镜像的 Entrypoint
+		if ep := ctx.String("entrypoint"); ep != "" {
+			entrypoint = []string{ep}
+		}
+	}
+	if ctx.NArg() > 1 {
+		cmd = ctx.Args().Tail()
+	}
+
+	cmdArray := make([]string, 0, len(entrypoint)+len(cmd))
+	cmdArray = append(cmdArray, entrypoint...)
+	cmdArray = append(cmdArray, cmd...)
+	return cmdArray
+}
+
+// 合并镜像的默认环境变量与用户通过 -e 指定的环境变量，同名变量以用户指定的为准
+func mergeEnv(imageEnv []string, userEnv []string) ([]string, error) {
+	env := make([]string, 0, len(imageEnv)+len(userEnv))
+	index := make(map[string]int)
+	for _, list := range [][]string{imageEnv, userEnv} {
+		for _, kv := range list {
+			key, _, _ := strings.Cut(kv, "=")
+			if key == "" {
+				return nil, fmt.Errorf("invalid env: [%v]", kv)
+			}
+			if i, ok := index[key]; ok {
+				env[i] = kv
+				continue
+			}
+			index[key] = len(env)
+			env = append(env, kv)
+		}
+	}
+	return env, nil
+}
+
+// 生成构建镜像时运行 RUN 指令的临时容器的 Config
+// 临时容器直接使用指定的镜像层，并在前台运行，以便将输出打印到终端
+func CreateBuildConfig(layers []string, cmdArray []string, env []string, workingDir string, user string) *Config {
+	utcPlus8 := time.FixedZone("UTC+8", 8*60*60)
+	now := time.Now().In(utcPlus8)
+	createdTime := now.Format("2006-01-02 15:04:05")
+
+	// 同一秒内可能会运行多个临时容器，因此使用纳秒级的时间戳生成 ID
+	containerID := generateContainerID(fmt.Sprintf("build-%d", now.UnixNano()))
+
+	return &Config{
+		ID:            containerID,
+		Name:          "build_" + containerID[:12],
+		Layers:        layers,
+		Rootfs:        path.Join(constant.RootPath, "rootfs", containerID),
+		RwLayer:       path.Join(constant.ContainerPath, containerID),
+		StorageDriver: storage.DefaultDriver(),
+		StateDir:      path.Join(constant.StatePath, containerID),
+		LogPath:       path.Join(constant.StatePath, containerID, constant.LogFileName),
+		NetworkMode:   constant.NetworkModeBridge,
+		Endpoints:     []*Endpoint{{Network: constant.DefaultNetwork}},
+		Hostname:      containerID[:12],
+		TTY:           true,
+		CmdArray:      cmdArray,
+		WorkingDir:    workingDir,
+		User:          user,
+		Cgroup:        createCgroupConfig(containerID, &Resources{Memory: "max", CpuPeriod: defaultCPUPeriod}),
+		CreatedTime:   createdTime,
+		Env:           env,
+	}
+}
+
 // 生成容器ID
 func generateContainerID(input string) string {
 	hash := sha256.New()
@@ -133,41 +292,61 @@ func extractVolumeMounts(ctx *cli.Context) ([]*Mount, error) {
 }
 
 // 生成 cgroup 配置
-func createCgroupConfig(ctx *cli.Context, containerID string) *Cgroup {
+func createCgroupConfig(containerID string, res *Resources) *Cgroup {
 	name := "m-docker-" + containerID
 
 	return &Cgroup{
 		Name:      name,
 		Path:      path.Join(constant.CgroupRootPath, name+".scope"),
-		Resources: createCgroupResource(ctx),
+		Resources: res,
 	}
 }
 
 // 生成 cgroup 资源配置
-func createCgroupResource(ctx *cli.Context) *Resources {
+func createCgroupResource(ctx *cli.Context) (*Resources, error) {
+	res := &Resources{
+		Memory:    "max",
+		CpuPeriod: defaultCPUPeriod,
+	}
+	if err := UpdateResources(ctx, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 根据命令行参数修改资源限制，只修改命令行中设置了的限制，run 和 update 命令共用
+func UpdateResources(ctx *cli.Context, res *Resources) error {
 	// 内存限制
-	memory := ctx.String("mem")
-	if memory == "" {
-		memory = "max"
+	if memory := ctx.String("mem"); memory != "" {
+		res.Memory = memory
 	}
 
-	// cpu 使用率限制
-	var cpuQuota uint64
-	cpuPercent := ctx.Float64("cpu")
-	if cpuPercent == 0 {
-		cpuQuota = 0
-	} else {
-		cpuQuota = uint64(cpuPercent * defaultCPUPeriod)
+	// cpu 使用率限制，为 0 时不限制
+	if ctx.IsSet("cpu") {
+		res.CpuPeriod = defaultCPUPeriod
+		res.CpuQuota = uint64(ctx.Float64("cpu") * defaultCPUPeriod)
 	}
 
-	return &Resources{
-		Memory:    memory,
-		CpuPeriod: defaultCPUPeriod,
-		CpuQuota:  cpuQuota,
+	// 网络带宽限制
+	if ctx.IsSet("net-ingress-rate") {
+		rate, err := parseRate(ctx.String("net-ingress-rate"))
+		if err != nil {
+			return err
+		}
+		res.NetIngressRate = rate
+	}
+	if ctx.IsSet("net-egress-rate") {
+		rate, err := parseRate(ctx.String("net-egress-rate"))
+		if err != nil {
+			return err
+		}
+		res.NetEgressRate = rate
 	}
+	return nil
 }
 
 // 将容器的 Config 持久化存储到磁盘上
+// 状态目录位于 tmpfs 上，重启后会被清空，因此同时在读写层目录下保存一份，用于恢复已经停止的容器
 func RecordContainerConfig(conf *Config) error {
 	// 创建容器的状态信息目录
 	if err := os.MkdirAll(conf.StateDir, 0777); err != nil {
@@ -179,29 +358,82 @@ func RecordContainerConfig(conf *Config) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal container config:  %v", err)
 	}
-	jsonStr := string(jsonBytes)
-	filePath := path.Join(conf.StateDir, constant.ConfigName)
+	if err := writeConfigFile(path.Join(conf.StateDir, constant.ConfigName), jsonBytes); err != nil {
+		return err
+	}
+
+	// 读写层目录由存储驱动创建，尚未创建时不保存
+	if filePath := persistentConfigPath(conf); filePath != "" {
+		if _, err := os.Stat(conf.RwLayer); err == nil {
+			if err := writeConfigFile(filePath, jsonBytes); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// 将 Config 写入文件
+func writeConfigFile(filePath string, jsonBytes []byte) error {
 	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s:  %v", filePath, err)
+	}
 	defer func() {
 		if err := file.Close(); err != nil {
 			log.Errorf("failed to close file %v:  %v", filePath, err)
 		}
 	}()
-	if err != nil {
-		return fmt.Errorf("failed to create file %s:  %v", filePath, err)
-	}
-	if _, err = file.WriteString(jsonStr); err != nil {
+	if _, err = file.Write(jsonBytes); err != nil {
 		return fmt.Errorf("failed to write container config to file %s:  %v", filePath, err)
 	}
-
 	return nil
 }
 
+// 容器 Config 在读写层目录下的路径
+// exec 使用的 Config 的状态目录在 /tmp/m-docker 下，与容器共享读写层，不能覆盖容器的 Config，此时返回空字符串
+func persistentConfigPath(conf *Config) string {
+	if conf.RwLayer == "" || conf.StateDir != path.Join(constant.StatePath, conf.ID) {
+		return ""
+	}
+	return path.Join(conf.RwLayer, constant.ConfigName)
+}
+
 // 删除容器的状态信息
+// 先删除读写层目录下的 Config，避免其他 m-docker 进程在此期间重新恢复该容器
 func DeleteContainerState(conf *Config) {
+	if filePath := persistentConfigPath(conf); filePath != "" {
+		os.Remove(filePath)
+	}
 	os.RemoveAll(conf.StateDir)
 }
 
+// 读取读写层目录下保存的 Config，只返回状态目录已经不存在的容器，如宿主机重启后 /run 被清空
+func ListPersistedConfigs() []*Config {
+	entries, err := os.ReadDir(constant.ContainerPath)
+	if err != nil {
+		return nil
+	}
+	var configs []*Config
+	for _, entry := range entries {
+		if _, err := os.Stat(path.Join(constant.StatePath, entry.Name())); !os.IsNotExist(err) {
+			continue
+		}
+		content, err := os.ReadFile(path.Join(constant.ContainerPath, entry.Name(), constant.ConfigName))
+		if err != nil {
+			continue
+		}
+		conf := new(Config)
+		if err := json.Unmarshal(content, conf); err != nil || conf.ID != entry.Name() {
+			log.Warningf("invalid container config in rw layer %s: %v", entry.Name(), err)
+			continue
+		}
+		configs = append(configs, conf)
+	}
+	return configs
+}
+
 // 根据容器状态目录路径获取容器 Config
 func GetConfigFromStatePath(statePath string) (*Config, error) {
 	configPath := path.Join(statePath, constant.ConfigName)
@@ -278,3 +510,34 @@ func GetIDFromNameOrPrefix(nameOrID string) (string, error) {
 
 	return id, nil
 }
+
+// 从容器名称或 ID 前缀获取容器 Config
+func GetConfigFromNameOrPrefix(nameOrID string) (*Config, error) {
+	id, err := GetIDFromNameOrPrefix(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	return GetConfigFromID(id)
+}
+
+// 获取所有容器的 Config，无法读取的容器会被忽略
+func ListConfigs() ([]*Config, error) {
+	dirs, err := os.ReadDir(constant.StatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read dir %s error: %v", constant.StatePath, err)
+	}
+
+	configs := make([]*Config, 0, len(dirs))
+	for _, dir := range dirs {
+		conf, err := GetConfigFromStatePath(path.Join(constant.StatePath, dir.Name()))
+		if err != nil {
+			log.Warningf("get config from id %s error: %v", dir.Name(), err)
+			continue
+		}
+		configs = append(configs, conf)
+	}
+	return configs, nil
+}
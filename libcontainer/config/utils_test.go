@@ -0,0 +1,77 @@
+package config
+
+import (
+	"flag"
+	"m-docker/libcontainer/image"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// 生成 m-docker run 的命令行参数所对应的 cli.Context，只包含 --entrypoint 参数
+func runContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("run", flag.ContinueOnError)
+	set.String("entrypoint", "", "")
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestResolveCommand(t *testing.T) {
+	imageConf := &image.ImageConfig{Entrypoint: []string{"/entry", "-x"}, Cmd: []string{"serve", "--port", "80"}}
+	tests := []struct {
+		name string
+		conf *image.ImageConfig
+		args []string
+		want []string
+	}{
+		{"image defaults", imageConf, []string{"img"}, []string{"/entry", "-x", "serve", "--port", "80"}},
+		{"command replaces cmd", imageConf, []string{"img", "sh", "-c", "ls"}, []string{"/entry", "-x", "sh", "-c", "ls"}},
+		{"entrypoint drops image cmd", imageConf, []string{"--entrypoint", "/bin/sh", "img"}, []string{"/bin/sh"}},
+		{"entrypoint and command", imageConf, []string{"--entrypoint", "/bin/sh", "img", "-c", "ls"}, []string{"/bin/sh", "-c", "ls"}},
+		{"empty entrypoint clears image entrypoint", imageConf, []string{"--entrypoint", "", "img", "ls"}, []string{"ls"}},
+		{"empty entrypoint without command", imageConf, []string{"--entrypoint=", "img"}, []string{}},
+		{"cmd only image", &image.ImageConfig{Cmd: []string{"sh"}}, []string{"img"}, []string{"sh"}},
+		{"empty image config", &image.ImageConfig{}, []string{"img"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveCommand(runContext(t, tt.args...), tt.conf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveCommand(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	tests := []struct {
+		imageEnv []string
+		userEnv  []string
+		want     []string
+		wantErr  bool
+	}{
+		{[]string{"PATH=/bin", "A=1"}, nil, []string{"PATH=/bin", "A=1"}, false},
+		// 同名变量以用户指定的为准，并保留在镜像中的位置
+		{[]string{"PATH=/bin", "A=1"}, []string{"B=2", "PATH=/usr/bin"}, []string{"PATH=/usr/bin", "A=1", "B=2"}, false},
+		{nil, []string{"A=1", "A=2"}, []string{"A=2"}, false},
+		// 只有名称的变量和值为空的变量
+		{nil, []string{"A", "B="}, []string{"A", "B="}, false},
+		{nil, []string{"A=x=y"}, []string{"A=x=y"}, false},
+		{nil, []string{"=1"}, nil, true},
+		{[]string{""}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := mergeEnv(tt.imageEnv, tt.userEnv)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("mergeEnv(%q, %q) succeeded", tt.imageEnv, tt.userEnv)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mergeEnv(%q, %q) = %q, %v, want %q", tt.imageEnv, tt.userEnv, got, err, tt.want)
+		}
+	}
+}
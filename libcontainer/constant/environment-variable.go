@@ -4,6 +4,9 @@ const (
 	// setns 目标进程的 PID
 	ENV_SETNS_PID = "SETNS_PID"
 
+	// 只加入该进程的 network namespace，用于 container:[id] 网络模式
+	ENV_SETNS_NET_PID = "SETNS_NET_PID"
+
 	// 是否不挂载根文件系统
 	ENV_NOT_MOUNT_ROOTFS = "NOT_MOUNT_ROOTFS"
 )
@@ -0,0 +1,42 @@
+package constant
+
+const (
+	// 默认网络的名称，容器默认连接到该网络
+	DefaultNetwork = "bridge"
+
+	// 默认网络所使用的网桥
+	DefaultBridge = "m-docker0"
+
+	// 默认网络的子网
+	DefaultSubnet = "172.29.0.0/16"
+
+	// 启用 IPv6 但没有指定子网时，从该 ULA 前缀中为网络分配 /64 子网
+	DefaultIPv6Pool = "fd6d:646f:636b::/48"
+
+	// 容器内网卡的名称
+	ContainerIfName = "eth0"
+)
+
+// 容器的网络模式
+const (
+	// 创建新的 network namespace，并通过 veth 设备连接到网络，默认使用该模式
+	NetworkModeBridge = "bridge"
+
+	// 创建新的 network namespace，只有 lo 设备
+	NetworkModeNone = "none"
+
+	// 使用宿主机的 network namespace
+	NetworkModeHost = "host"
+
+	// 加入其它容器的 network namespace，格式为 container:[id]
+	NetworkModeContainerPrefix = "container:"
+)
+
+// CNI 插件的默认路径，与 containerd 等运行时一致
+const (
+	// CNI 网络配置所在的目录
+	DefaultCNIConfigDir = "/etc/cni/net.d"
+
+	// CNI 插件可执行文件所在的目录，多个目录之间使用 ':' 分隔
+	DefaultCNIBinDir = "/opt/cni/bin"
+)
@@ -10,9 +10,39 @@ const (
 	// m-docker 数据的根目录
 	RootPath = "/var/lib/m-docker"
 
+	// 镜像元数据的存放目录
+	ImagePath = "/var/lib/m-docker/images"
+
+	// 内容寻址的 blob 存放目录，blob 以 sha256/[hex] 的形式存放
+	// 包括镜像层的原始 tar 包、镜像的 config 等
+	BlobPath = "/var/lib/m-docker/blobs"
+
+	// 镜像层解压后的存放目录，以 chainID 命名，每个镜像层只解压一次，由所有引用它的镜像共享
+	LayerPath = "/var/lib/m-docker/layers"
+
+	// 容器读写层的存放目录，以容器 ID 命名
+	// 读写层目录下还保存了容器 Config 的副本，状态目录被清空后据此恢复容器
+	ContainerPath = "/var/lib/m-docker/containers"
+
+	// 网络配置的存放目录，以网络名称命名
+	NetworkPath = "/var/lib/m-docker/networks"
+
+	// 各个网络的 IP 地址分配情况的存放目录，以网络名称命名
+	IPAMPath = "/var/lib/m-docker/ipam"
+
+	// 文件锁的存放目录，用于在多个 m-docker 进程之间互斥，如同时解压同一个镜像层
+	LockPath = "/var/lib/m-docker/locks"
+
+	// 构建镜像时的缓存目录，记录构建步骤与其所生成镜像层的对应关系
+	BuildCachePath = "/var/lib/m-docker/build-cache"
+
 	// m-docker 状态信息的根目录
 	StatePath = "/run/m-docker"
 
+	// 使用 CNI 网络的容器的 network namespace 的绑定挂载点所在的目录，以 [容器 ID]-[网卡名称] 命名
+	// 容器进程退出后 network namespace 仍然保留，直到对其执行 CNI 的 DEL
+	NetnsPath = "/run/m-docker-netns"
+
 	// 容器 Config 文件名
 	ConfigName = "config.json"
 
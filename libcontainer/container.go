@@ -1,13 +1,14 @@
 package libcontainer
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"m-docker/libcontainer/cgroup"
 	"m-docker/libcontainer/config"
 	"m-docker/libcontainer/constant"
 	"os"
 	"os/exec"
-	"strings"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
@@ -52,8 +53,19 @@ func (c *Container) Create() error {
 	if err := c.CgroupManager.Init(); err != nil {
 		return fmt.Errorf("failed to init cgroup: %v", err)
 	}
-	// 设置 cgroup 的资源限制
-	c.CgroupManager.Set(c.Config.Cgroup.Resources)
+	// 设置 cgroup 的资源限制，与 update 一致，无法设置时拒绝启动容器
+	if err := c.CgroupManager.Set(c.Config.Cgroup.Resources); err != nil {
+		return fmt.Errorf("failed to set cgroup resources: %v", err)
+	}
+
+	// 创建容器的网络端点，容器进程创建之后再移动到容器中
+	if err := SetupEndpoints(c.Config); err != nil {
+		return fmt.Errorf("failed to setup network: %v", err)
+	}
+	// 发布端口
+	if err := PublishPorts(c.Config); err != nil {
+		return fmt.Errorf("failed to publish ports: %v", err)
+	}
 
 	return nil
 }
@@ -83,15 +95,74 @@ func (c *Container) Start() error {
 		return fmt.Errorf("failed to apply process %v to cgroup: %v", c.Config.Pid, err)
 	}
 
+	// 配置容器的网络，此时容器进程还在等待管道中的参数，尚未运行用户的命令
+	// 复用已经存在的容器环境时，网络端点已经在容器中，不需要再次配置
+	if !c.Shared {
+		if err := AttachEndpoints(c.Config); err != nil {
+			writePipe.Close()
+			_ = process.Process.Kill()
+			_ = process.Wait()
+			return fmt.Errorf("failed to setup network: %v", err)
+		}
+		// 记录 veth 设备等网络信息
+		if err := config.RecordContainerConfig(c.Config); err != nil {
+			return fmt.Errorf("failed to record container config: %v", err)
+		}
+
+		// 容器加入网络后，更新同一网络中所有容器的 /etc/hosts
+		RefreshHosts(c.Config)
+	}
+
 	// 子进程创建之后再通过管道发送参数
-	sendCommand(c.Config.CmdArray, writePipe)
+	userProcess := &config.Process{
+		Args: c.Config.CmdArray,
+		Cwd:  c.Config.WorkingDir,
+		User: c.Config.User,
+	}
+	// 复用已经存在的容器环境时不修改主机名
+	if !c.Shared {
+		userProcess.Hostname = c.Config.Hostname
+	}
+	sendProcess(userProcess, writePipe)
 
-	// 等待容器进程结束
-	err = process.Wait()
+	// 等待容器进程结束，并记录容器进程的退出码
+	if err := process.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return fmt.Errorf("failed to wait process: %v", err)
+		}
+	}
+	c.Config.ExitCode = process.ProcessState.ExitCode()
 
 	return nil
 }
 
+// 容器进程退出后释放容器的运行环境，但保留容器的读写层和状态信息
+// 之后可以通过 export、cp 等命令访问已经停止的容器，通过 rm 命令将其删除
+func (c *Container) Release() {
+	log.Debugf("Release container %s", c.Config.ID)
+	// 释放 cgroup
+	c.CgroupManager.Destroy()
+
+	// 卸载 volume
+	UmountVolumes(c.Config)
+
+	// 卸载 rootfs，读写层保留
+	UmountRootfs(c.Config)
+
+	// 撤销发布的端口，释放容器的网络
+	UnpublishPorts(c.Config)
+	syncEndpoints(c.Config)
+	ReleaseEndpoints(c.Config)
+	RefreshHosts(c.Config)
+
+	c.Config.Status = constant.ContainerStopped
+	c.Config.Pid = 0
+	if err := config.RecordContainerConfig(c.Config); err != nil {
+		log.Errorf("failed to record container config: %v", err)
+	}
+}
+
 // 清理容器数据
 func (c *Container) Remove() {
 	log.Debugf("Remove container %s", c.Config.ID)
@@ -108,6 +179,32 @@ func (c *Container) Remove() {
 
 		// 删除 rootfs
 		DeleteRootfs(c.Config)
+
+		// 撤销发布的端口，释放容器的网络
+		UnpublishPorts(c.Config)
+		ReleaseEndpoints(c.Config)
+		RefreshHosts(c.Config)
+	}
+}
+
+// 宿主机重启后 /run 被清空，根据读写层目录下保存的 Config 恢复容器
+// 只在状态信息的根目录不存在时由第一个 m-docker 进程执行一次，此时容器进程都已经退出，恢复的容器均为已停止状态
+// 容器的 network namespace 已经随之销毁，释放端点占用的地址后只保留网络名称和网卡名称
+func RestoreContainers() {
+	if err := os.Mkdir(constant.StatePath, 0755); err != nil {
+		return
+	}
+	for _, conf := range config.ListPersistedConfigs() {
+		log.Debugf("restore stopped container %s", conf.ID)
+		ReleaseEndpoints(conf)
+		for _, ep := range conf.Endpoints {
+			*ep = config.Endpoint{Network: ep.Network, IfName: ep.IfName}
+		}
+		conf.Status = constant.ContainerStopped
+		conf.Pid = 0
+		if err := config.RecordContainerConfig(conf); err != nil {
+			log.Warnf("failed to restore container %s: %v", conf.ID, err)
+		}
 	}
 }
 
@@ -128,9 +225,13 @@ func (c *Container) newInitProcess() (*exec.Cmd, *os.File, error) {
 	// 如果不是复用已经存在的容器环境，就需要创建新的 UTS、PID、Mount、NET、IPC namespace
 	if !c.Shared {
 		// CLoneflags 参数表明这个句柄将以 clone 系统调用创建进程
+		cloneflags := syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC
+		// host 和 container:[id] 模式不创建新的 network namespace
+		if newNetns(conf) {
+			cloneflags |= syscall.CLONE_NEWNET
+		}
 		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS |
-				syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
+			Cloneflags: uintptr(cloneflags),
 		}
 	}
 
@@ -169,13 +270,29 @@ func (c *Container) newInitProcess() (*exec.Cmd, *os.File, error) {
 	// 设置容器进程的环境变量
 	cmd.Env = append(os.Environ(), conf.Env...)
 
+	// container:[id] 模式下，容器进程启动时由 nsenter 加入目标容器的 network namespace
+	if !c.Shared {
+		targetPid, err := netnsTargetPid(conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if targetPid != 0 {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", constant.ENV_SETNS_NET_PID, targetPid))
+		}
+	}
+
 	return cmd, writePipe, nil
 }
 
 // 通过匿名管道发送参数给子进程
-func sendCommand(comArray []string, writePipe *os.File) {
-	command := strings.Join(comArray, " ")
-	log.Debugf("Send command: %s", command)
-	_, _ = writePipe.WriteString(command)
-	_ = writePipe.Close()
+// 参数以 json 的形式发送，以保留命令参数中的空格
+func sendProcess(process *config.Process, writePipe *os.File) {
+	defer writePipe.Close()
+	data, err := json.Marshal(process)
+	if err != nil {
+		log.Errorf("marshal process error: %v", err)
+		return
+	}
+	log.Debugf("Send process: %s", data)
+	_, _ = writePipe.Write(data)
 }
@@ -0,0 +1,336 @@
+package libcontainer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/archive"
+	"m-docker/libcontainer/config"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// 将容器中的 srcPath 复制到宿主机的 dstPath，规则与 docker cp 一致
+// dstPath 为 - 时将 srcPath 打包为 tar 流写入 w
+// 运行中的容器直接访问其 rootfs，已经停止的容器则临时挂载其文件系统
+// 容器中的路径由 chroot 到容器 rootfs 的子进程解析并打包，见 CopyHelper
+func CopyFromContainer(conf *config.Config, srcPath string, dstPath string, w io.Writer) error {
+	rootfs, release, err := MountContainerFS(conf, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if dstPath != "-" {
+		if dstPath, err = hostPath(dstPath); err != nil {
+			return err
+		}
+	}
+	return runCopyHelper(copyHelperTar, rootfs, srcPath, func(in io.Writer, out *bufio.Reader) error {
+		// 子进程先返回源路径的信息，据此确定源路径在 tar 流中的名称
+		src := new(copyInfo)
+		if err := readCopyLine(out, src); err != nil {
+			return err
+		}
+		if dstPath == "-" {
+			if err := writeCopyLine(in, src.Name); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, out)
+			return err
+		}
+		destDir, name, err := resolveDest("/", dstPath, src)
+		if err != nil {
+			return err
+		}
+		if err := writeCopyLine(in, name); err != nil {
+			return err
+		}
+		return archive.UntarWithOptions(out, destDir, &archive.UntarOptions{})
+	})
+}
+
+// 将宿主机的 srcPath 复制到容器中的 dstPath，规则与 docker cp 一致
+// srcPath 为 - 时从 r 中读取 tar 流，解压到容器中的 dstPath 目录下
+// 容器中的路径由 chroot 到容器 rootfs 的子进程解析并解压，容器中的符号链接无法指向宿主机上的文件
+func CopyToContainer(conf *config.Config, srcPath string, dstPath string, r io.Reader) error {
+	rootfs, release, err := MountContainerFS(conf, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var src *copySource
+	info := &copyInfo{Archive: srcPath == "-"}
+	if !info.Archive {
+		if srcPath, err = hostPath(srcPath); err != nil {
+			return err
+		}
+		if src, err = resolveSource("/", srcPath); err != nil {
+			return err
+		}
+		info = src.copyInfo()
+	}
+	return runCopyHelper(copyHelperUntar, rootfs, dstPath, func(in io.Writer, out *bufio.Reader) error {
+		// 子进程根据源路径的信息确定解压的目录，并返回源路径在 tar 流中应使用的名称
+		if err := writeCopyLine(in, info); err != nil {
+			return err
+		}
+		var name string
+		if err := readCopyLine(out, &name); err != nil {
+			return err
+		}
+		if info.Archive {
+			_, err := io.Copy(in, r)
+			return err
+		}
+		return archive.TarWithOptions(src.path, in, &archive.TarOptions{Name: name})
+	})
+}
+
+// 子进程所执行的操作
+const (
+	// 打包容器中的源路径
+	copyHelperTar = "tar"
+
+	// 解压到容器中的目标路径
+	copyHelperUntar = "untar"
+)
+
+// 在子进程中 chroot 到容器的 rootfs 之后再访问容器中的路径，与 docker 一致
+// 若在宿主机上先解析路径再访问，运行中的容器可以在两步之间将路径中的目录替换为指向 / 的符号链接，使读写落到宿主机上；
+// chroot 之后所有路径都由内核在容器的 rootfs 之内解析，无论容器如何修改其文件系统都无法访问到 rootfs 之外的文件
+// args 为 [tar|untar] [rootfs] [容器中的路径]，与父进程之间通过标准输入输出交换一行 json 后传输 tar 流：
+// 1. tar：向父进程发送源路径的 copyInfo，读取源路径在 tar 流中的名称，然后将 tar 流写入标准输出
+// 2. untar：读取源路径的 copyInfo，向父进程发送源路径在 tar 流中应使用的名称，然后从标准输入读取 tar 流并解压
+func CopyHelper(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: cp-helper tar|untar ROOTFS PATH")
+	}
+	op, rootfs, p := args[0], args[1], args[2]
+	if err := syscall.Chroot(rootfs); err != nil {
+		return fmt.Errorf("failed to chroot to %s: %v", rootfs, err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	switch op {
+	case copyHelperTar:
+		src, err := resolveSource("/", p)
+		if err != nil {
+			return err
+		}
+		if err := writeCopyLine(os.Stdout, src.copyInfo()); err != nil {
+			return err
+		}
+		var name string
+		if err := readCopyLine(in, &name); err != nil {
+			return err
+		}
+		return archive.TarWithOptions(src.path, os.Stdout, &archive.TarOptions{Name: name})
+	case copyHelperUntar:
+		src := new(copyInfo)
+		if err := readCopyLine(in, src); err != nil {
+			return err
+		}
+		var destDir, name string
+		if src.Archive {
+			destDir = filepath.Clean("/" + p)
+			if fi, err := os.Stat(destDir); err != nil || !fi.IsDir() {
+				return fmt.Errorf("destination %s must be an existing directory", p)
+			}
+		} else {
+			var err error
+			if destDir, name, err = resolveDest("/", p, src); err != nil {
+				return err
+			}
+		}
+		if err := writeCopyLine(os.Stdout, name); err != nil {
+			return err
+		}
+		return archive.UntarWithOptions(in, destDir, &archive.UntarOptions{})
+	default:
+		return fmt.Errorf("unknown cp-helper operation %q", op)
+	}
+}
+
+// 启动 chroot 到 rootfs 的子进程，通过 fn 与其交互，返回子进程或 fn 的错误
+func runCopyHelper(op string, rootfs string, p string, fn func(in io.Writer, out *bufio.Reader) error) error {
+	cmd := exec.Command("/proc/self/exe", "cp-helper", op, rootfs, p)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start cp-helper: %v", err)
+	}
+
+	fnErr := fn(in, bufio.NewReader(out))
+	in.Close()
+	if fnErr != nil {
+		// 子进程可能阻塞在读写管道上
+		_ = cmd.Process.Kill()
+	}
+	// 子进程失败时，fn 的错误通常只是管道被关闭，子进程输出的错误才是原因
+	if err := cmd.Wait(); err != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%s", strings.TrimSpace(stderr.String()))
+	} else if err != nil && fnErr == nil {
+		return fmt.Errorf("cp-helper failed: %v", err)
+	}
+	return fnErr
+}
+
+// 在父进程与子进程之间传递的源路径信息
+type copyInfo struct {
+	// 源路径在 tar 流中的默认名称，只复制目录内容时为空
+	Name string `json:"name"`
+
+	// 源路径是否为目录
+	IsDir bool `json:"isDir"`
+
+	// 源路径为 -，直接解压用户提供的 tar 流
+	Archive bool `json:"archive,omitempty"`
+}
+
+// 写入一行 json，json 中的字符串会转义换行符，因此文件名中的换行符不会影响分行
+func writeCopyLine(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// 读取一行 json，之后的内容为 tar 流
+func readCopyLine(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// 复制的源路径
+type copySource struct {
+	// 源路径在宿主机上的路径
+	path string
+
+	// 源路径的文件信息，符号链接不会被解析
+	info os.FileInfo
+
+	// 源路径以 /. 结尾，表示只复制目录中的内容
+	contentsOnly bool
+}
+
+// 源路径在 tar 包中的名称，只复制目录内容时为空
+func (src *copySource) name() string {
+	if src.contentsOnly {
+		return ""
+	}
+	return filepath.Base(src.path)
+}
+
+// 传递给另一个进程的源路径信息
+func (src *copySource) copyInfo() *copyInfo {
+	return &copyInfo{Name: src.name(), IsDir: src.info.IsDir()}
+}
+
+// 在 root 之内解析复制的源路径
+// 与 docker cp 一致，源路径自身为符号链接时复制链接本身，除非以 / 结尾
+func resolveSource(root string, p string) (*copySource, error) {
+	src := &copySource{
+		contentsOnly: strings.HasSuffix(p, "/.") || p == ".",
+	}
+
+	clean := filepath.Clean("/" + p)
+	if strings.HasSuffix(p, "/") || src.contentsOnly {
+		resolved, err := archive.ResolvePath(root, clean)
+		if err != nil {
+			return nil, err
+		}
+		src.path = resolved
+	} else {
+		dir, err := archive.ResolvePath(root, filepath.Dir(clean))
+		if err != nil {
+			return nil, err
+		}
+		src.path = filepath.Join(dir, filepath.Base(clean))
+	}
+
+	info, err := os.Lstat(src.path)
+	if err != nil {
+		return nil, fmt.Errorf("source %s: %v", p, err)
+	}
+	if src.contentsOnly && !info.IsDir() {
+		return nil, fmt.Errorf("source %s is not a directory", p)
+	}
+	src.info = info
+	return src, nil
+}
+
+// 在 root 之内解析目标路径，确定解压的目录以及源路径在其中的名称：
+// 1. 目标是已经存在的目录时，复制到该目录下，只复制目录内容时直接解压到该目录中
+// 2. 目标是已经存在的文件时，源路径也必须是文件，并覆盖目标
+// 3. 目标不存在时，其父目录必须存在，源路径复制后重命名为目标
+func resolveDest(root string, dst string, src *copyInfo) (string, string, error) {
+	clean := filepath.Clean("/" + dst)
+	resolved, err := archive.ResolvePath(root, clean)
+	if err != nil {
+		return "", "", err
+	}
+
+	fi, err := os.Stat(resolved)
+	if err == nil {
+		if fi.IsDir() {
+			return resolved, src.Name, nil
+		}
+		if src.IsDir {
+			return "", "", fmt.Errorf("cannot copy a directory to a file: %s", dst)
+		}
+		return filepath.Dir(resolved), filepath.Base(resolved), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	if strings.HasSuffix(dst, "/") && !src.IsDir {
+		return "", "", fmt.Errorf("destination directory %s does not exist", dst)
+	}
+	parent := filepath.Dir(resolved)
+	if fi, err := os.Stat(parent); err != nil || !fi.IsDir() {
+		return "", "", fmt.Errorf("destination directory %s does not exist", filepath.Dir(clean))
+	}
+	return parent, filepath.Base(resolved), nil
+}
+
+// 将宿主机上的相对路径转换为绝对路径，并保留结尾的 / 和 /.
+func hostPath(p string) (string, error) {
+	if filepath.IsAbs(p) {
+		return p, nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasSuffix(p, "/.") || p == ".":
+		abs += "/."
+	case strings.HasSuffix(p, "/"):
+		abs += "/"
+	}
+	return abs, nil
+}
@@ -0,0 +1,15 @@
+package libcontainer
+
+import (
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/storage"
+)
+
+// 获取容器的文件系统相对于镜像的变化，按路径排序
+func Changes(conf *config.Config) ([]storage.Change, error) {
+	driver, err := storage.NewStorageDriver(conf.StorageDriver)
+	if err != nil {
+		return nil, err
+	}
+	return driver.Diff(conf.RwLayer, conf.Layers)
+}
@@ -0,0 +1,19 @@
+package libcontainer
+
+import (
+	"io"
+	"m-docker/libcontainer/archive"
+	"m-docker/libcontainer/config"
+)
+
+// 将容器的文件系统打包为 tar 流写入 w，即镜像层和读写层合并后的内容
+// 打包时跳过 volume 等挂载点中的内容，只保留容器自身的文件
+func Export(conf *config.Config, w io.Writer) error {
+	rootfs, release, err := MountContainerFS(conf, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return archive.TarWithOptions(rootfs, w, &archive.TarOptions{OneFileSystem: true})
+}
@@ -0,0 +1,347 @@
+package libcontainer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/constant"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 为容器生成并挂载到 /etc 下的文件，文件保存在容器的状态信息目录中
+var containerFiles = []string{"hosts", "hostname", "resolv.conf"}
+
+var (
+	// 宿主机的 hosts，host 模式的容器直接使用
+	hostHosts = "/etc/hosts"
+
+	// 宿主机的 DNS 配置
+	hostResolvConf = "/etc/resolv.conf"
+
+	// 宿主机使用 systemd-resolved 时，/etc/resolv.conf 中是本地的 stub 地址，该文件中是真正的上游服务器
+	systemdResolvConf = "/run/systemd/resolve/resolv.conf"
+)
+
+// 宿主机上没有可用的 DNS 服务器时使用的默认服务器，与 docker 一致
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// 生成容器的 hosts、hostname 和 resolv.conf，并 bind mount 到 rootfs 的 /etc 下
+// container:[id] 模式下直接挂载目标容器的文件，与其共享网络配置
+func mountContainerFiles(conf *config.Config) error {
+	dir := conf.StateDir
+	if strings.HasPrefix(conf.NetworkMode, constant.NetworkModeContainerPrefix) {
+		target, err := config.GetConfigFromID(strings.TrimPrefix(conf.NetworkMode, constant.NetworkModeContainerPrefix))
+		if err != nil {
+			return fmt.Errorf("failed to get network container: %v", err)
+		}
+		dir = target.StateDir
+	} else {
+		if err := writeContainerFiles(conf); err != nil {
+			return err
+		}
+	}
+
+	etc := path.Join(conf.Rootfs, "etc")
+	if fi, err := os.Lstat(etc); os.IsNotExist(err) {
+		if err := os.Mkdir(etc, 0755); err != nil {
+			return fmt.Errorf("failed to create dir %s: %v", etc, err)
+		}
+	} else if err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s in the image is not a directory", "/etc")
+	}
+
+	for _, name := range containerFiles {
+		dest := path.Join(etc, name)
+		if err := ensureMountFile(dest); err != nil {
+			return err
+		}
+		if err := syscall.Mount(path.Join(dir, name), dest, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind mount /etc/%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// 卸载容器的 hosts、hostname 和 resolv.conf
+func umountContainerFiles(conf *config.Config) {
+	for _, name := range containerFiles {
+		_ = syscall.Unmount(path.Join(conf.Rootfs, "etc", name), syscall.MNT_DETACH)
+	}
+}
+
+// 准备文件的挂载点
+// 镜像中的文件可能是指向容器外部的符号链接，bind mount 会跟随符号链接，因此将其替换为普通文件
+func ensureMountFile(dest string) error {
+	fi, err := os.Lstat(dest)
+	if err == nil && fi.Mode().IsRegular() {
+		return nil
+	}
+	if err == nil {
+		if err := os.RemoveAll(dest); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", dest, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dest, err)
+	}
+	return file.Close()
+}
+
+// 在容器的状态信息目录中生成 hosts、hostname 和 resolv.conf
+func writeContainerFiles(conf *config.Config) error {
+	if err := os.MkdirAll(conf.StateDir, 0755); err != nil {
+		return fmt.Errorf("failed to create container state dir: %v", err)
+	}
+	if err := os.WriteFile(path.Join(conf.StateDir, "hostname"), []byte(conf.Hostname+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write hostname: %v", err)
+	}
+	resolv, err := buildResolvConf(conf)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(conf.StateDir, "resolv.conf"), resolv, 0644); err != nil {
+		return fmt.Errorf("failed to write resolv.conf: %v", err)
+	}
+	return writeHosts(conf, nil)
+}
+
+// 重新生成与容器连接到同一网络的所有运行中容器的 hosts，使它们可以通过容器名称互相访问
+// 容器加入或离开网络时调用，conf 的最新状态以内存中的为准
+func RefreshHosts(conf *config.Config) {
+	refreshHosts(conf, endpointNetworks(conf))
+}
+
+// 重新生成 conf 以及连接到 networks 中任意网络的运行中容器的 hosts
+func refreshHosts(conf *config.Config, networks []string) {
+	if len(networks) == 0 {
+		return
+	}
+	confs, err := config.ListConfigs()
+	if err != nil {
+		log.Warnf("failed to refresh hosts: %v", err)
+		return
+	}
+	peers := []*config.Config{conf}
+	for _, other := range confs {
+		if other.ID != conf.ID && other.Status == constant.ContainerRunning {
+			peers = append(peers, other)
+		}
+	}
+
+	for _, peer := range peers {
+		// 容器离开网络后不再更新它自己的 hosts，它的状态信息目录可能已经被删除
+		if peer.ID == conf.ID && !connected(conf) {
+			continue
+		}
+		if peer.ID != conf.ID && !connectedToAny(peer, networks) {
+			continue
+		}
+		if err := writeHosts(peer, peers); err != nil {
+			log.Warnf("failed to refresh hosts of container %s: %v", peer.ID, err)
+		}
+	}
+}
+
+// 生成容器的 hosts，包含容器自身、同一网络中的其它容器以及通过 --add-host 添加的记录
+// 直接覆盖文件内容而不是重新创建文件，已经 bind mount 到容器中的文件会随之更新
+func writeHosts(conf *config.Config, peers []*config.Config) error {
+	var buf bytes.Buffer
+	if conf.NetworkMode == constant.NetworkModeHost {
+		// host 模式使用宿主机的 hosts
+		content, err := os.ReadFile(hostHosts)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", hostHosts, err)
+		}
+		buf.Write(content)
+	} else {
+		buf.WriteString("127.0.0.1\tlocalhost\n")
+		buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+		buf.WriteString("fe00::0\tip6-localnet\n")
+		buf.WriteString("ff00::0\tip6-mcastprefix\n")
+		buf.WriteString("ff02::1\tip6-allnodes\n")
+		buf.WriteString("ff02::2\tip6-allrouters\n")
+		for _, ep := range conf.Endpoints {
+			for _, ip := range endpointIPs(ep) {
+				fmt.Fprintf(&buf, "%s\t%s\n", ip, hostNames(conf))
+			}
+		}
+		if len(conf.Endpoints) == 0 {
+			// 没有连接网络时，主机名解析到回环地址
+			fmt.Fprintf(&buf, "127.0.0.1\t%s\n", hostNames(conf))
+		}
+
+		// 同一网络中的其它容器
+		for _, peer := range peers {
+			if peer.ID == conf.ID {
+				continue
+			}
+			for _, ep := range peer.Endpoints {
+				if !hasEndpoint(conf, ep.Network) {
+					continue
+				}
+				for _, ip := range endpointIPs(ep) {
+					fmt.Fprintf(&buf, "%s\t%s\n", ip, hostNames(peer))
+				}
+			}
+		}
+	}
+
+	for _, h := range conf.ExtraHosts {
+		host, ip, _ := strings.Cut(h, ":")
+		fmt.Fprintf(&buf, "%s\t%s\n", ip, host)
+	}
+
+	if err := os.WriteFile(path.Join(conf.StateDir, "hosts"), buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write hosts: %v", err)
+	}
+	return nil
+}
+
+// hosts 中容器的名称：主机名和容器名称
+func hostNames(conf *config.Config) string {
+	if conf.Hostname == "" || conf.Hostname == conf.Name {
+		return conf.Name
+	}
+	return conf.Hostname + " " + conf.Name
+}
+
+// 端点的 IPv4 和 IPv6 地址，不带子网掩码，端点没有连接时返回空
+func endpointIPs(ep *config.Endpoint) []string {
+	var ips []string
+	for _, address := range []string{ep.IPAddress, ep.IPv6Address} {
+		if ip, _, err := net.ParseCIDR(address); err == nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips
+}
+
+// 容器是否有已经连接的网络端点
+func connected(conf *config.Config) bool {
+	for _, ep := range conf.Endpoints {
+		if len(endpointIPs(ep)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 容器是否连接到指定的网络
+func hasEndpoint(conf *config.Config, network string) bool {
+	for _, ep := range conf.Endpoints {
+		if ep.Network == network {
+			return true
+		}
+	}
+	return false
+}
+
+// 容器是否连接到 networks 中的任意网络
+func connectedToAny(conf *config.Config, networks []string) bool {
+	for _, network := range networks {
+		if hasEndpoint(conf, network) {
+			return true
+		}
+	}
+	return false
+}
+
+// 容器所连接的网络名称
+func endpointNetworks(conf *config.Config) []string {
+	var networks []string
+	for _, ep := range conf.Endpoints {
+		networks = append(networks, ep.Network)
+	}
+	return networks
+}
+
+// 生成容器的 resolv.conf，以宿主机的配置为基础，使用 --dns 和 --dns-search 覆盖其中的服务器和搜索域
+// 容器有独立的 network namespace 时，宿主机上的回环地址在容器中无法访问，需要去掉
+func buildResolvConf(conf *config.Config) ([]byte, error) {
+	content, err := os.ReadFile(hostResolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %v", hostResolvConf, err)
+	}
+	nameservers, search, others := parseResolvConf(content)
+
+	if conf.NetworkMode != constant.NetworkModeHost && len(conf.DNS) == 0 {
+		nameservers = filterLoopback(nameservers)
+		if len(nameservers) == 0 {
+			// systemd-resolved 的 stub 地址在容器中无法访问，改用它的上游服务器
+			if content, err := os.ReadFile(systemdResolvConf); err == nil {
+				nameservers, _, _ = parseResolvConf(content)
+				nameservers = filterLoopback(nameservers)
+			}
+		}
+		if len(nameservers) == 0 {
+			log.Debugf("no usable nameserver on the host, using default nameservers")
+			nameservers = defaultNameservers
+		}
+	}
+	if len(conf.DNS) > 0 {
+		nameservers = conf.DNS
+	}
+	if len(conf.DNSSearch) > 0 {
+		search = conf.DNSSearch
+	}
+
+	var buf bytes.Buffer
+	for _, ns := range nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	// 与 docker 一致，--dns-search . 表示不使用搜索域
+	if len(search) > 0 && !(len(search) == 1 && search[0] == ".") {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(search, " "))
+	}
+	for _, line := range others {
+		fmt.Fprintf(&buf, "%s\n", line)
+	}
+	return buf.Bytes(), nil
+}
+
+// 解析 resolv.conf，返回其中的 DNS 服务器、搜索域以及其它配置行
+func parseResolvConf(content []byte) ([]string, []string, []string) {
+	var nameservers, search, others []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) > 1 {
+				nameservers = append(nameservers, fields[1])
+			}
+		case "search", "domain":
+			search = fields[1:]
+		default:
+			others = append(others, line)
+		}
+	}
+	return nameservers, search, others
+}
+
+// 去掉回环地址的 DNS 服务器
+func filterLoopback(nameservers []string) []string {
+	var result []string
+	for _, ns := range nameservers {
+		if ip := net.ParseIP(ns); ip != nil && !ip.IsLoopback() {
+			result = append(result, ns)
+		}
+	}
+	return result
+}
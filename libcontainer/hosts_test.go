@@ -0,0 +1,197 @@
+package libcontainer
+
+import (
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/constant"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 使用临时目录中的文件作为宿主机的 hosts 和 resolv.conf，内容为空字符串时文件不存在
+func fakeHostFiles(t *testing.T, hosts string, resolv string, systemd string) {
+	dir := t.TempDir()
+	oldHosts, oldResolv, oldSystemd := hostHosts, hostResolvConf, systemdResolvConf
+	hostHosts, hostResolvConf, systemdResolvConf = path.Join(dir, "hosts"), path.Join(dir, "resolv.conf"), path.Join(dir, "systemd-resolv.conf")
+	t.Cleanup(func() {
+		hostHosts, hostResolvConf, systemdResolvConf = oldHosts, oldResolv, oldSystemd
+	})
+	for file, content := range map[string]string{hostHosts: hosts, hostResolvConf: resolv, systemdResolvConf: systemd} {
+		if content == "" {
+			continue
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseResolvConf(t *testing.T) {
+	tests := []struct {
+		content     string
+		nameservers []string
+		search      []string
+		others      []string
+	}{
+		{"", nil, nil, nil},
+		{
+			"# generated\nnameserver 10.0.0.2\n; comment\nnameserver 1.1.1.1\nsearch a.example b.example\noptions ndots:2\n",
+			[]string{"10.0.0.2", "1.1.1.1"}, []string{"a.example", "b.example"}, []string{"options ndots:2"},
+		},
+		// domain 与 search 互相覆盖，以最后一个为准
+		{"search a.example\ndomain b.example\n", nil, []string{"b.example"}, nil},
+		// 没有地址的 nameserver 被忽略，行首和行尾的空白被去掉
+		{"nameserver\n  nameserver 8.8.8.8  \n", []string{"8.8.8.8"}, nil, nil},
+	}
+	for _, tt := range tests {
+		nameservers, search, others := parseResolvConf([]byte(tt.content))
+		if !reflect.DeepEqual(nameservers, tt.nameservers) || !reflect.DeepEqual(search, tt.search) || !reflect.DeepEqual(others, tt.others) {
+			t.Errorf("parseResolvConf(%q) = %q, %q, %q, want %q, %q, %q", tt.content, nameservers, search, others, tt.nameservers, tt.search, tt.others)
+		}
+	}
+}
+
+func TestBuildResolvConf(t *testing.T) {
+	tests := []struct {
+		name    string
+		resolv  string
+		systemd string
+		conf    *config.Config
+		want    string
+	}{
+		{
+			name:   "host servers",
+			resolv: "nameserver 10.0.0.2\nsearch example.com\noptions ndots:2\n",
+			conf:   &config.Config{NetworkMode: constant.NetworkModeBridge},
+			want:   "nameserver 10.0.0.2\nsearch example.com\noptions ndots:2\n",
+		},
+		{
+			name:    "loopback replaced by systemd-resolved upstream",
+			resolv:  "nameserver 127.0.0.53\nsearch example.com\n",
+			systemd: "nameserver 192.168.1.1\nnameserver 127.0.0.1\n",
+			conf:    &config.Config{NetworkMode: constant.NetworkModeBridge},
+			want:    "nameserver 192.168.1.1\nsearch example.com\n",
+		},
+		{
+			name:   "loopback replaced by default servers",
+			resolv: "nameserver 127.0.0.53\nnameserver ::1\n",
+			conf:   &config.Config{NetworkMode: constant.NetworkModeBridge},
+			want:   "nameserver 8.8.8.8\nnameserver 8.8.4.4\n",
+		},
+		{
+			name: "no host resolv.conf",
+			conf: &config.Config{NetworkMode: constant.NetworkModeNone},
+			want: "nameserver 8.8.8.8\nnameserver 8.8.4.4\n",
+		},
+		{
+			name:   "host mode keeps loopback",
+			resolv: "nameserver 127.0.0.53\n",
+			conf:   &config.Config{NetworkMode: constant.NetworkModeHost},
+			want:   "nameserver 127.0.0.53\n",
+		},
+		{
+			name:   "dns and dns-search override the host",
+			resolv: "nameserver 10.0.0.2\nsearch example.com\noptions ndots:2\n",
+			conf:   &config.Config{NetworkMode: constant.NetworkModeBridge, DNS: []string{"127.0.0.1", "9.9.9.9"}, DNSSearch: []string{"a.test", "b.test"}},
+			want:   "nameserver 127.0.0.1\nnameserver 9.9.9.9\nsearch a.test b.test\noptions ndots:2\n",
+		},
+		{
+			name:   "dns-search . removes the search domains",
+			resolv: "nameserver 10.0.0.2\nsearch example.com\n",
+			conf:   &config.Config{NetworkMode: constant.NetworkModeBridge, DNSSearch: []string{"."}},
+			want:   "nameserver 10.0.0.2\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeHostFiles(t, "", tt.resolv, tt.systemd)
+			got, err := buildResolvConf(tt.conf)
+			if err != nil {
+				t.Fatalf("buildResolvConf: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("buildResolvConf() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// hosts 中除了固定的 localhost 记录之外的内容
+func hostsEntries(t *testing.T, conf *config.Config) string {
+	content, err := os.ReadFile(path.Join(conf.StateDir, "hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && (fields[1] == "localhost" || strings.HasPrefix(fields[1], "ip6-")) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestWriteHosts(t *testing.T) {
+	fakeHostFiles(t, "127.0.0.1\tlocalhost\n10.1.1.1\thost.example\n", "", "")
+	web := &config.Config{
+		ID:          "web",
+		Name:        "web",
+		Hostname:    "webhost",
+		StateDir:    t.TempDir(),
+		NetworkMode: constant.NetworkModeBridge,
+		Endpoints: []*config.Endpoint{
+			{Network: "front", IPAddress: "172.18.0.2/16", IPv6Address: "fd00::2/64"},
+			{Network: "back", IPAddress: "172.19.0.2/16"},
+		},
+		ExtraHosts: []string{"db.example:10.2.2.2"},
+	}
+	db := &config.Config{
+		ID:       "db",
+		Name:     "db",
+		Hostname: "db",
+		Endpoints: []*config.Endpoint{
+			{Network: "back", IPAddress: "172.19.0.3/16"},
+		},
+	}
+	other := &config.Config{
+		ID:        "other",
+		Name:      "other",
+		Endpoints: []*config.Endpoint{{Network: "elsewhere", IPAddress: "172.20.0.2/16"}},
+	}
+	// 已经断开的端点没有地址，不会出现在 hosts 中
+	stopped := &config.Config{
+		ID:        "stopped",
+		Name:      "stopped",
+		Endpoints: []*config.Endpoint{{Network: "front"}},
+	}
+
+	if err := writeHosts(web, []*config.Config{web, db, other, stopped}); err != nil {
+		t.Fatalf("writeHosts: %v", err)
+	}
+	want := "172.18.0.2\twebhost web\nfd00::2\twebhost web\n172.19.0.2\twebhost web\n172.19.0.3\tdb\n10.2.2.2\tdb.example"
+	if got := hostsEntries(t, web); got != want {
+		t.Errorf("hosts =\n%s\nwant\n%s", got, want)
+	}
+
+	// 没有连接网络时主机名解析到回环地址
+	none := &config.Config{ID: "none", Name: "none", StateDir: t.TempDir(), NetworkMode: constant.NetworkModeNone}
+	if err := writeHosts(none, nil); err != nil {
+		t.Fatalf("writeHosts: %v", err)
+	}
+	if got := hostsEntries(t, none); got != "127.0.0.1\tnone" {
+		t.Errorf("hosts without network = %q", got)
+	}
+
+	// host 模式使用宿主机的 hosts，并追加 --add-host 的记录
+	host := &config.Config{ID: "host", Name: "host", StateDir: t.TempDir(), NetworkMode: constant.NetworkModeHost, ExtraHosts: []string{"a:10.3.3.3"}}
+	if err := writeHosts(host, nil); err != nil {
+		t.Fatalf("writeHosts: %v", err)
+	}
+	content, _ := os.ReadFile(path.Join(host.StateDir, "hosts"))
+	if want := "127.0.0.1\tlocalhost\n10.1.1.1\thost.example\n10.3.3.3\ta\n"; string(content) != want {
+		t.Errorf("hosts in host mode = %q, want %q", content, want)
+	}
+}
@@ -0,0 +1,204 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/constant"
+	"os"
+	"path"
+)
+
+// blob 写入过程中的临时文件存放目录，与 blob 位于同一文件系统，保证 rename 是原子的
+const blobIngestDir = "ingest"
+
+// 获取 blob 在内容存储中的路径
+func BlobPath(digest string) string {
+	hexStr, _ := ParseDigest(digest)
+	return path.Join(constant.BlobPath, digestAlgorithm, hexStr)
+}
+
+// 判断 blob 是否已经存在
+func HasBlob(digest string) bool {
+	if _, err := ParseDigest(digest); err != nil {
+		return false
+	}
+	_, err := os.Stat(BlobPath(digest))
+	return err == nil
+}
+
+// 打开内容存储中的 blob
+// blob 在写入时已经校验过摘要，因此这里不再重复校验
+func OpenBlob(digest string) (*os.File, error) {
+	if _, err := ParseDigest(digest); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(BlobPath(digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("blob %s not found", digest)
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// 将 r 中的数据写入内容存储，返回其摘要和大小
+// 若 expected 不为空，则校验数据的摘要是否与其一致
+// 数据先写入临时文件，校验通过后再原子地重命名，因此不会留下不完整的 blob
+// 写入期间持有镜像存储的共享锁，清理不会删除正在写入的临时文件
+func WriteBlob(r io.Reader, expected string) (string, int64, error) {
+	if expected != "" {
+		if _, err := ParseDigest(expected); err != nil {
+			return "", 0, err
+		}
+	}
+	unlock, err := LockStore()
+	if err != nil {
+		return "", 0, err
+	}
+	defer unlock()
+
+	ingestPath := path.Join(constant.BlobPath, blobIngestDir)
+	if err := os.MkdirAll(ingestPath, 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create dir %s: %v", ingestPath, err)
+	}
+	if err := os.MkdirAll(path.Join(constant.BlobPath, digestAlgorithm), 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create blob dir: %v", err)
+	}
+	tmpFile, err := os.CreateTemp(ingestPath, "blob-")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, hash), r)
+	if err != nil {
+		tmpFile.Close()
+		return "", 0, fmt.Errorf("failed to write blob: %v", err)
+	}
+	// 确保数据落盘后再重命名
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return "", 0, fmt.Errorf("failed to sync blob: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", 0, fmt.Errorf("failed to close blob: %v", err)
+	}
+
+	digest := digestFromHex(hex.EncodeToString(hash.Sum(nil)))
+	if expected != "" && digest != expected {
+		return "", 0, fmt.Errorf("digest mismatch: expected %s, got %s", expected, digest)
+	}
+
+	// 相同内容的 blob 只保存一份
+	if HasBlob(digest) {
+		return digest, size, nil
+	}
+	if err := os.Rename(tmpFile.Name(), BlobPath(digest)); err != nil {
+		return "", 0, fmt.Errorf("failed to commit blob %s: %v", digest, err)
+	}
+	return digest, size, nil
+}
+
+// 将数据写入内容存储，返回其摘要
+func WriteBlobBytes(data []byte) (string, error) {
+	digest := DigestBytes(data)
+	if HasBlob(digest) {
+		return digest, nil
+	}
+	if _, _, err := WriteBlob(bytes.NewReader(data), digest); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// 从内容存储中读取 blob 并将其反序列化到 v 中
+func ReadJSONBlob(desc Descriptor, v interface{}) error {
+	blob, err := OpenBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	if err := json.NewDecoder(blob).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode blob %s: %v", desc.Digest, err)
+	}
+	return nil
+}
+
+// 将对象序列化为 json 后写入内容存储，返回其描述符
+func writeJSONBlob(mediaType string, v interface{}) (Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	digest, err := WriteBlobBytes(data)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{
+		MediaType: mediaType,
+		Digest:    digest,
+		Size:      int64(len(data)),
+	}, nil
+}
+
+// 写入文件时先写入同目录下的临时文件，再原子地重命名
+func atomicWriteFile(filePath string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(path.Dir(filePath), "."+path.Base(filePath)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filePath)
+}
+
+// 清理不在 keep 中的 blob，以及写入中断后残留的临时文件，返回被删除的 blob 数量
+// 镜像的 config 和 manifest 可以随时通过 Image.Manifest 重新生成，因此无需保留
+// 与 PruneLayers 一样，调用者需要持有镜像存储的排他锁
+func PruneBlobs(keep map[string]bool) (int, error) {
+	if err := os.RemoveAll(path.Join(constant.BlobPath, blobIngestDir)); err != nil {
+		return 0, fmt.Errorf("failed to clean ingest dir: %v", err)
+	}
+
+	blobDir := path.Join(constant.BlobPath, digestAlgorithm)
+	entries, err := os.ReadDir(blobDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read dir %s: %v", blobDir, err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if keep[digestFromHex(entry.Name())] {
+			continue
+		}
+		if err := os.Remove(path.Join(blobDir, entry.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove blob %s: %v", entry.Name(), err)
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,37 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// 目前只支持 sha256 摘要
+const digestAlgorithm = "sha256"
+
+// 将 sha256 摘要的十六进制形式转换为 sha256:[hex] 的形式
+func digestFromHex(hexStr string) string {
+	return digestAlgorithm + ":" + hexStr
+}
+
+// 计算数据的 sha256 摘要
+func DigestBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return digestFromHex(hex.EncodeToString(sum[:]))
+}
+
+// 解析 sha256:[hex] 形式的摘要，返回其十六进制部分
+func ParseDigest(digest string) (string, error) {
+	algorithm, hexStr, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != digestAlgorithm {
+		return "", fmt.Errorf("unsupported digest: %s", digest)
+	}
+	if len(hexStr) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid digest: %s", digest)
+	}
+	if _, err := hex.DecodeString(hexStr); err != nil || strings.ToLower(hexStr) != hexStr {
+		return "", fmt.Errorf("invalid digest: %s", digest)
+	}
+	return hexStr, nil
+}
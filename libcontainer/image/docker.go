@@ -0,0 +1,139 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// docker save 所生成的镜像包中，描述各个镜像的文件
+const dockerManifestFile = "manifest.json"
+
+// manifest.json 中描述单个镜像的条目
+type dockerManifest struct {
+	// 镜像 config 文件在镜像包中的相对路径
+	Config string `json:"Config"`
+
+	// 镜像的所有名称，如 ubuntu:latest
+	RepoTags []string `json:"RepoTags"`
+
+	// 各镜像层 tar 包在镜像包中的相对路径，按照自底向上的顺序排列
+	Layers []string `json:"Layers"`
+}
+
+// 从解压后的 docker save 镜像包目录中加载镜像
+func loadDockerArchive(dir string) ([]string, error) {
+	var manifests []dockerManifest
+	if err := readJSONFile(path.Join(dir, dockerManifestFile), &manifests); err != nil {
+		return nil, fmt.Errorf("invalid docker archive: %v", err)
+	}
+
+	var names []string
+	for _, m := range manifests {
+		loaded, err := loadDockerManifest(dir, m)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, loaded...)
+	}
+
+	return names, nil
+}
+
+// 加载 manifest.json 中的单个镜像，镜像的每个 tag 都会保存一份镜像元数据
+func loadDockerManifest(dir string, m dockerManifest) ([]string, error) {
+	configFile, err := openArchiveFile(dir, m.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+	config := new(OCIConfig)
+	if err := json.NewDecoder(configFile).Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to decode config %s: %v", m.Config, err)
+	}
+	if len(config.RootFS.DiffIDs) != len(m.Layers) {
+		return nil, fmt.Errorf("config %s has %d diff_ids but manifest has %d layers", m.Config, len(config.RootFS.DiffIDs), len(m.Layers))
+	}
+
+	// 将各个镜像层写入内容存储并解压
+	var diffIDs []string
+	parent := ""
+	for i, layerPath := range m.Layers {
+		layer, err := loadDockerLayer(dir, layerPath, parent, config.RootFS.DiffIDs[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load layer %s: %v", layerPath, err)
+		}
+		diffIDs = append(diffIDs, layer.DiffID)
+		parent = layer.ChainID
+	}
+
+	// 没有 tag 的镜像使用 config 文件名的前 12 位作为名称
+	tags := m.RepoTags
+	untagged := len(tags) == 0
+	if untagged {
+		base := path.Base(m.Config)
+		if len(base) > 12 {
+			base = base[:12]
+		}
+		tags = []string{base}
+	}
+
+	for _, tag := range tags {
+		if err := SaveImage(&Image{
+			Name:     tag,
+			Layers:   diffIDs,
+			Config:   config.Config,
+			Created:  config.Created,
+			History:  config.History,
+			Untagged: untagged,
+		}); err != nil {
+			return nil, fmt.Errorf("failed to save image %s: %v", tag, err)
+		}
+		log.Debugf("loaded image %s", tag)
+	}
+
+	return tags, nil
+}
+
+// 将 docker save 镜像包中的镜像层写入内容存储，并在 parent 之上创建镜像层
+func loadDockerLayer(dir string, layerPath string, parent string, diffID string) (*Layer, error) {
+	if layer, err := GetLayer(ChainID(parent, diffID)); err == nil {
+		return layer, nil
+	}
+
+	file, err := openArchiveFile(dir, layerPath)
+	if err != nil {
+		return nil, err
+	}
+	digest, size, err := WriteBlob(file, "")
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateLayerFromBlob(parent, Descriptor{
+		MediaType: MediaTypeOCILayer,
+		Digest:    digest,
+		Size:      size,
+	}, diffID)
+}
+
+// 打开镜像包中的文件
+// 较新版本的 docker 会将文件放在 blobs/sha256 下，这些文件在解压时已经写入了内容存储
+func openArchiveFile(dir string, name string) (io.ReadCloser, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if hexStr, ok := strings.CutPrefix(name, "blobs/"+digestAlgorithm+"/"); ok {
+		return OpenBlob(digestFromHex(hexStr))
+	}
+	return os.Open(archivePath(dir, name))
+}
+
+// 将镜像包中的相对路径拼接到 dir 下，并避免跳出 dir
+func archivePath(dir string, name string) string {
+	return path.Join(dir, path.Clean("/"+name))
+}
@@ -0,0 +1,346 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"m-docker/libcontainer/constant"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 镜像的元数据
+// 一个镜像由若干个有序的镜像层组成，镜像层可以被多个镜像共享
+type Image struct {
+	// 镜像名称
+	Name string `json:"name"`
+
+	// 镜像层的 diffID，按照自底向上的顺序排列
+	// 镜像层解压后存放在 LayerPath/[chainID] 目录下
+	Layers []string `json:"layers"`
+
+	// 镜像的默认运行配置，在创建容器的 Config 时使用
+	Config *ImageConfig `json:"config,omitempty"`
+
+	// 镜像的创建时间
+	Created *time.Time `json:"created,omitempty"`
+
+	// 镜像的构建历史，按照时间顺序排列
+	History []History `json:"history,omitempty"`
+
+	// 镜像没有指定名称，使用 DefaultName 生成的默认名称，即悬空镜像
+	// 用户通过 tag 等方式指定的名称即使与默认名称格式相同，也不是悬空镜像
+	Untagged bool `json:"untagged,omitempty"`
+}
+
+// 根据镜像名称获取镜像的元数据
+// 优先读取 ImagePath/[name].json 元数据文件，
+// 若不存在，则将 ImagePath/[name].tar 作为只有一层的镜像导入，以兼容之前直接放置 tar 包的用法
+func GetImage(name string) (*Image, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+
+	metaPath := path.Join(constant.ImagePath, name+".json")
+	content, err := os.ReadFile(metaPath)
+	if err == nil {
+		img := new(Image)
+		if err := json.Unmarshal(content, img); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal image metadata %s: %v", metaPath, err)
+		}
+		if len(img.Layers) == 0 {
+			return nil, fmt.Errorf("image %s has no layers", name)
+		}
+		for _, diffID := range img.Layers {
+			if _, err := ParseDigest(diffID); err != nil {
+				return nil, fmt.Errorf("image %s has invalid layer: %v", name, err)
+			}
+		}
+		img.Name = name
+		return img, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read image metadata %s: %v", metaPath, err)
+	}
+
+	// 没有元数据文件，则尝试将 [name].tar 作为单层镜像导入
+	tarPath := path.Join(constant.ImagePath, name+".tar")
+	if _, err := os.Stat(tarPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("image %s not found", name)
+		}
+		return nil, fmt.Errorf("failed to stat image %s: %v", name, err)
+	}
+	return importTarImage(name, tarPath)
+}
+
+// 将单个 tar 包作为单层镜像导入到内容存储中
+func importTarImage(name string, tarPath string) (*Image, error) {
+	log.Infof("importing image %s from %s", name, tarPath)
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, err := Import(file, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import %s: %v", tarPath, err)
+	}
+	return img, nil
+}
+
+// 将 tar 包作为单层镜像导入，tar 包可以经过 gzip 压缩，如 export 命令导出的容器文件系统
+// 导入的镜像没有默认的运行配置；name 为空时使用镜像层摘要的前 12 位作为名称
+func Import(r io.Reader, name string) (*Image, error) {
+	if name != "" {
+		if err := validateName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	unlock, err := LockStore()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	digest, size, err := WriteBlob(r, "")
+	if err != nil {
+		return nil, err
+	}
+	desc := Descriptor{
+		MediaType: MediaTypeOCILayer,
+		Digest:    digest,
+		Size:      size,
+	}
+	// 压缩包的 diffID 需要解压后才能得到
+	diffID := digest
+	if isGzipBlob(digest) {
+		desc.MediaType = MediaTypeOCILayerGz
+		diffID = ""
+	}
+	layer, err := CreateLayerFromBlob("", desc, diffID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	img := &Image{
+		Name:    name,
+		Layers:  []string{layer.DiffID},
+		Created: &now,
+		History: []History{{Created: &now, Comment: "Imported from tarball"}},
+	}
+	if name == "" {
+		img.Name = DefaultName(layer.DiffID)
+		img.Untagged = true
+	}
+	if err := SaveImage(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// 列出所有镜像，元数据无法读取的镜像会被忽略
+func ListImages() ([]*Image, error) {
+	var images []*Image
+	err := filepath.WalkDir(constant.ImagePath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == constant.ImagePath {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".json") || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(constant.ImagePath, p)
+		if err != nil {
+			return err
+		}
+		img, err := GetImage(strings.TrimSuffix(rel, ".json"))
+		if err != nil {
+			log.Warnf("failed to get image %s: %v", rel, err)
+			return nil
+		}
+		images = append(images, img)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %v", err)
+	}
+	return images, nil
+}
+
+// 删除镜像的元数据，镜像层可能被其他镜像共享，由 PruneLayers 统一清理
+func DeleteImage(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	metaPath := path.Join(constant.ImagePath, name+".json")
+	if err := os.Remove(metaPath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("image %s not found", name)
+		}
+		return err
+	}
+
+	// 清理名称中的 '/' 所产生的空目录
+	for dir := path.Dir(metaPath); dir != constant.ImagePath; dir = path.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// 生成没有指定名称的镜像的默认名称，即摘要的前 12 位
+func DefaultName(digest string) string {
+	hexStr, _ := ParseDigest(digest)
+	if len(hexStr) < 12 {
+		return hexStr
+	}
+	return hexStr[:12]
+}
+
+// 判断镜像是否为悬空镜像，即没有指定名称而使用默认名称的镜像
+func (img *Image) Dangling() bool {
+	return img.Untagged
+}
+
+// 将镜像的元数据写入 ImagePath/[name].json
+func SaveImage(img *Image) error {
+	if err := validateName(img.Name); err != nil {
+		return err
+	}
+
+	jsonBytes, err := json.Marshal(img)
+	if err != nil {
+		return fmt.Errorf("failed to marshal image metadata: %v", err)
+	}
+	metaPath := path.Join(constant.ImagePath, img.Name+".json")
+	// 镜像名称中可能带有 '/'，如 library/ubuntu
+	if err := os.MkdirAll(path.Dir(metaPath), 0755); err != nil {
+		return fmt.Errorf("failed to create dir %s: %v", path.Dir(metaPath), err)
+	}
+	if err := atomicWriteFile(metaPath, jsonBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write image metadata %s: %v", metaPath, err)
+	}
+	return nil
+}
+
+// 计算镜像各层的 chainID，按照自底向上的顺序排列
+func (img *Image) ChainIDs() []string {
+	chainIDs := make([]string, 0, len(img.Layers))
+	parent := ""
+	for _, diffID := range img.Layers {
+		parent = ChainID(parent, diffID)
+		chainIDs = append(chainIDs, parent)
+	}
+	return chainIDs
+}
+
+// 获取镜像各层解压后的目录，按照自底向上的顺序排列
+func (img *Image) LayerDirs() ([]string, error) {
+	chainIDs := img.ChainIDs()
+	dirs := make([]string, 0, len(chainIDs))
+	for _, chainID := range chainIDs {
+		if _, err := GetLayer(chainID); err != nil {
+			return nil, fmt.Errorf("image %s: %v", img.Name, err)
+		}
+		dirs = append(dirs, LayerDir(chainID))
+	}
+	return dirs, nil
+}
+
+// 生成镜像的 OCI manifest 并写入内容存储，返回 manifest 的描述符
+// 镜像的 config 和各个镜像层的 blob 也会一并写入内容存储，因此可以直接通过描述符读取它们
+func (img *Image) Manifest() (Descriptor, error) {
+	chainIDs := img.ChainIDs()
+	layers := make([]Descriptor, 0, len(chainIDs))
+	diffIDs := make([]string, 0, len(chainIDs))
+	for _, chainID := range chainIDs {
+		desc, diffID, err := LayerBlob(chainID)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configDesc, err := writeJSONBlob(MediaTypeOCIConfig, &OCIConfig{
+		Created:      img.Created,
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		Config:       img.Config,
+		RootFS: RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+		History: img.History,
+	})
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to write config: %v", err)
+	}
+
+	manifestDesc, err := writeJSONBlob(MediaTypeOCIManifest, &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        configDesc,
+		Layers:        layers,
+	})
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return manifestDesc, nil
+}
+
+// 获取镜像的构建历史
+// 历史记录中生成镜像层的步骤数与镜像层数不一致时（如直接导入的旧镜像），为每个镜像层生成一条没有描述的记录
+func (img *Image) LayerHistory() []History {
+	nonEmpty := 0
+	for _, h := range img.History {
+		if !h.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty == len(img.Layers) {
+		return append([]History{}, img.History...)
+	}
+	history := make([]History, len(img.Layers))
+	for i := range history {
+		history[i].Created = img.Created
+	}
+	return history
+}
+
+// 为镜像添加一个新的名称，新名称与原镜像共享所有镜像层
+// 若新名称已经被其他镜像使用，则该名称会指向新的镜像
+func Tag(source string, target string) error {
+	img, err := GetImage(source)
+	if err != nil {
+		return err
+	}
+	img.Name = target
+	img.Untagged = false
+	return SaveImage(img)
+}
+
+// 校验镜像名称，避免通过镜像名称访问到 ImagePath 之外的路径
+func validateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("image name can not be empty")
+	}
+	if strings.HasPrefix(name, "/") || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid image name: %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package image
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/archive"
+	"m-docker/libcontainer/constant"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// 镜像层目录下存放解压内容的子目录，作为 overlay 的 lowerdir
+	layerDiffDir = "diff"
+
+	// 镜像层目录下的元数据文件
+	layerMetaFile = "layer.json"
+
+	// 正在解压的镜像层的临时目录前缀，崩溃后残留的临时目录可以被安全地清理
+	layerTmpPrefix = ".tmp-"
+
+	// 镜像存储的锁文件名称
+	storeLockName = "image-store"
+)
+
+// 镜像层的元数据
+type Layer struct {
+	// 镜像层的 chainID，由其自身及所有下层的 diffID 计算得到，用于唯一标识一个镜像层目录
+	ChainID string `json:"chainID"`
+
+	// 镜像层未压缩的 tar 包的摘要
+	DiffID string `json:"diffID"`
+
+	// 下一层镜像层的 chainID，最底层的镜像层为空
+	Parent string `json:"parent,omitempty"`
+
+	// 镜像层未压缩的 tar 包的大小
+	Size int64 `json:"size"`
+
+	// 镜像层的原始 blob，如 pull 或 load 时得到的压缩包
+	Blob *Descriptor `json:"blob,omitempty"`
+}
+
+// 计算镜像层的 chainID
+// 最底层的 chainID 即为其 diffID，其余层为 sha256(parent + " " + diffID)
+func ChainID(parent string, diffID string) string {
+	if parent == "" {
+		return diffID
+	}
+	return DigestBytes([]byte(parent + " " + diffID))
+}
+
+// 获取镜像层在 LayerPath 下的目录
+func layerPath(chainID string) string {
+	hexStr, _ := ParseDigest(chainID)
+	return path.Join(constant.LayerPath, hexStr)
+}
+
+// 获取镜像层解压后的内容目录
+func LayerDir(chainID string) string {
+	return path.Join(layerPath(chainID), layerDiffDir)
+}
+
+// 根据 chainID 获取镜像层的元数据
+func GetLayer(chainID string) (*Layer, error) {
+	if _, err := ParseDigest(chainID); err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path.Join(layerPath(chainID), layerMetaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("layer %s not found", chainID)
+		}
+		return nil, err
+	}
+	layer := new(Layer)
+	if err := json.Unmarshal(content, layer); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal layer metadata %s: %v", chainID, err)
+	}
+	return layer, nil
+}
+
+// 在 parent 之上创建一个镜像层，r 为镜像层的 tar 包，可以经过 gzip 压缩
+// 若 diffID 不为空，则校验解压内容的摘要；若对应的镜像层已经存在，则直接复用而不再解压
+// 镜像层先解压到临时目录中，校验通过后再原子地重命名，因此崩溃时不会留下看似完整的镜像层
+// 解压期间持有镜像层的文件锁，同时运行的多个进程只会解压一次相同的镜像层
+// 同时持有镜像存储的共享锁，清理不会删除正在解压的临时目录
+func CreateLayer(parent string, r io.Reader, diffID string, blob *Descriptor) (*Layer, error) {
+	unlockStore, err := LockStore()
+	if err != nil {
+		return nil, err
+	}
+	defer unlockStore()
+
+	locked := false
+	if diffID != "" {
+		if _, err := ParseDigest(diffID); err != nil {
+			return nil, err
+		}
+		if layer, err := GetLayer(ChainID(parent, diffID)); err == nil {
+			log.Debugf("layer %s already exists", layer.ChainID)
+			return layer, nil
+		}
+
+		// 加锁之后再检查一次，其他进程可能已经解压完成了
+		unlock, err := lockLayer(ChainID(parent, diffID))
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		locked = true
+		if layer, err := GetLayer(ChainID(parent, diffID)); err == nil {
+			log.Debugf("layer %s already exists", layer.ChainID)
+			return layer, nil
+		}
+	}
+	if parent != "" {
+		if _, err := GetLayer(parent); err != nil {
+			return nil, fmt.Errorf("parent layer: %v", err)
+		}
+	}
+
+	// 镜像层可能经过 gzip 压缩
+	br := bufio.NewReader(r)
+	var reader io.Reader = br
+	if isGzip(br) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	if err := os.MkdirAll(constant.LayerPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dir %s: %v", constant.LayerPath, err)
+	}
+	tmpDir, err := os.MkdirTemp(constant.LayerPath, layerTmpPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 解压的同时计算未压缩内容的摘要和大小
+	hash := sha256.New()
+	counter := &countWriter{}
+	tee := io.TeeReader(reader, io.MultiWriter(hash, counter))
+	diffDir := path.Join(tmpDir, layerDiffDir)
+	if err := os.Mkdir(diffDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := archive.Untar(tee, diffDir); err != nil {
+		return nil, err
+	}
+	// tar 的结束标记之后可能还有填充数据，它们同样计入 diff_id
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil, err
+	}
+	actual := digestFromHex(hex.EncodeToString(hash.Sum(nil)))
+	if diffID != "" && actual != diffID {
+		return nil, fmt.Errorf("diff_id mismatch: expected %s, got %s", diffID, actual)
+	}
+
+	layer := &Layer{
+		ChainID: ChainID(parent, actual),
+		DiffID:  actual,
+		Parent:  parent,
+		Size:    counter.n,
+		Blob:    blob,
+	}
+	meta, err := json.Marshal(layer)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path.Join(tmpDir, layerMetaFile), meta, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// 事先不知道 diffID 时，只能在解压完成后对镜像层加锁
+	if !locked {
+		unlock, err := lockLayer(layer.ChainID)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	// 相同的镜像层可能已经被其他镜像创建过了，此时直接复用
+	if existing, err := GetLayer(layer.ChainID); err == nil {
+		return existing, nil
+	}
+	if err := os.Rename(tmpDir, layerPath(layer.ChainID)); err != nil {
+		if existing, err := GetLayer(layer.ChainID); err == nil {
+			return existing, nil
+		}
+		return nil, fmt.Errorf("failed to commit layer %s: %v", layer.ChainID, err)
+	}
+	log.Debugf("created layer %s", layer.ChainID)
+	return layer, nil
+}
+
+// 对镜像层加文件锁，返回用于解锁的函数
+// 文件锁在进程退出时由内核自动释放，因此进程崩溃不会导致死锁
+func lockLayer(chainID string) (func(), error) {
+	hexStr, err := ParseDigest(chainID)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile("layer-"+hexStr, unix.LOCK_EX)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock layer %s: %v", chainID, err)
+	}
+	return unlock, nil
+}
+
+// 对镜像存储加共享锁，返回用于解锁的函数
+// 写入 blob、解压镜像层，以及从创建镜像层到保存引用它们的镜像的整个过程中都需要持有，
+// 清理镜像层和 blob 时加排他锁，避免删除正在解压的临时目录，或者刚刚创建、还没有被镜像引用的镜像层和 blob
+func LockStore() (func(), error) {
+	unlock, err := lockFile(storeLockName, unix.LOCK_SH)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock image store: %v", err)
+	}
+	return unlock, nil
+}
+
+// 对镜像存储加排他锁，返回用于解锁的函数，清理期间持有，此时没有其他进程在创建镜像层或镜像
+func LockStoreExclusive() (func(), error) {
+	unlock, err := lockFile(storeLockName, unix.LOCK_EX)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock image store: %v", err)
+	}
+	return unlock, nil
+}
+
+// 对锁目录中名为 name 的文件加 flock，how 为 LOCK_SH 或 LOCK_EX
+// 同一进程中多次加共享锁使用不同的文件描述符，互不影响
+func lockFile(name string, how int) (func(), error) {
+	if err := os.MkdirAll(constant.LockPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dir %s: %v", constant.LockPath, err)
+	}
+	lockPath := path.Join(constant.LockPath, name)
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %v", lockPath, err)
+	}
+	if err := unix.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		_ = unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// 从内容存储中的 blob 创建镜像层
+func CreateLayerFromBlob(parent string, desc Descriptor, diffID string) (*Layer, error) {
+	if diffID != "" {
+		if layer, err := GetLayer(ChainID(parent, diffID)); err == nil {
+			return layer, nil
+		}
+	}
+	blob, err := OpenBlob(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	return CreateLayer(parent, blob, diffID, &desc)
+}
+
+// 将目录打包为镜像层，叠加在 parent 之上，目录中 overlay 格式的 whiteout 会被转换为 OCI 格式
+func CreateLayerFromDir(parent string, dir string) (*Layer, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.Tar(dir, pw))
+	}()
+	layer, err := CreateLayerFromTar(parent, pr)
+	pr.Close()
+	return layer, err
+}
+
+// 将未压缩的镜像层 tar 流作为新的镜像层，叠加在 parent 之上
+// tar 包会先写入内容存储，作为镜像层的原始 blob，push 和 save 时直接使用
+func CreateLayerFromTar(parent string, r io.Reader) (*Layer, error) {
+	digest, size, err := WriteBlob(r, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write layer blob: %v", err)
+	}
+	return CreateLayerFromBlob(parent, Descriptor{
+		MediaType: MediaTypeOCILayer,
+		Digest:    digest,
+		Size:      size,
+	}, digest)
+}
+
+// 根据镜像层解压后的目录获取镜像层的元数据，是 LayerDir 的逆过程
+func LayerFromDir(dir string) (*Layer, error) {
+	layerDir := path.Dir(path.Clean(dir))
+	if path.Base(dir) != layerDiffDir || path.Dir(layerDir) != constant.LayerPath {
+		return nil, fmt.Errorf("%s is not a layer dir", dir)
+	}
+	return GetLayer(digestFromHex(path.Base(layerDir)))
+}
+
+// 获取镜像层的 blob 描述符以及对应的 diffID，供 save 和 push 使用
+// 若内容存储中没有镜像层的 blob，则从解压目录重新打包并写入内容存储，同时将 overlay 格式的 whiteout 转换回 OCI 格式
+// 重新打包的结果不压缩，其摘要即为 diffID，但由于文件的时间戳等信息可能发生了变化，它不一定与镜像层原来的 diffID 相同
+func LayerBlob(chainID string) (Descriptor, string, error) {
+	layer, err := GetLayer(chainID)
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	if layer.Blob != nil && HasBlob(layer.Blob.Digest) {
+		return *layer.Blob, layer.DiffID, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.Tar(LayerDir(chainID), pw))
+	}()
+	digest, size, err := WriteBlob(pr, "")
+	pr.Close()
+	if err != nil {
+		return Descriptor{}, "", fmt.Errorf("failed to pack layer %s: %v", chainID, err)
+	}
+	desc := Descriptor{
+		MediaType: MediaTypeOCILayer,
+		Digest:    digest,
+		Size:      size,
+	}
+
+	// 只有内容与原来一致时才记录到镜像层的元数据中
+	if digest == layer.DiffID {
+		layer.Blob = &desc
+		meta, err := json.Marshal(layer)
+		if err != nil {
+			return Descriptor{}, "", err
+		}
+		if err := atomicWriteFile(path.Join(layerPath(chainID), layerMetaFile), meta, 0644); err != nil {
+			return Descriptor{}, "", fmt.Errorf("failed to write layer metadata %s: %v", chainID, err)
+		}
+	}
+	return desc, digest, nil
+}
+
+// 判断数据是否以 gzip 的魔数开头
+func isGzip(br *bufio.Reader) bool {
+	magic, err := br.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// 判断内容存储中的 blob 是否经过 gzip 压缩
+func isGzipBlob(digest string) bool {
+	blob, err := OpenBlob(digest)
+	if err != nil {
+		return false
+	}
+	defer blob.Close()
+	return isGzip(bufio.NewReader(blob))
+}
+
+// 统计写入字节数的 io.Writer
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// 清理不在 keep 中的镜像层，以及解压中断后残留的临时目录，返回被删除的镜像层数量
+// keep 中需要包含所有仍在使用的镜像层及其下层的 chainID
+// 调用者需要在确定 keep 之前持有镜像存储的排他锁，此时残留的临时目录都属于已经退出的进程
+func PruneLayers(keep map[string]bool) (int, error) {
+	entries, err := os.ReadDir(constant.LayerPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read dir %s: %v", constant.LayerPath, err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, layerTmpPrefix) && keep[digestFromHex(name)] {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(constant.LayerPath, name)); err != nil {
+			return removed, fmt.Errorf("failed to remove layer %s: %v", name, err)
+		}
+		log.Debugf("removed layer %s", name)
+		if !strings.HasPrefix(name, layerTmpPrefix) {
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,159 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// 镜像层直接写入 LayerPath，需要 root 权限
+func requireRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to write the layer store")
+	}
+}
+
+// 生成只包含一个随机内容文件的镜像层 tar 包，保证每个测试的 diffID 都不同
+func randomLayer(t *testing.T, name string) ([]byte, string) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	content := hex.EncodeToString(data)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), content
+}
+
+// 测试结束后删除镜像层目录
+func cleanupLayer(t *testing.T, chainID string) {
+	t.Cleanup(func() {
+		os.RemoveAll(layerPath(chainID))
+	})
+}
+
+func TestChainID(t *testing.T) {
+	a := DigestBytes([]byte("a"))
+	b := DigestBytes([]byte("b"))
+	if ChainID("", a) != a {
+		t.Error("chainID of the bottom layer is not its diffID")
+	}
+	if want := DigestBytes([]byte(a + " " + b)); ChainID(a, b) != want {
+		t.Errorf("ChainID(a, b) = %s, want %s", ChainID(a, b), want)
+	}
+	if ChainID(a, b) == ChainID(b, a) {
+		t.Error("chainID does not depend on the order of layers")
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	valid := DigestBytes([]byte("x"))
+	if hexStr, err := ParseDigest(valid); err != nil || digestFromHex(hexStr) != valid {
+		t.Errorf("ParseDigest(%s) = %s, %v", valid, hexStr, err)
+	}
+	hexStr := strings.TrimPrefix(valid, "sha256:")
+	for _, digest := range []string{
+		"",
+		hexStr,
+		"sha512:" + hexStr,
+		"sha256:" + hexStr[:63],
+		"sha256:" + strings.ToUpper(hexStr),
+		"sha256:" + hexStr[:62] + "zz",
+		// 摘要被用作目录名称，不能包含路径分隔符
+		"sha256:../../../../../../../../../../../../../../../../../../../../etc",
+	} {
+		if _, err := ParseDigest(digest); err == nil {
+			t.Errorf("ParseDigest(%q) succeeded", digest)
+		}
+	}
+}
+
+func TestCreateLayer(t *testing.T) {
+	requireRoot(t)
+	data, content := randomLayer(t, "file")
+	diffID := DigestBytes(data)
+	cleanupLayer(t, diffID)
+
+	layer, err := CreateLayer("", bytes.NewReader(data), "", nil)
+	if err != nil {
+		t.Fatalf("CreateLayer: %v", err)
+	}
+	if layer.DiffID != diffID || layer.ChainID != diffID || layer.Parent != "" || layer.Size != int64(len(data)) {
+		t.Errorf("layer = %+v", layer)
+	}
+	if got, err := os.ReadFile(path.Join(LayerDir(layer.ChainID), "file")); err != nil || string(got) != content {
+		t.Errorf("layer content = %q, %v", got, err)
+	}
+	if stored, err := GetLayer(layer.ChainID); err != nil || *stored != *layer {
+		t.Errorf("GetLayer = %+v, %v", stored, err)
+	}
+	if found, err := LayerFromDir(LayerDir(layer.ChainID)); err != nil || found.ChainID != layer.ChainID {
+		t.Errorf("LayerFromDir = %+v, %v", found, err)
+	}
+
+	// diffID 已知且镜像层已经存在时直接复用，不会读取 tar 包
+	again, err := CreateLayer("", strings.NewReader("not a tar"), diffID, nil)
+	if err != nil || again.ChainID != layer.ChainID {
+		t.Errorf("CreateLayer of an existing layer = %+v, %v", again, err)
+	}
+
+	// 经过 gzip 压缩的镜像层，diffID 为未压缩内容的摘要
+	childData, _ := randomLayer(t, "child")
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(childData)
+	zw.Close()
+	childDiffID := DigestBytes(childData)
+	cleanupLayer(t, ChainID(diffID, childDiffID))
+	child, err := CreateLayer(layer.ChainID, &gz, childDiffID, nil)
+	if err != nil {
+		t.Fatalf("CreateLayer of a gzip layer: %v", err)
+	}
+	if child.DiffID != childDiffID || child.Parent != layer.ChainID || child.ChainID != ChainID(diffID, childDiffID) {
+		t.Errorf("child layer = %+v", child)
+	}
+}
+
+func TestCreateLayerErrors(t *testing.T) {
+	requireRoot(t)
+	data, _ := randomLayer(t, "file")
+	diffID := DigestBytes(data)
+	cleanupLayer(t, diffID)
+
+	wrong := DigestBytes([]byte("something else"))
+	cleanupLayer(t, wrong)
+	if _, err := CreateLayer("", bytes.NewReader(data), wrong, nil); err == nil || !strings.Contains(err.Error(), "diff_id mismatch") {
+		t.Errorf("CreateLayer with a wrong diffID error = %v", err)
+	}
+	if _, err := GetLayer(wrong); err == nil {
+		t.Error("layer with a mismatched diffID is stored")
+	}
+
+	missing := DigestBytes([]byte("missing parent"))
+	if _, err := CreateLayer(missing, bytes.NewReader(data), "", nil); err == nil || !strings.Contains(err.Error(), "parent layer") {
+		t.Errorf("CreateLayer on a missing parent error = %v", err)
+	}
+
+	// 解压失败时不留下临时目录
+	entries, _ := os.ReadDir(path.Dir(layerPath(diffID)))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), layerTmpPrefix) {
+			t.Errorf("temp dir %s is left behind", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package image
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/constant"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 加载镜像包，返回加载的所有镜像名称
+// 支持 OCI image layout 格式以及 docker save 所生成的格式
+func Load(r io.Reader) ([]string, error) {
+	unlock, err := LockStore()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// blobs/sha256 下的文件直接写入内容存储，其余文件先解压到临时目录，因为 tar 包中各文件的顺序是不确定的
+	if err := os.MkdirAll(constant.RootPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dir %s: %v", constant.RootPath, err)
+	}
+	tmpDir, err := os.MkdirTemp(constant.RootPath, ".load-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := unpackArchive(r, tmpDir); err != nil {
+		return nil, fmt.Errorf("failed to unpack archive: %v", err)
+	}
+
+	// docker save 所生成的镜像包中含有 manifest.json
+	if _, err := os.Stat(path.Join(tmpDir, dockerManifestFile)); err == nil {
+		return loadDockerArchive(tmpDir)
+	}
+	return loadOCILayout(tmpDir)
+}
+
+// 解压镜像包，blob 写入内容存储并校验摘要，其余普通文件写入 dir
+func unpackArchive(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if hexStr, ok := strings.CutPrefix(name, "blobs/"+digestAlgorithm+"/"); ok {
+			if _, _, err := WriteBlob(tr, digestFromHex(hexStr)); err != nil {
+				return fmt.Errorf("failed to write blob %s: %v", name, err)
+			}
+			continue
+		}
+
+		target := archivePath(dir, name)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+		file, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %v", name, err)
+		}
+	}
+}
+
+// 从解压后的 OCI image layout 目录中加载镜像
+func loadOCILayout(dir string) ([]string, error) {
+	layout := new(OCILayout)
+	if err := readJSONFile(path.Join(dir, "oci-layout"), layout); err != nil {
+		return nil, fmt.Errorf("invalid oci image layout: %v", err)
+	}
+	if layout.Version != OCILayoutVersion {
+		return nil, fmt.Errorf("unsupported oci image layout version: %s", layout.Version)
+	}
+
+	index := new(Index)
+	if err := readJSONFile(path.Join(dir, "index.json"), index); err != nil {
+		return nil, fmt.Errorf("invalid oci image layout: %v", err)
+	}
+
+	var names []string
+	for _, desc := range index.Manifests {
+		manifestDesc, err := resolveManifest(desc)
+		if err != nil {
+			return nil, err
+		}
+
+		// 没有记录镜像名称，则使用 manifest 摘要的前 12 位作为名称
+		name := imageNameFromAnnotations(desc.Annotations)
+		untagged := name == ""
+		if untagged {
+			name = DefaultName(manifestDesc.Digest)
+		}
+
+		if err := loadManifest(manifestDesc, name, untagged); err != nil {
+			return nil, fmt.Errorf("failed to load image %s: %v", name, err)
+		}
+		log.Debugf("loaded image %s", name)
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// 若描述符指向的是 manifest list，则选出与当前平台匹配的 manifest
+func resolveManifest(desc Descriptor) (Descriptor, error) {
+	switch desc.MediaType {
+	case MediaTypeOCIManifest, MediaTypeDockerManifest:
+		return desc, nil
+	case MediaTypeOCIIndex, MediaTypeDockerManifestList:
+		index := new(Index)
+		if err := ReadJSONBlob(desc, index); err != nil {
+			return Descriptor{}, err
+		}
+		for _, m := range index.Manifests {
+			if m.Platform != nil && m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH {
+				return resolveManifest(m)
+			}
+		}
+		return Descriptor{}, fmt.Errorf("no manifest for platform %s/%s in %s", runtime.GOOS, runtime.GOARCH, desc.Digest)
+	default:
+		return Descriptor{}, fmt.Errorf("unsupported manifest media type: %s", desc.MediaType)
+	}
+}
+
+// 从注解中获取镜像名称
+func imageNameFromAnnotations(annotations map[string]string) string {
+	if name := annotations[AnnotationContainerdRef]; name != "" {
+		return name
+	}
+	return annotations[AnnotationRefName]
+}
+
+// 加载 manifest 所描述的镜像，并以 name 为名称保存镜像的元数据，untagged 表示 name 为默认名称
+// manifest 所引用的 blob 需要已经存在于内容存储中
+func loadManifest(desc Descriptor, name string, untagged bool) error {
+	manifest := new(Manifest)
+	if err := ReadJSONBlob(desc, manifest); err != nil {
+		return err
+	}
+	config := new(OCIConfig)
+	if err := ReadJSONBlob(manifest.Config, config); err != nil {
+		return err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("config has %d diff_ids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	img := &Image{
+		Name:     name,
+		Config:   config.Config,
+		Created:  config.Created,
+		History:  config.History,
+		Untagged: untagged,
+	}
+	parent := ""
+	for i, layerDesc := range manifest.Layers {
+		layer, err := CreateLayerFromBlob(parent, layerDesc, config.RootFS.DiffIDs[i])
+		if err != nil {
+			return fmt.Errorf("failed to load layer %s: %v", layerDesc.Digest, err)
+		}
+		img.Layers = append(img.Layers, layer.DiffID)
+		parent = layer.ChainID
+	}
+
+	return SaveImage(img)
+}
+
+// 读取 json 文件并反序列化到 v 中
+func readJSONFile(filePath string, v interface{}) error {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path.Base(filePath), err)
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %v", path.Base(filePath), err)
+	}
+	return nil
+}
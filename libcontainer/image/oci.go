@@ -0,0 +1,118 @@
+package image
+
+import "time"
+
+// 这里只定义了 m-docker 用到的 OCI 镜像规范中的字段
+// 完整的规范见 https://github.com/opencontainers/image-spec
+
+const (
+	// oci-layout 文件中的版本号
+	OCILayoutVersion = "1.0.0"
+
+	MediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// docker 使用的 manifest 格式，与 OCI 格式的字段相同
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// 镜像引用名称的注解，OCI 规范中一般只记录 tag，containerd 等工具则记录完整的镜像名称
+	AnnotationRefName       = "org.opencontainers.image.ref.name"
+	AnnotationContainerdRef = "io.containerd.image.name"
+)
+
+// oci-layout 文件
+type OCILayout struct {
+	Version string `json:"imageLayoutVersion"`
+}
+
+// 内容描述符，通过摘要引用 blobs 目录下的内容
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// 镜像所适用的平台
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// index.json 以及 manifest list
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// 镜像的 manifest，引用镜像的 config 和各个镜像层
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// 镜像的 config
+type OCIConfig struct {
+	Created      *time.Time   `json:"created,omitempty"`
+	Architecture string       `json:"architecture"`
+	OS           string       `json:"os"`
+	Config       *ImageConfig `json:"config,omitempty"`
+	RootFS       RootFS       `json:"rootfs"`
+	History      []History    `json:"history,omitempty"`
+}
+
+// 镜像中记录的容器默认运行配置
+type ImageConfig struct {
+	// 运行容器进程的用户
+	User string `json:"User,omitempty"`
+
+	// 默认的环境变量
+	Env []string `json:"Env,omitempty"`
+
+	// 默认的入口点
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+
+	// 默认的运行命令，若设置了 Entrypoint，则作为它的参数
+	Cmd []string `json:"Cmd,omitempty"`
+
+	// 容器进程的工作目录
+	WorkingDir string `json:"WorkingDir,omitempty"`
+
+	// 镜像的标签
+	Labels map[string]string `json:"Labels,omitempty"`
+
+	// 容器监听的端口，格式为 [port]/[protocol]，run -P 时会发布这些端口
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+}
+
+// 镜像的 rootfs，diff_ids 为各镜像层未压缩时的摘要，按照自底向上的顺序排列
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// 镜像的构建历史中的一条记录，对应构建镜像时的一个步骤
+type History struct {
+	// 步骤的执行时间
+	Created *time.Time `json:"created,omitempty"`
+
+	// 步骤所执行的命令，如 Dockerfile 中的指令
+	CreatedBy string `json:"created_by,omitempty"`
+
+	// 步骤的注释，如 commit -m 指定的信息
+	Comment string `json:"comment,omitempty"`
+
+	// 步骤没有生成镜像层，如 ENV、CMD 等只修改配置的指令
+	EmptyLayer bool `json:"empty_layer,omitempty"`
+}
@@ -0,0 +1,111 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// 将镜像以 OCI image layout 格式打包，写入 w 中
+// 打包结果包括 oci-layout、index.json 以及 blobs/sha256 下的 manifest、config 和各个镜像层
+func Save(name string, w io.Writer) error {
+	// 镜像的 config 和 manifest 是临时生成的，打包完成之前不能被清理
+	unlock, err := LockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	img, err := GetImage(name)
+	if err != nil {
+		return err
+	}
+	manifestDesc, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	manifest := new(Manifest)
+	if err := ReadJSONBlob(manifestDesc, manifest); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: time.Now()}); err != nil {
+			return fmt.Errorf("failed to write %s: %v", dir, err)
+		}
+	}
+
+	// 从内容存储中复制各个镜像层、config 以及 manifest
+	blobs := append([]Descriptor{}, manifest.Layers...)
+	blobs = append(blobs, manifest.Config, manifestDesc)
+	for _, desc := range blobs {
+		if err := saveBlob(tw, desc); err != nil {
+			return fmt.Errorf("failed to save blob %s: %v", desc.Digest, err)
+		}
+	}
+
+	manifestDesc.Annotations = map[string]string{
+		AnnotationContainerdRef: img.Name,
+		AnnotationRefName:       img.Name,
+	}
+
+	// 写入 index.json 和 oci-layout
+	if err := writeJSONFile(tw, "index.json", &Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests:     []Descriptor{manifestDesc},
+	}); err != nil {
+		return err
+	}
+	if err := writeJSONFile(tw, "oci-layout", &OCILayout{Version: OCILayoutVersion}); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// 将内容存储中的 blob 写入 tw 中
+func saveBlob(tw *tar.Writer, desc Descriptor) error {
+	blob, err := OpenBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	return writeFile(tw, blobPath(desc.Digest), blob, desc.Size)
+}
+
+// 将对象序列化为 json 后写入 tw 中的 name 文件
+func writeJSONFile(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", name, err)
+	}
+	return writeFile(tw, name, bytes.NewReader(data), int64(len(data)))
+}
+
+// 向 tw 中写入一个普通文件
+func writeFile(tw *tar.Writer, name string, r io.Reader, size int64) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+	}); err != nil {
+		return fmt.Errorf("failed to write header of %s: %v", name, err)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// 获取 blob 在 OCI image layout 中的相对路径
+func blobPath(digest string) string {
+	hexStr, _ := ParseDigest(digest)
+	return path.Join("blobs", digestAlgorithm, hexStr)
+}
@@ -0,0 +1,291 @@
+package libcontainer
+
+import (
+	"fmt"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/constant"
+	"m-docker/libcontainer/network"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 为容器的所有网络端点分配 IP 地址并创建 veth 设备
+func SetupEndpoints(conf *config.Config) error {
+	for _, ep := range conf.Endpoints {
+		if err := network.Connect(ep, conf.ID); err != nil {
+			return fmt.Errorf("failed to connect to network %s: %v", ep.Network, err)
+		}
+		log.Debugf("connect to network %s success, ip: %s", ep.Network, ep.IPAddress)
+	}
+	return nil
+}
+
+// 容器进程创建之后，将网络端点移动到容器的 network namespace 中并完成配置
+// 新建的 network namespace 中 lo 默认是关闭的，需要将其启用
+// 出站流量策略也在此时安装，容器进程还没有运行用户的命令，不会有流量绕过策略
+// 只在容器第一次启动时调用，exec 复用容器的网络，不能再次调用
+func AttachEndpoints(conf *config.Config) error {
+	if newNetns(conf) {
+		if err := network.SetupLoopback(conf.Pid); err != nil {
+			return err
+		}
+	}
+	// 连接了多个网络时，只有第一个网络的网关作为默认路由
+	for i, ep := range conf.Endpoints {
+		if err := network.Attach(ep, conf.ID, conf.Pid, i == 0); err != nil {
+			return fmt.Errorf("failed to attach to network %s: %v", ep.Network, err)
+		}
+	}
+	// 带宽限制只在此时设置一次，之后通过 update 修改
+	if err := SetBandwidth(conf); err != nil {
+		return err
+	}
+	if conf.Egress != nil && newNetns(conf) {
+		if err := network.ApplyEgressPolicy(conf.Pid, conf.Egress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将容器的端口发布到宿主机上
+// 每次创建容器时都会先清理已经退出的容器残留的规则，即使该容器没有发布端口
+func PublishPorts(conf *config.Config) error {
+	CleanupStalePorts()
+	if len(conf.Ports) == 0 {
+		return nil
+	}
+	if len(conf.Endpoints) == 0 {
+		return fmt.Errorf("port publishing requires a network endpoint")
+	}
+	return network.PublishPorts(conf.ID, conf.Endpoints[0], conf.Ports)
+}
+
+// 撤销容器发布的端口，可以重复调用
+func UnpublishPorts(conf *config.Config) {
+	if len(conf.Ports) == 0 {
+		return
+	}
+	network.UnpublishPorts(conf.ID)
+}
+
+// 清理管理容器的 m-docker 进程异常退出后残留的端口映射规则
+// 容器已经停止，或者记录为运行中但进程已经不存在时，其规则都是残留的
+// 没有配置文件的容器可能正在创建中，不做处理；已经删除的容器在 Remove 时已经清理过规则
+// 在 run、rm 和 system prune 时调用
+func CleanupStalePorts() {
+	ids, err := network.PublishedContainers()
+	if err != nil {
+		log.Warnf("failed to list published ports: %v", err)
+		return
+	}
+	for _, id := range ids {
+		conf, err := config.GetConfigFromID(id)
+		if err != nil {
+			continue
+		}
+		if conf.Status == constant.ContainerRunning && syscall.Kill(conf.Pid, 0) != syscall.ESRCH {
+			continue
+		}
+		log.Warnf("cleaning up stale published ports of container %s", id)
+		network.UnpublishPorts(id)
+	}
+}
+
+// 删除容器的 veth 设备并释放 IP 地址，可以重复调用
+func ReleaseEndpoints(conf *config.Config) {
+	for _, ep := range conf.Endpoints {
+		if err := network.Disconnect(ep, conf.ID); err != nil {
+			log.Errorf("failed to disconnect from network %s: %v", ep.Network, err)
+			continue
+		}
+		*ep = config.Endpoint{Network: ep.Network, IfName: ep.IfName}
+	}
+}
+
+// 容器是否需要创建新的 network namespace，host 和 container:[id] 模式使用已经存在的 network namespace
+func newNetns(conf *config.Config) bool {
+	return conf.NetworkMode != constant.NetworkModeHost &&
+		!strings.HasPrefix(conf.NetworkMode, constant.NetworkModeContainerPrefix)
+}
+
+// 获取 container:[id] 模式下所加入的容器进程的 PID，其它模式返回 0
+func netnsTargetPid(conf *config.Config) (int, error) {
+	if !strings.HasPrefix(conf.NetworkMode, constant.NetworkModeContainerPrefix) {
+		return 0, nil
+	}
+	id := strings.TrimPrefix(conf.NetworkMode, constant.NetworkModeContainerPrefix)
+	target, err := config.GetConfigFromID(id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get container %s: %v", id, err)
+	}
+	if target.Status != constant.ContainerRunning {
+		return 0, fmt.Errorf("container %s is not running", id)
+	}
+	return target.Pid, nil
+}
+
+// 将运行中的容器连接到网络，新的网卡依次命名为 eth1、eth2 等
+func ConnectNetwork(conf *config.Config, name string) (err error) {
+	if err := checkNetworkChange(conf); err != nil {
+		return err
+	}
+	if hasEndpoint(conf, name) {
+		return fmt.Errorf("container %s is already connected to network %s", conf.Name, name)
+	}
+
+	ep := &config.Endpoint{Network: name, IfName: nextIfName(conf)}
+	if err := network.Connect(ep, conf.ID); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := network.Disconnect(ep, conf.ID); err != nil {
+				log.Warnf("failed to disconnect from network %s: %v", name, err)
+			}
+		}
+	}()
+	// 容器没有连接其他网络时，新的网络提供默认路由
+	if err := network.Attach(ep, conf.ID, conf.Pid, len(conf.Endpoints) == 0); err != nil {
+		return err
+	}
+	ingressRate, egressRate := bandwidthLimits(conf)
+	if err := network.SetBandwidth(ep, ingressRate, egressRate); err != nil {
+		return err
+	}
+
+	conf.Endpoints = append(conf.Endpoints, ep)
+	if err := config.RecordContainerConfig(conf); err != nil {
+		return fmt.Errorf("failed to record container config: %v", err)
+	}
+	RefreshHosts(conf)
+	return nil
+}
+
+// 将运行中的容器从网络断开，删除对应的网卡并释放 IP 地址
+func DisconnectNetwork(conf *config.Config, name string) error {
+	if err := checkNetworkChange(conf); err != nil {
+		return err
+	}
+	index := -1
+	for i, ep := range conf.Endpoints {
+		if ep.Network == name {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("container %s is not connected to network %s", conf.Name, name)
+	}
+	// 发布的端口转发到第一个网络中的地址
+	if index == 0 && len(conf.Ports) > 0 {
+		return fmt.Errorf("container %s publishes ports on network %s", conf.Name, name)
+	}
+
+	// 删除宿主机一端的 veth 设备时，容器中的网卡也会随之删除
+	ep := conf.Endpoints[index]
+	if err := network.Disconnect(ep, conf.ID); err != nil {
+		return err
+	}
+	conf.Endpoints = append(conf.Endpoints[:index], conf.Endpoints[index+1:]...)
+	if err := config.RecordContainerConfig(conf); err != nil {
+		return fmt.Errorf("failed to record container config: %v", err)
+	}
+	refreshHosts(conf, append(endpointNetworks(conf), name))
+	return nil
+}
+
+// 只有运行中的、拥有独立 network namespace 并使用网桥网络的容器才能连接或断开网络
+func checkNetworkChange(conf *config.Config) error {
+	if conf.Status != constant.ContainerRunning {
+		return fmt.Errorf("container %s is not running", conf.Name)
+	}
+	if !newNetns(conf) || conf.NetworkMode == constant.NetworkModeNone {
+		return fmt.Errorf("container %s uses network mode %s and cannot be connected to other networks", conf.Name, conf.NetworkMode)
+	}
+	return nil
+}
+
+// 容器中下一个未被使用的网卡名称
+func nextIfName(conf *config.Config) string {
+	used := make(map[string]bool)
+	for _, ep := range conf.Endpoints {
+		used[ep.IfName] = true
+	}
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("eth%d", i)
+		if !used[name] {
+			return name
+		}
+	}
+}
+
+// 从磁盘上重新读取容器的网络端点和资源限制
+// 容器运行期间可能通过 network connect/disconnect 修改了网络，通过 update 修改了资源限制，管理容器的进程中保存的配置已经过期
+func syncEndpoints(conf *config.Config) {
+	saved, err := config.GetConfigFromID(conf.ID)
+	if err != nil {
+		return
+	}
+	conf.Endpoints = saved.Endpoints
+	if saved.Cgroup != nil {
+		conf.Cgroup = saved.Cgroup
+	}
+}
+
+// 按照容器的资源限制设置所有网络端点的带宽，容器运行期间通过 update 修改限制时也会调用
+func SetBandwidth(conf *config.Config) error {
+	ingressRate, egressRate := bandwidthLimits(conf)
+	for _, ep := range conf.Endpoints {
+		if err := network.SetBandwidth(ep, ingressRate, egressRate); err != nil {
+			return fmt.Errorf("failed to set bandwidth of network %s: %v", ep.Network, err)
+		}
+	}
+	return nil
+}
+
+// 容器的入站和出站带宽限制
+func bandwidthLimits(conf *config.Config) (uint64, uint64) {
+	if conf.Cgroup == nil || conf.Cgroup.Resources == nil {
+		return 0, 0
+	}
+	return conf.Cgroup.NetIngressRate, conf.Cgroup.NetEgressRate
+}
+
+// 删除网络，仍有运行中的容器连接到该网络时拒绝删除
+func RemoveNetwork(name string) error {
+	confs, err := NetworkContainers(name)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, conf := range confs {
+		if conf.Status == constant.ContainerRunning {
+			names = append(names, conf.Name)
+		}
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("network %s has active endpoints: %s", name, strings.Join(names, ", "))
+	}
+	return network.DeleteNetwork(name)
+}
+
+// 获取连接到网络的所有容器
+func NetworkContainers(name string) ([]*config.Config, error) {
+	confs, err := config.ListConfigs()
+	if err != nil {
+		return nil, err
+	}
+	var result []*config.Config
+	for _, conf := range confs {
+		for _, ep := range conf.Endpoints {
+			if ep.Network == name {
+				result = append(result, conf)
+				break
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,144 @@
+package network
+
+import (
+	"fmt"
+	"m-docker/libcontainer/config"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// 数据包在 tbf 队列中最多等待的时间，超过后丢弃，与 CNI 的 bandwidth 插件一致
+const tbfLatencyUsec = 25 * 1000
+
+// tbf 的最小突发量，突发量小于 MTU 时数据包无法发出
+const tbfMinBurst = 32 * 1024
+
+// 限制端点的网络带宽，单位为 bit/s，为 0 时取消限制，可以在容器运行期间重复调用以修改限制
+// 限制设置在宿主机一端的 veth 设备上：
+// 1. 容器的入站流量是 veth 设备的出站流量，直接使用 tbf 限速
+// 2. 容器的出站流量是 veth 设备的入站流量，通过 ingress qdisc 重定向到 ifb 设备，再在 ifb 设备上使用 tbf 限速
+func SetBandwidth(ep *config.Endpoint, ingressRate uint64, egressRate uint64) error {
+	if ep.HostVeth == "" {
+		if ingressRate > 0 || egressRate > 0 {
+			log.Warnf("bandwidth limits are not supported for network %s, use the cni bandwidth plugin instead", ep.Network)
+		}
+		return nil
+	}
+	link, err := netlink.LinkByName(ep.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to get veth %s: %v", ep.HostVeth, err)
+	}
+	if err := setRootTbf(link, ingressRate); err != nil {
+		return fmt.Errorf("failed to limit ingress rate of %s: %v", ep.IfName, err)
+	}
+	if err := setIngressRedirect(link, ifbName(ep.HostVeth), egressRate); err != nil {
+		return fmt.Errorf("failed to limit egress rate of %s: %v", ep.IfName, err)
+	}
+	return nil
+}
+
+// 删除端点的 ifb 设备，veth 设备删除时其上的 qdisc 会随之删除，但 ifb 设备不会
+func removeBandwidth(ep *config.Endpoint) {
+	if ep.HostVeth == "" {
+		return
+	}
+	if ifb, err := netlink.LinkByName(ifbName(ep.HostVeth)); err == nil {
+		if err := netlink.LinkDel(ifb); err != nil {
+			log.Warnf("failed to delete ifb %s: %v", ifb.Attrs().Name, err)
+		}
+	}
+}
+
+// 在设备的出口上设置 tbf，rate 为 0 时删除
+func setRootTbf(link netlink.Link, rate uint64) error {
+	if rate == 0 {
+		tbf := &netlink.Tbf{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Handle: netlink.MakeHandle(1, 0), Parent: netlink.HANDLE_ROOT}}
+		if err := netlink.QdiscDel(tbf); err != nil && err != unix.ENOENT && err != unix.EINVAL {
+			return err
+		}
+		return nil
+	}
+	return netlink.QdiscReplace(newTbf(link.Attrs().Index, rate))
+}
+
+// 将设备入口的流量重定向到 ifb 设备并在 ifb 设备上限速，rate 为 0 时删除 ingress qdisc 和 ifb 设备
+func setIngressRedirect(link netlink.Link, name string, rate uint64) error {
+	ingress := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Handle: netlink.MakeHandle(0xffff, 0), Parent: netlink.HANDLE_INGRESS}}
+	if rate == 0 {
+		if err := netlink.QdiscDel(ingress); err != nil && err != unix.ENOENT && err != unix.EINVAL {
+			return err
+		}
+		if ifb, err := netlink.LinkByName(name); err == nil {
+			return netlink.LinkDel(ifb)
+		}
+		return nil
+	}
+
+	ifb, err := netlink.LinkByName(name)
+	if err != nil {
+		la := netlink.NewLinkAttrs()
+		la.Name = name
+		la.TxQLen = 1000
+		la.MTU = link.Attrs().MTU
+		if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: la}); err != nil {
+			return fmt.Errorf("failed to create ifb %s: %v", name, err)
+		}
+		if ifb, err = netlink.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to get ifb %s: %v", name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(ifb); err != nil {
+		return fmt.Errorf("failed to set up ifb %s: %v", name, err)
+	}
+	if err := netlink.QdiscReplace(newTbf(ifb.Attrs().Index, rate)); err != nil {
+		return err
+	}
+
+	// 修改限制时 ingress qdisc 和重定向规则已经存在，只需要修改 ifb 上的 tbf
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == "ingress" {
+			return nil
+		}
+	}
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return err
+	}
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifb.Attrs().Index,
+		Actions:    []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+	}
+	return netlink.FilterAdd(filter)
+}
+
+// 生成限速为 rate bit/s 的 tbf，突发量为 10ms 的流量
+func newTbf(linkIndex int, rate uint64) *netlink.Tbf {
+	bytesPerSec := rate / 8
+	burst := uint32(bytesPerSec / 100)
+	if burst < tbfMinBurst {
+		burst = tbfMinBurst
+	}
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{LinkIndex: linkIndex, Handle: netlink.MakeHandle(1, 0), Parent: netlink.HANDLE_ROOT},
+		Rate:       bytesPerSec,
+		Limit:      uint32(bytesPerSec*tbfLatencyUsec/netlink.TIME_UNITS_PER_SEC) + burst,
+		Buffer:     uint32(netlink.Xmittime(bytesPerSec, burst)),
+	}
+}
+
+// 宿主机一端的 veth 设备所对应的 ifb 设备名称
+func ifbName(hostVeth string) string {
+	return "ifb" + hostVeth[len("veth"):]
+}
@@ -0,0 +1,197 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// iptables 和 ip6tables 的命令名称，规则相关的函数通过该参数区分 IPv4 和 IPv6
+const (
+	iptables  = "iptables"
+	ip6tables = "ip6tables"
+)
+
+// 创建网络的网桥并配置网关地址，网桥已经存在时只补全缺少的配置
+// 同时开启 IP 转发，并通过 iptables 对从网络中发出的流量做 SNAT，使容器能够访问外部网络
+// 网络启用了 IPv6 时同样配置 IPv6 网关地址和转发，routed 模式下不做 NAT66
+// 调用者需要持有网络的锁
+func ensureBridge(nw *Network) (netlink.Link, error) {
+	gateway, err := nw.gatewayNet()
+	if err != nil {
+		return nil, err
+	}
+	gateway6, err := nw.gatewayNet6()
+	if err != nil {
+		return nil, err
+	}
+
+	bridge, err := netlink.LinkByName(nw.Bridge)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, fmt.Errorf("failed to get bridge %s: %v", nw.Bridge, err)
+		}
+		la := netlink.NewLinkAttrs()
+		la.Name = nw.Bridge
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: la}); err != nil && err != unix.EEXIST {
+			return nil, fmt.Errorf("failed to create bridge %s: %v", nw.Bridge, err)
+		}
+		if bridge, err = netlink.LinkByName(nw.Bridge); err != nil {
+			return nil, fmt.Errorf("failed to get bridge %s: %v", nw.Bridge, err)
+		}
+		log.Infof("Created bridge %s for network %s", nw.Bridge, nw.Name)
+	}
+
+	// 网桥的地址在宿主机重启后会丢失，每次都检查一遍
+	if err := netlink.AddrAdd(bridge, &netlink.Addr{IPNet: gateway}); err != nil && err != unix.EEXIST {
+		return nil, fmt.Errorf("failed to add address %s to bridge %s: %v", gateway, nw.Bridge, err)
+	}
+	if gateway6 != nil {
+		addr6 := &netlink.Addr{IPNet: gateway6, Flags: unix.IFA_F_NODAD}
+		if err := netlink.AddrAdd(bridge, addr6); err != nil && err != unix.EEXIST {
+			return nil, fmt.Errorf("failed to add address %s to bridge %s: %v", gateway6, nw.Bridge, err)
+		}
+	}
+	if err := netlink.LinkSetUp(bridge); err != nil {
+		return nil, fmt.Errorf("failed to set up bridge %s: %v", nw.Bridge, err)
+	}
+
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return nil, fmt.Errorf("failed to enable ip forwarding: %v", err)
+	}
+	setupMasquerade(nw, iptables)
+	if gateway6 != nil {
+		if err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644); err != nil {
+			return nil, fmt.Errorf("failed to enable ipv6 forwarding: %v", err)
+		}
+		setupMasquerade(nw, ip6tables)
+	}
+
+	return bridge, nil
+}
+
+// 删除网络的网桥以及网络所使用的 iptables 和 ip6tables 规则
+func removeBridge(nw *Network) error {
+	for _, ipt := range []string{iptables, ip6tables} {
+		if !iptablesAvailable(ipt) {
+			continue
+		}
+		for _, rule := range networkRules(nw, ipt) {
+			deleteRule(ipt, rule)
+		}
+	}
+
+	bridge, err := netlink.LinkByName(nw.Bridge)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to get bridge %s: %v", nw.Bridge, err)
+	}
+	if err := netlink.LinkDel(bridge); err != nil {
+		return fmt.Errorf("failed to delete bridge %s: %v", nw.Bridge, err)
+	}
+	return nil
+}
+
+// 添加网络所需的 iptables 或 ip6tables 规则，已经存在的规则不会重复添加
+// 宿主机没有 iptables 时容器之间仍然可以通信，只是不能访问外部网络，不同网络之间也无法隔离，因此只打印警告
+func setupMasquerade(nw *Network, ipt string) {
+	if !iptablesAvailable(ipt) {
+		log.Warnf("%s not found, containers in network %s can not access external network and are not isolated from other networks", ipt, nw.Name)
+		return
+	}
+	if err := ensureIsolationChains(ipt); err != nil {
+		log.Warnf("failed to setup network isolation: %v", err)
+	}
+	for _, rule := range networkRules(nw, ipt) {
+		if err := ensureRule(ipt, rule); err != nil {
+			log.Warnf("failed to add %s rule for network %s: %v", ipt, nw.Name, err)
+		}
+	}
+}
+
+// 网络所使用的 iptables 或 ip6tables 规则：
+// 1. 对从网络中发往外部的流量做 SNAT，IPv6 的 routed 模式下不做
+// 2. 允许网桥上的流量转发
+// 3. 从网桥转发到其它网络的网桥上的流量会被丢弃，实现网络之间的隔离
+func networkRules(nw *Network, ipt string) [][]string {
+	subnet := nw.Subnet
+	if ipt == ip6tables {
+		subnet = nw.Subnet6
+	}
+	var rules [][]string
+	if ipt == iptables || nw.IPv6Mode != IPv6ModeRouted {
+		rules = append(rules, []string{"-t", "nat", "POSTROUTING", "-s", subnet, "!", "-o", nw.Bridge, "-j", "MASQUERADE"})
+	}
+	return append(rules,
+		[]string{"-t", "filter", "FORWARD", "-i", nw.Bridge, "-j", "ACCEPT"},
+		[]string{"-t", "filter", "FORWARD", "-o", nw.Bridge, "-j", "ACCEPT"},
+		[]string{"-t", "filter", isolationChain1, "-i", nw.Bridge, "!", "-o", nw.Bridge, "-j", isolationChain2},
+		[]string{"-t", "filter", isolationChain2, "-o", nw.Bridge, "-j", "DROP"},
+	)
+}
+
+// 网络隔离所使用的链
+// 第一级匹配从某个网桥转发出去的流量，第二级匹配发往任意网桥的流量，两级都匹配说明是跨网络的流量
+const (
+	isolationChain1 = "M-DOCKER-ISOLATION-1"
+	isolationChain2 = "M-DOCKER-ISOLATION-2"
+)
+
+// 创建网络隔离所使用的链，并在 FORWARD 的最前面跳转到该链，使其先于允许转发的规则生效
+func ensureIsolationChains(ipt string) error {
+	for _, chain := range []string{isolationChain1, isolationChain2} {
+		if err := ensureChain(ipt, "filter", chain); err != nil {
+			return err
+		}
+	}
+	check := []string{"-t", "filter", "-C", "FORWARD", "-j", isolationChain1}
+	if err := exec.Command(ipt, check...).Run(); err == nil {
+		return nil
+	}
+	insert := []string{"-t", "filter", "-I", "FORWARD", "1", "-j", isolationChain1}
+	if output, err := exec.Command(ipt, insert...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", ipt, strings.Join(insert, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// 创建 iptables 链，已经存在时不做处理
+func ensureChain(ipt string, table string, chain string) error {
+	if err := exec.Command(ipt, "-t", table, "-L", chain, "-n").Run(); err == nil {
+		return nil
+	}
+	if output, err := exec.Command(ipt, "-t", table, "-N", chain).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create chain %s: %v: %s", chain, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// rule 的格式为 -t [table] [chain] [args...]，先通过 -C 检查规则是否存在，不存在时再通过 -A 添加
+func ensureRule(ipt string, rule []string) error {
+	table, chain, args := rule[:2], rule[2], rule[3:]
+	check := append(append(append([]string{}, table...), "-C", chain), args...)
+	if err := exec.Command(ipt, check...).Run(); err == nil {
+		return nil
+	}
+	add := append(append(append([]string{}, table...), "-A", chain), args...)
+	if output, err := exec.Command(ipt, add...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", ipt, strings.Join(add, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// 删除规则，格式与 ensureRule 相同，规则不存在时不做处理
+func deleteRule(ipt string, rule []string) {
+	table, chain, args := rule[:2], rule[2], rule[3:]
+	del := append(append(append([]string{}, table...), "-D", chain), args...)
+	if output, err := exec.Command(ipt, del...).CombinedOutput(); err != nil {
+		log.Debugf("%s %s: %v: %s", ipt, strings.Join(del, " "), err, strings.TrimSpace(string(output)))
+	}
+}
@@ -0,0 +1,438 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/constant"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// CNI 网络配置所在的目录
+	cniConfigDir = constant.DefaultCNIConfigDir
+
+	// CNI 插件所在的目录
+	cniBinDir = constant.DefaultCNIBinDir
+
+	// 容器 network namespace 的绑定挂载点所在的目录
+	cniNetnsDir = constant.NetnsPath
+)
+
+// 设置 CNI 网络配置和插件所在的目录，为空时使用默认目录
+func SetCNIPaths(configDir string, binDir string) {
+	if configDir != "" {
+		cniConfigDir = configDir
+	}
+	if binDir != "" {
+		cniBinDir = binDir
+	}
+}
+
+// CNI 的网络配置列表，插件按顺序调用
+type cniConfigList struct {
+	CNIVersion string            `json:"cniVersion"`
+	Name       string            `json:"name"`
+	Plugins    []json.RawMessage `json:"plugins"`
+}
+
+// CNI 插件返回的结果，只解析需要使用的字段，支持 0.3.0 及以上版本的格式
+type cniResult struct {
+	Interfaces []struct {
+		Name    string `json:"name"`
+		Mac     string `json:"mac"`
+		Sandbox string `json:"sandbox"`
+	} `json:"interfaces"`
+	IPs []struct {
+		Address   string `json:"address"`
+		Gateway   string `json:"gateway"`
+		Interface *int   `json:"interface"`
+	} `json:"ips"`
+}
+
+// CNI 插件失败时输出的错误
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details"`
+}
+
+// 在 CNI 配置目录中查找名称为 name 的网络配置，按文件名排序，使用第一个匹配的配置
+// 单个插件的 .conf 配置会被转换为只有一个插件的配置列表
+func loadCNIConfigList(name string) (*cniConfigList, bool, error) {
+	lists, err := loadCNIConfigLists()
+	if err != nil {
+		return nil, false, err
+	}
+	for _, list := range lists {
+		if list.Name == name {
+			return list, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// 读取 CNI 配置目录中的所有网络配置，同名的网络只保留第一个
+func loadCNIConfigLists() ([]*cniConfigList, error) {
+	entries, err := os.ReadDir(cniConfigDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cni config dir %s: %v", cniConfigDir, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	var lists []*cniConfigList
+	seen := make(map[string]bool)
+	for _, name := range names {
+		file := path.Join(cniConfigDir, name)
+		var list *cniConfigList
+		switch filepath.Ext(name) {
+		case ".conflist":
+			list, err = parseCNIConfigList(file)
+		case ".conf", ".json":
+			list, err = parseCNIConfig(file)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Warnf("ignoring invalid cni config %s: %v", file, err)
+			continue
+		}
+		if seen[list.Name] {
+			continue
+		}
+		seen[list.Name] = true
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+// 解析 .conflist 格式的配置
+func parseCNIConfigList(file string) (*cniConfigList, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	list := new(cniConfigList)
+	if err := json.Unmarshal(content, list); err != nil {
+		return nil, err
+	}
+	if list.Name == "" || len(list.Plugins) == 0 {
+		return nil, fmt.Errorf("missing name or plugins")
+	}
+	return list, nil
+}
+
+// 解析 .conf 格式的单个插件的配置
+func parseCNIConfig(file string) (*cniConfigList, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var conf struct {
+		CNIVersion string `json:"cniVersion"`
+		Name       string `json:"name"`
+		Type       string `json:"type"`
+	}
+	if err := json.Unmarshal(content, &conf); err != nil {
+		return nil, err
+	}
+	if conf.Name == "" || conf.Type == "" {
+		return nil, fmt.Errorf("missing name or type")
+	}
+	return &cniConfigList{CNIVersion: conf.CNIVersion, Name: conf.Name, Plugins: []json.RawMessage{content}}, nil
+}
+
+// 列出 CNI 配置目录中的网络
+func listCNINetworks() ([]*Network, error) {
+	lists, err := loadCNIConfigLists()
+	if err != nil {
+		return nil, err
+	}
+	var networks []*Network
+	for _, list := range lists {
+		networks = append(networks, &Network{Name: list.Name, Driver: DriverCNI})
+	}
+	return networks, nil
+}
+
+// 准备通过 CNI 插件连接网络，此时容器进程还没有创建，只记录所使用的配置
+func cniPrepare(ep *config.Endpoint) error {
+	list, ok, err := loadCNIConfigList(ep.Network)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("cni network %s not found in %s", ep.Network, cniConfigDir)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	ep.CNI = &config.CNIState{ConfigList: data, BinDir: cniBinDir}
+	return nil
+}
+
+// 依次调用配置列表中的插件执行 ADD，每个插件的结果作为下一个插件的 prevResult
+// 插件版本支持时再执行一次 CHECK 确认网络配置正确，最后将结果记录到端点中
+// 容器的 network namespace 会先被绑定挂载到 NetnsPath 中，之后的 CNI_NETNS 都使用该路径
+func cniAdd(ep *config.Endpoint, containerID string, pid int) (err error) {
+	// 已经执行过 ADD 的端点不能再次执行，否则插件会为其再分配一个地址
+	if ep.CNI.Netns != "" {
+		return fmt.Errorf("network %s is already attached to netns %s", ep.Network, ep.CNI.Netns)
+	}
+	list := new(cniConfigList)
+	if err := json.Unmarshal(ep.CNI.ConfigList, list); err != nil {
+		return fmt.Errorf("invalid cni config of network %s: %v", ep.Network, err)
+	}
+	netnsPath := path.Join(cniNetnsDir, containerID+"-"+ep.IfName)
+	if err := pinNetns(pid, netnsPath); err != nil {
+		return err
+	}
+	ep.CNI.Netns = netnsPath
+	defer func() {
+		if err != nil {
+			unpinNetns(ep.CNI.Netns)
+			ep.CNI.Netns = ""
+		}
+	}()
+
+	var result json.RawMessage
+	for i, plugin := range list.Plugins {
+		result, err = execPlugin("ADD", list, plugin, result, ep, containerID)
+		if err != nil {
+			// 添加失败时删除已经添加的部分，插件需要能够处理没有完成的 ADD
+			cniCleanup(list, i, nil, ep, containerID)
+			return err
+		}
+	}
+
+	if supportsCheck(list.CNIVersion) {
+		for _, plugin := range list.Plugins {
+			if _, err := execPlugin("CHECK", list, plugin, result, ep, containerID); err != nil {
+				cniCleanup(list, len(list.Plugins)-1, result, ep, containerID)
+				return err
+			}
+		}
+	}
+	ep.CNI.Result = result
+	return parseCNIResult(ep, result)
+}
+
+// ADD 或 CHECK 失败时，按照相反的顺序对第 last 个及之前的插件执行 DEL，释放已经分配的网卡和 IP 地址等资源
+func cniCleanup(list *cniConfigList, last int, prevResult json.RawMessage, ep *config.Endpoint, containerID string) {
+	for i := last; i >= 0; i-- {
+		if _, err := execPlugin("DEL", list, list.Plugins[i], prevResult, ep, containerID); err != nil {
+			log.Warnf("failed to clean up cni network %s: %v", ep.Network, err)
+		}
+	}
+}
+
+// 按照与 ADD 相反的顺序调用插件执行 DEL，prevResult 为 ADD 的结果，完成后解除 network namespace 的绑定挂载
+// 绑定挂载已经不存在时（例如宿主机重启后）不设置 CNI_NETNS，插件仍然需要释放 IP 地址等资源
+func cniDel(ep *config.Endpoint, containerID string) error {
+	list := new(cniConfigList)
+	if err := json.Unmarshal(ep.CNI.ConfigList, list); err != nil {
+		return fmt.Errorf("invalid cni config of network %s: %v", ep.Network, err)
+	}
+	pinned := ep.CNI.Netns
+	if !isNetns(ep.CNI.Netns) {
+		ep.CNI.Netns = ""
+	}
+
+	var errs []string
+	for i := len(list.Plugins) - 1; i >= 0; i-- {
+		if _, err := execPlugin("DEL", list, list.Plugins[i], ep.CNI.Result, ep, containerID); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		ep.CNI.Netns = pinned
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	unpinNetns(pinned)
+	return nil
+}
+
+// 将进程 pid 的 network namespace 绑定挂载到 file 上
+// 容器进程退出并被回收后 PID 可能被其它进程复用，/proc/[pid]/ns/net 会指向其它进程甚至宿主机的 network namespace，
+// 绑定挂载则始终指向容器的 network namespace，并使其在执行 DEL 之前一直存在
+func pinNetns(pid int, file string) error {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return fmt.Errorf("failed to create netns dir: %v", err)
+	}
+	f, err := os.OpenFile(file, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("failed to create netns file %s: %v", file, err)
+	}
+	f.Close()
+	if err := unix.Mount(fmt.Sprintf("/proc/%d/ns/net", pid), file, "", unix.MS_BIND, ""); err != nil {
+		os.Remove(file)
+		return fmt.Errorf("failed to pin netns of process %d: %v", pid, err)
+	}
+	return nil
+}
+
+// 解除 network namespace 的绑定挂载并删除挂载点，可以重复调用
+func unpinNetns(file string) {
+	if file == "" {
+		return
+	}
+	if err := unix.Unmount(file, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		log.Warnf("failed to unmount netns %s: %v", file, err)
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		log.Warnf("failed to remove netns %s: %v", file, err)
+	}
+}
+
+// file 是否为 network namespace 的绑定挂载，没有挂载时只是一个普通的空文件
+func isNetns(file string) bool {
+	if file == "" {
+		return false
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(file, &st); err != nil {
+		return false
+	}
+	return st.Type == unix.NSFS_MAGIC
+}
+
+// 执行 CNI 插件，插件的配置通过标准输入传递，其余参数通过 CNI_* 环境变量传递
+func execPlugin(command string, list *cniConfigList, plugin json.RawMessage, prevResult json.RawMessage, ep *config.Endpoint, containerID string) (json.RawMessage, error) {
+	conf := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(plugin, &conf); err != nil {
+		return nil, fmt.Errorf("invalid cni plugin config: %v", err)
+	}
+	var pluginType string
+	if err := json.Unmarshal(conf["type"], &pluginType); err != nil || pluginType == "" {
+		return nil, fmt.Errorf("missing type in cni plugin config")
+	}
+	// 配置列表中的名称和版本会传递给每个插件
+	conf["name"], _ = json.Marshal(list.Name)
+	conf["cniVersion"], _ = json.Marshal(list.CNIVersion)
+	if prevResult != nil {
+		conf["prevResult"] = prevResult
+	}
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	binary, err := findPlugin(pluginType, ep.CNI.BinDir)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+containerID,
+		"CNI_NETNS="+ep.CNI.Netns,
+		"CNI_IFNAME="+ep.IfName,
+		"CNI_ARGS=",
+		"CNI_PATH="+ep.CNI.BinDir,
+	)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	log.Debugf("cni %s %s: %s", command, pluginType, stdin)
+
+	if err := cmd.Run(); err != nil {
+		cniErr := new(cniError)
+		if json.Unmarshal(stdout.Bytes(), cniErr) == nil && cniErr.Msg != "" {
+			if cniErr.Details != "" {
+				return nil, fmt.Errorf("cni plugin %s %s failed: %s (code %d): %s", pluginType, command, cniErr.Msg, cniErr.Code, cniErr.Details)
+			}
+			return nil, fmt.Errorf("cni plugin %s %s failed: %s (code %d)", pluginType, command, cniErr.Msg, cniErr.Code)
+		}
+		return nil, fmt.Errorf("cni plugin %s %s failed: %v: %s", pluginType, command, err, strings.TrimSpace(stderr.String()))
+	}
+	if command != "ADD" {
+		return nil, nil
+	}
+	if !json.Valid(stdout.Bytes()) {
+		return nil, fmt.Errorf("cni plugin %s returned an invalid result: %s", pluginType, strings.TrimSpace(stdout.String()))
+	}
+	return json.RawMessage(bytes.TrimSpace(stdout.Bytes())), nil
+}
+
+// 在 CNI_PATH 的各个目录中查找插件
+func findPlugin(pluginType string, binDir string) (string, error) {
+	if strings.Contains(pluginType, "/") {
+		return "", fmt.Errorf("invalid cni plugin type: %s", pluginType)
+	}
+	for _, dir := range filepath.SplitList(binDir) {
+		binary := path.Join(dir, pluginType)
+		if fi, err := os.Stat(binary); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return binary, nil
+		}
+	}
+	return "", fmt.Errorf("cni plugin %s not found in %s", pluginType, binDir)
+}
+
+// 从 ADD 的结果中获取容器网卡的 IPv4 和 IPv6 地址、网关和 MAC 地址，每个地址族使用第一个地址
+func parseCNIResult(ep *config.Endpoint, data json.RawMessage) error {
+	result := new(cniResult)
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("invalid cni result: %v", err)
+	}
+	for _, ip := range result.IPs {
+		// 只使用容器中的网卡的地址
+		if ip.Interface != nil {
+			i := *ip.Interface
+			if i < 0 || i >= len(result.Interfaces) || result.Interfaces[i].Sandbox == "" {
+				continue
+			}
+			if ep.MacAddress == "" {
+				ep.MacAddress = result.Interfaces[i].Mac
+			}
+		}
+		addr, _, err := net.ParseCIDR(ip.Address)
+		if err != nil {
+			continue
+		}
+		if addr.To4() != nil && ep.IPAddress == "" {
+			ep.IPAddress = ip.Address
+			ep.Gateway = ip.Gateway
+		} else if addr.To4() == nil && ep.IPv6Address == "" {
+			ep.IPv6Address = ip.Address
+			ep.IPv6Gateway = ip.Gateway
+		}
+	}
+	if ep.IPAddress == "" && ep.IPv6Address == "" {
+		log.Warnf("cni network %s returned no address for the container", ep.Network)
+	}
+	return nil
+}
+
+// CHECK 命令从 0.4.0 版本开始支持
+func supportsCheck(version string) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err1 := strconv.Atoi(parts[0])
+	minor, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return major > 0 || minor >= 4
+}
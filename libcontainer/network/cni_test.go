@@ -0,0 +1,337 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"m-docker/libcontainer/config"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 伪造的 CNI 插件，记录每次调用的命令、环境变量和标准输入，ADD 时返回带有插件名称的结果
+// 环境变量 FAKE_CNI_FAIL 为 [命令]-[插件名称] 时以 CNI 的错误格式失败
+const fakePluginScript = `#!/bin/sh
+name=%s
+log=%s
+echo "$CNI_COMMAND $name" >> "$log/calls"
+cat > "$log/$CNI_COMMAND-$name.stdin"
+env | grep '^CNI_' | sort > "$log/$CNI_COMMAND-$name.env"
+if [ "$FAKE_CNI_FAIL" = "$CNI_COMMAND-$name" ]; then
+	echo '{"cniVersion":"1.0.0","code":11,"msg":"boom","details":"'$name'"}'
+	exit 1
+fi
+if [ "$CNI_COMMAND" = ADD ]; then
+	echo '{"cniVersion":"1.0.0","interfaces":[{"name":"'$CNI_IFNAME'","mac":"02:00:00:00:00:01","sandbox":"'$CNI_NETNS'"}],"ips":[{"address":"10.22.0.5/16","gateway":"10.22.0.1","interface":0}],"dns":{"domain":"'$name'"}}'
+fi
+`
+
+type cniTest struct {
+	ep     *config.Endpoint
+	binDir string
+	logDir string
+}
+
+// 在临时目录中创建由 plugins 组成的 CNI 网络 test-net 和对应的伪造插件，并准备好连接该网络的端点
+// 绑定挂载 network namespace 需要 root 权限
+func newCNITest(t *testing.T, version string, plugins ...string) *cniTest {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to pin network namespaces")
+	}
+	confDir, binDir, logDir, netnsDir := t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()
+	oldConfDir, oldBinDir, oldNetnsDir := cniConfigDir, cniBinDir, cniNetnsDir
+	cniConfigDir, cniBinDir, cniNetnsDir = confDir, binDir, netnsDir
+	t.Cleanup(func() {
+		cniConfigDir, cniBinDir, cniNetnsDir = oldConfDir, oldBinDir, oldNetnsDir
+	})
+
+	var confs []string
+	for _, name := range plugins {
+		script := fmt.Sprintf(fakePluginScript, name, logDir)
+		if err := os.WriteFile(path.Join(binDir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		confs = append(confs, fmt.Sprintf(`{"type":%q,"option":%q}`, name, name+"-option"))
+	}
+	list := fmt.Sprintf(`{"cniVersion":%q,"name":"test-net","plugins":[%s]}`, version, strings.Join(confs, ","))
+	if err := os.WriteFile(path.Join(confDir, "10-test.conflist"), []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ep := &config.Endpoint{Network: "test-net", IfName: "eth0"}
+	if err := cniPrepare(ep); err != nil {
+		t.Fatalf("cniPrepare: %v", err)
+	}
+	return &cniTest{ep: ep, binDir: binDir, logDir: logDir}
+}
+
+// 插件被调用的顺序
+func (c *cniTest) calls(t *testing.T) []string {
+	content, err := os.ReadFile(path.Join(c.logDir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+// 插件执行 command 时的标准输入
+func (c *cniTest) stdin(t *testing.T, command string, name string) map[string]json.RawMessage {
+	content, err := os.ReadFile(path.Join(c.logDir, command+"-"+name+".stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(content, &conf); err != nil {
+		t.Fatalf("invalid stdin of %s %s: %v", command, name, err)
+	}
+	return conf
+}
+
+// 插件执行 command 时的 CNI_* 环境变量
+func (c *cniTest) env(t *testing.T, command string, name string) map[string]string {
+	content, err := os.ReadFile(path.Join(c.logDir, command+"-"+name+".env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env
+}
+
+// 返回结果中 dns.domain 字段所记录的插件名称
+func resultPlugin(t *testing.T, result json.RawMessage) string {
+	var r struct {
+		DNS struct {
+			Domain string `json:"domain"`
+		} `json:"dns"`
+	}
+	if err := json.Unmarshal(result, &r); err != nil {
+		t.Fatalf("invalid result %s: %v", result, err)
+	}
+	return r.DNS.Domain
+}
+
+func TestCNIAddEnvAndStdin(t *testing.T) {
+	c := newCNITest(t, "0.3.1", "a")
+	if err := cniAdd(c.ep, "container1", os.Getpid()); err != nil {
+		t.Fatalf("cniAdd: %v", err)
+	}
+	netnsPath := path.Join(cniNetnsDir, "container1-eth0")
+	if c.ep.CNI.Netns != netnsPath || !isNetns(netnsPath) {
+		t.Fatalf("netns %q is not pinned at %s", c.ep.CNI.Netns, netnsPath)
+	}
+
+	env := c.env(t, "ADD", "a")
+	want := map[string]string{
+		"CNI_COMMAND":     "ADD",
+		"CNI_CONTAINERID": "container1",
+		"CNI_NETNS":       netnsPath,
+		"CNI_IFNAME":      "eth0",
+		"CNI_ARGS":        "",
+		"CNI_PATH":        c.binDir,
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %v, want %v", env, want)
+	}
+
+	stdin := c.stdin(t, "ADD", "a")
+	if string(stdin["name"]) != `"test-net"` || string(stdin["cniVersion"]) != `"0.3.1"` {
+		t.Errorf("name = %s, cniVersion = %s", stdin["name"], stdin["cniVersion"])
+	}
+	if string(stdin["option"]) != `"a-option"` {
+		t.Errorf("plugin config not passed through: %s", stdin["option"])
+	}
+	if _, ok := stdin["prevResult"]; ok {
+		t.Errorf("first plugin got prevResult %s", stdin["prevResult"])
+	}
+
+	if c.ep.IPAddress != "10.22.0.5/16" || c.ep.Gateway != "10.22.0.1" || c.ep.MacAddress != "02:00:00:00:00:01" {
+		t.Errorf("endpoint = %+v", c.ep)
+	}
+
+	if err := cniDel(c.ep, "container1"); err != nil {
+		t.Fatalf("cniDel: %v", err)
+	}
+	if env := c.env(t, "DEL", "a"); env["CNI_NETNS"] != netnsPath || env["CNI_COMMAND"] != "DEL" {
+		t.Errorf("DEL env = %v", env)
+	}
+	if _, err := os.Stat(netnsPath); !os.IsNotExist(err) {
+		t.Errorf("netns %s is not unpinned after DEL: %v", netnsPath, err)
+	}
+}
+
+func TestCNIAddChainsPrevResult(t *testing.T) {
+	c := newCNITest(t, "0.3.1", "a", "b", "c")
+	if err := cniAdd(c.ep, "container1", os.Getpid()); err != nil {
+		t.Fatalf("cniAdd: %v", err)
+	}
+	defer cniDel(c.ep, "container1")
+
+	if got := c.calls(t); !reflect.DeepEqual(got, []string{"ADD a", "ADD b", "ADD c"}) {
+		t.Errorf("calls = %v", got)
+	}
+	if prev := resultPlugin(t, c.stdin(t, "ADD", "b")["prevResult"]); prev != "a" {
+		t.Errorf("prevResult of b comes from %q, want a", prev)
+	}
+	if prev := resultPlugin(t, c.stdin(t, "ADD", "c")["prevResult"]); prev != "b" {
+		t.Errorf("prevResult of c comes from %q, want b", prev)
+	}
+	if last := resultPlugin(t, c.ep.CNI.Result); last != "c" {
+		t.Errorf("recorded result comes from %q, want c", last)
+	}
+}
+
+func TestCNIAddTwice(t *testing.T) {
+	c := newCNITest(t, "0.3.1", "a")
+	if err := cniAdd(c.ep, "container1", os.Getpid()); err != nil {
+		t.Fatalf("cniAdd: %v", err)
+	}
+	defer cniDel(c.ep, "container1")
+	netnsPath := c.ep.CNI.Netns
+
+	err := cniAdd(c.ep, "container1", os.Getpid())
+	if err == nil || !strings.Contains(err.Error(), "already attached") {
+		t.Fatalf("second cniAdd error = %v", err)
+	}
+	if got := c.calls(t); !reflect.DeepEqual(got, []string{"ADD a"}) {
+		t.Errorf("calls = %v", got)
+	}
+	if c.ep.CNI.Netns != netnsPath || !isNetns(netnsPath) {
+		t.Errorf("failed second cniAdd changed the pinned netns to %q", c.ep.CNI.Netns)
+	}
+}
+
+func TestCNIDelReverseOrder(t *testing.T) {
+	c := newCNITest(t, "0.3.1", "a", "b", "c")
+	if err := cniAdd(c.ep, "container1", os.Getpid()); err != nil {
+		t.Fatalf("cniAdd: %v", err)
+	}
+	if err := cniDel(c.ep, "container1"); err != nil {
+		t.Fatalf("cniDel: %v", err)
+	}
+	want := []string{"ADD a", "ADD b", "ADD c", "DEL c", "DEL b", "DEL a"}
+	if got := c.calls(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if prev := resultPlugin(t, c.stdin(t, "DEL", name)["prevResult"]); prev != "c" {
+			t.Errorf("prevResult of DEL %s comes from %q, want c", name, prev)
+		}
+	}
+}
+
+func TestCNIDelWithoutNetns(t *testing.T) {
+	c := newCNITest(t, "0.3.1", "a")
+	if err := cniAdd(c.ep, "container1", os.Getpid()); err != nil {
+		t.Fatalf("cniAdd: %v", err)
+	}
+	// 模拟宿主机重启后绑定挂载已经不存在，只剩下记录的路径
+	unpinNetns(c.ep.CNI.Netns)
+	stale, err := os.Create(c.ep.CNI.Netns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+	defer os.Remove(stale.Name())
+
+	if err := cniDel(c.ep, "container1"); err != nil {
+		t.Fatalf("cniDel: %v", err)
+	}
+	if netns := c.env(t, "DEL", "a")["CNI_NETNS"]; netns != "" {
+		t.Errorf("CNI_NETNS = %q for a netns that is no longer pinned", netns)
+	}
+}
+
+func TestCNICheckVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		check   bool
+	}{
+		{"0.3.0", false},
+		{"0.3.1", false},
+		{"0.4.0", true},
+		{"1.0.0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			c := newCNITest(t, tt.version, "a", "b")
+			if err := cniAdd(c.ep, "container1", os.Getpid()); err != nil {
+				t.Fatalf("cniAdd: %v", err)
+			}
+			defer cniDel(c.ep, "container1")
+
+			want := []string{"ADD a", "ADD b"}
+			if tt.check {
+				want = append(want, "CHECK a", "CHECK b")
+			}
+			if got := c.calls(t); !reflect.DeepEqual(got, want) {
+				t.Errorf("calls = %v, want %v", got, want)
+			}
+			if tt.check {
+				if prev := resultPlugin(t, c.stdin(t, "CHECK", "a")["prevResult"]); prev != "b" {
+					t.Errorf("prevResult of CHECK comes from %q, want b", prev)
+				}
+			}
+		})
+	}
+}
+
+func TestSupportsCheck(t *testing.T) {
+	tests := map[string]bool{
+		"":      false,
+		"0.1.0": false,
+		"0.3.1": false,
+		"0.4.0": true,
+		"1.0.0": true,
+		"1.1":   true,
+		"x.y.z": false,
+	}
+	for version, want := range tests {
+		if got := supportsCheck(version); got != want {
+			t.Errorf("supportsCheck(%q) = %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestCNIAddRollback(t *testing.T) {
+	c := newCNITest(t, "0.3.1", "a", "b", "c")
+	t.Setenv("FAKE_CNI_FAIL", "ADD-b")
+
+	err := cniAdd(c.ep, "container1", os.Getpid())
+	if err == nil || !strings.Contains(err.Error(), "boom (code 11): b") {
+		t.Fatalf("cniAdd error = %v", err)
+	}
+	want := []string{"ADD a", "ADD b", "DEL b", "DEL a"}
+	if got := c.calls(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	if c.ep.CNI.Netns != "" || c.ep.CNI.Result != nil {
+		t.Errorf("failed endpoint still records netns %q and result %s", c.ep.CNI.Netns, c.ep.CNI.Result)
+	}
+	if _, err := os.Stat(path.Join(cniNetnsDir, "container1-eth0")); !os.IsNotExist(err) {
+		t.Errorf("netns is not unpinned after a failed ADD: %v", err)
+	}
+}
+
+func TestCNICheckFailureCleanup(t *testing.T) {
+	c := newCNITest(t, "1.0.0", "a", "b", "c")
+	t.Setenv("FAKE_CNI_FAIL", "CHECK-b")
+
+	if err := cniAdd(c.ep, "container1", os.Getpid()); err == nil {
+		t.Fatal("cniAdd succeeded although CHECK failed")
+	}
+	want := []string{"ADD a", "ADD b", "ADD c", "CHECK a", "CHECK b", "DEL c", "DEL b", "DEL a"}
+	if got := c.calls(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	if c.ep.CNI.Netns != "" {
+		t.Errorf("failed endpoint still records netns %q", c.ep.CNI.Netns)
+	}
+}
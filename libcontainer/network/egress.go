@@ -0,0 +1,105 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"m-docker/libcontainer/config"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+)
+
+// 容器的 network namespace 中存放出站规则的 nftables 表
+const egressTable = "m_docker_egress"
+
+// 在进程 pid 所在的 network namespace 中通过 nftables 安装出站流量策略
+// 规则只作用于容器自己的 network namespace，不影响宿主机和其它容器，宿主机没有 nft 时拒绝启动容器
+func ApplyEgressPolicy(pid int, policy *config.EgressPolicy) error {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return fmt.Errorf("nft not found, egress policy requires nftables")
+	}
+	ruleset := egressRuleset(policy)
+	log.Debugf("egress ruleset of process %d:\n%s", pid, ruleset)
+	return inNetns(pid, func() error {
+		cmd := exec.Command("nft", "-f", "-")
+		cmd.Stdin = strings.NewReader(ruleset)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to install egress policy: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	})
+}
+
+// 生成出站流量策略的 nftables 规则集，output 链默认丢弃，只放行以下流量：
+// 回环设备上的流量、已建立连接的流量、IPv6 邻居发现以及策略中放行的流量
+// 规则集先声明再删除已经存在的表，nft 在同一个事务中完成替换，重复安装不会叠加规则
+func egressRuleset(policy *config.EgressPolicy) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "table inet %s\n", egressTable)
+	fmt.Fprintf(&buf, "delete table inet %s\n", egressTable)
+	fmt.Fprintf(&buf, "table inet %s {\n", egressTable)
+	buf.WriteString("\tchain output {\n")
+	buf.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	buf.WriteString("\t\toifname \"lo\" accept\n")
+	buf.WriteString("\t\tct state established,related accept\n")
+	buf.WriteString("\t\ticmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit } accept\n")
+	for _, rule := range policy.Allow {
+		fmt.Fprintf(&buf, "\t\t%s accept\n", egressMatch(rule))
+	}
+	buf.WriteString("\t}\n")
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// 出站规则对应的 nftables 匹配条件
+func egressMatch(rule *config.EgressRule) string {
+	if rule.Destination != "" {
+		if ip, _, err := net.ParseCIDR(rule.Destination); err == nil && ip.To4() == nil {
+			return "ip6 daddr " + rule.Destination
+		}
+		return "ip daddr " + rule.Destination
+	}
+	switch {
+	case rule.Protocol == "icmp":
+		return "meta l4proto { icmp, ipv6-icmp }"
+	case rule.Ports != "":
+		return fmt.Sprintf("%s dport %s", rule.Protocol, rule.Ports)
+	default:
+		return "meta l4proto " + rule.Protocol
+	}
+}
+
+// 在进程 pid 所在的 network namespace 中执行 fn，fn 中创建的子进程也在该 network namespace 中
+// setns 只作用于当前线程，因此需要锁定线程，恢复失败时不解锁，线程会随 goroutine 退出而销毁
+func inNetns(pid int, fn func() error) error {
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to get current netns: %v", err)
+	}
+	defer origin.Close()
+	target, err := netns.GetFromPid(pid)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to get netns of process %d: %v", pid, err)
+	}
+	defer target.Close()
+
+	if err := netns.Set(target); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter netns of process %d: %v", pid, err)
+	}
+	fnErr := fn()
+	if err := netns.Set(origin); err != nil {
+		log.Warnf("failed to restore netns: %v", err)
+		return fnErr
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
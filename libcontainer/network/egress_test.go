@@ -0,0 +1,50 @@
+package network
+
+import (
+	"m-docker/libcontainer/config"
+	"strings"
+	"testing"
+)
+
+func TestEgressMatch(t *testing.T) {
+	tests := []struct {
+		rule *config.EgressRule
+		want string
+	}{
+		{&config.EgressRule{Destination: "10.0.0.0/8"}, "ip daddr 10.0.0.0/8"},
+		{&config.EgressRule{Destination: "fd00::/64"}, "ip6 daddr fd00::/64"},
+		{&config.EgressRule{Protocol: "icmp"}, "meta l4proto { icmp, ipv6-icmp }"},
+		{&config.EgressRule{Protocol: "tcp", Ports: "443"}, "tcp dport 443"},
+		{&config.EgressRule{Protocol: "udp", Ports: "8000-8080"}, "udp dport 8000-8080"},
+		{&config.EgressRule{Protocol: "udp"}, "meta l4proto udp"},
+	}
+	for _, tt := range tests {
+		if got := egressMatch(tt.rule); got != tt.want {
+			t.Errorf("egressMatch(%+v) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestEgressRuleset(t *testing.T) {
+	ruleset := egressRuleset(&config.EgressPolicy{Allow: []*config.EgressRule{
+		{Destination: "10.0.0.0/8"},
+		{Protocol: "tcp", Ports: "443"},
+	}})
+	lines := strings.Split(strings.TrimSpace(ruleset), "\n")
+
+	// 先替换已经存在的表，再以默认丢弃的 output 链重新创建
+	want := []string{"table inet m_docker_egress", "delete table inet m_docker_egress", "table inet m_docker_egress {"}
+	for i, line := range want {
+		if lines[i] != line {
+			t.Fatalf("line %d = %q, want %q\n%s", i, lines[i], line, ruleset)
+		}
+	}
+	if !strings.Contains(ruleset, "type filter hook output priority 0; policy drop;") {
+		t.Errorf("output chain does not drop by default:\n%s", ruleset)
+	}
+	for _, rule := range []string{"oifname \"lo\" accept", "ct state established,related accept", "ip daddr 10.0.0.0/8 accept", "tcp dport 443 accept"} {
+		if !strings.Contains(ruleset, "\t\t"+rule+"\n") {
+			t.Errorf("ruleset does not contain %q:\n%s", rule, ruleset)
+		}
+	}
+}
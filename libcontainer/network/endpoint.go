@@ -0,0 +1,280 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/constant"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// 为容器创建连接到网络的端点：分配 IP 地址，创建 veth 设备并将宿主机一端连接到网桥上
+// 容器一端暂时留在宿主机上，等容器进程创建之后再通过 Attach 移动到容器的 network namespace 中
+func Connect(ep *config.Endpoint, containerID string) (err error) {
+	// 先加锁再读取网络的配置，避免网络同时被删除
+	unlock, err := lockNetwork(ep.Network)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	nw, err := GetNetwork(ep.Network)
+	if err != nil {
+		return err
+	}
+	if ep.IfName == "" {
+		ep.IfName = constant.ContainerIfName
+	}
+	if nw.Driver == DriverCNI {
+		return cniPrepare(ep)
+	}
+
+	bridge, err := ensureBridge(nw)
+	if err != nil {
+		return err
+	}
+
+	ip, err := allocateIP(nw, nw.Subnet, nw.Gateway, containerID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = releaseIP(nw, ip, containerID)
+		}
+	}()
+	var ip6 net.IP
+	if nw.Subnet6 != "" {
+		if ip6, err = allocateIP(nw, nw.Subnet6, nw.Gateway6, containerID); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = releaseIP(nw, ip6, containerID)
+			}
+		}()
+	}
+
+	hostVeth, err := newVethName()
+	if err != nil {
+		return err
+	}
+	la := netlink.NewLinkAttrs()
+	la.Name = hostVeth
+	la.MasterIndex = bridge.Attrs().Index
+	veth := &netlink.Veth{LinkAttrs: la, PeerName: peerName(hostVeth)}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create veth %s: %v", hostVeth, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = netlink.LinkDel(veth)
+		}
+	}()
+	if err := netlink.LinkSetUp(veth); err != nil {
+		return fmt.Errorf("failed to set up veth %s: %v", hostVeth, err)
+	}
+
+	_, ipNet, _ := net.ParseCIDR(nw.Subnet)
+	ep.HostVeth = hostVeth
+	ep.IPAddress = (&net.IPNet{IP: ip, Mask: ipNet.Mask}).String()
+	ep.Gateway = nw.Gateway
+	ep.MacAddress = macFromIP(ip).String()
+	if ip6 != nil {
+		_, ipNet6, _ := net.ParseCIDR(nw.Subnet6)
+		ep.IPv6Address = (&net.IPNet{IP: ip6, Mask: ipNet6.Mask}).String()
+		ep.IPv6Gateway = nw.Gateway6
+	}
+	log.Debugf("Connected container %s to network %s: %s %s via %s", containerID, nw.Name, ep.IPAddress, ep.IPv6Address, hostVeth)
+	return nil
+}
+
+// 将端点在容器一端的 veth 设备移动到进程 pid 所在的 network namespace 中，
+// 重命名为 IfName 并配置 MAC 地址、IPv4 和 IPv6 地址，defaultRoute 为 true 时还会添加经过网关的默认路由
+// CNI 网络由插件完成以上工作
+func Attach(ep *config.Endpoint, containerID string, pid int, defaultRoute bool) error {
+	if ep.CNI != nil {
+		return cniAdd(ep, containerID, pid)
+	}
+	peer, err := netlink.LinkByName(peerName(ep.HostVeth))
+	if err != nil {
+		return fmt.Errorf("failed to get veth peer of %s: %v", ep.HostVeth, err)
+	}
+	if err := netlink.LinkSetNsPid(peer, pid); err != nil {
+		return fmt.Errorf("failed to move veth %s to netns of process %d: %v", peer.Attrs().Name, pid, err)
+	}
+
+	handle, err := handleAt(pid)
+	if err != nil {
+		return err
+	}
+	defer handle.Delete()
+
+	peer, err = handle.LinkByName(peerName(ep.HostVeth))
+	if err != nil {
+		return fmt.Errorf("failed to get veth peer of %s in container: %v", ep.HostVeth, err)
+	}
+	if err := handle.LinkSetName(peer, ep.IfName); err != nil {
+		return fmt.Errorf("failed to rename veth to %s: %v", ep.IfName, err)
+	}
+	mac, err := net.ParseMAC(ep.MacAddress)
+	if err != nil {
+		return fmt.Errorf("invalid mac address %s: %v", ep.MacAddress, err)
+	}
+	if err := handle.LinkSetHardwareAddr(peer, mac); err != nil {
+		return fmt.Errorf("failed to set mac address of %s: %v", ep.IfName, err)
+	}
+	addr, err := netlink.ParseAddr(ep.IPAddress)
+	if err != nil {
+		return fmt.Errorf("invalid ip address %s: %v", ep.IPAddress, err)
+	}
+	if err := handle.AddrAdd(peer, addr); err != nil {
+		return fmt.Errorf("failed to add address %s to %s: %v", ep.IPAddress, ep.IfName, err)
+	}
+	var addr6 *netlink.Addr
+	if ep.IPv6Address != "" {
+		if addr6, err = netlink.ParseAddr(ep.IPv6Address); err != nil {
+			return fmt.Errorf("invalid ipv6 address %s: %v", ep.IPv6Address, err)
+		}
+		// 地址由 IPAM 分配，不会冲突，跳过 DAD 使地址立即可用
+		addr6.Flags = unix.IFA_F_NODAD
+		if err := handle.AddrAdd(peer, addr6); err != nil {
+			return fmt.Errorf("failed to add address %s to %s: %v", ep.IPv6Address, ep.IfName, err)
+		}
+	}
+	if err := handle.LinkSetUp(peer); err != nil {
+		return fmt.Errorf("failed to set up %s: %v", ep.IfName, err)
+	}
+
+	if !defaultRoute {
+		return nil
+	}
+	route := &netlink.Route{
+		LinkIndex: peer.Attrs().Index,
+		Gw:        net.ParseIP(ep.Gateway),
+	}
+	if err := handle.RouteAdd(route); err != nil {
+		return fmt.Errorf("failed to add default route via %s: %v", ep.Gateway, err)
+	}
+	if addr6 != nil {
+		route6 := &netlink.Route{
+			LinkIndex: peer.Attrs().Index,
+			Gw:        net.ParseIP(ep.IPv6Gateway),
+		}
+		if err := handle.RouteAdd(route6); err != nil {
+			return fmt.Errorf("failed to add ipv6 default route via %s: %v", ep.IPv6Gateway, err)
+		}
+	}
+	return nil
+}
+
+// 启用进程 pid 所在的 network namespace 中的 lo 设备
+func SetupLoopback(pid int) error {
+	handle, err := handleAt(pid)
+	if err != nil {
+		return err
+	}
+	defer handle.Delete()
+
+	lo, err := handle.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("failed to get lo: %v", err)
+	}
+	if err := handle.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("failed to set up lo: %v", err)
+	}
+	return nil
+}
+
+// 删除端点的 veth 设备并释放 IPv4 和 IPv6 地址
+// 容器的 network namespace 销毁时 veth 设备会随之删除，此时设备不存在不视为错误
+// CNI 网络只有执行过 ADD 时才需要调用插件执行 DEL
+func Disconnect(ep *config.Endpoint, containerID string) error {
+	if ep.CNI != nil {
+		if ep.CNI.Netns == "" {
+			return nil
+		}
+		return cniDel(ep, containerID)
+	}
+	removeBandwidth(ep)
+	if ep.HostVeth != "" {
+		link, err := netlink.LinkByName(ep.HostVeth)
+		if err == nil {
+			if err := netlink.LinkDel(link); err != nil {
+				return fmt.Errorf("failed to delete veth %s: %v", ep.HostVeth, err)
+			}
+		} else if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return fmt.Errorf("failed to get veth %s: %v", ep.HostVeth, err)
+		}
+	}
+
+	var ips []net.IP
+	for _, address := range []string{ep.IPAddress, ep.IPv6Address} {
+		if address == "" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return fmt.Errorf("invalid ip address %s: %v", address, err)
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+	unlock, err := lockNetwork(ep.Network)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	nw, err := GetNetwork(ep.Network)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := releaseIP(nw, ip, containerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 获取进程 pid 所在的 network namespace 的 netlink 句柄
+func handleAt(pid int) (*netlink.Handle, error) {
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get netns of process %d: %v", pid, err)
+	}
+	defer ns.Close()
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get netlink handle of process %d: %v", pid, err)
+	}
+	return handle, nil
+}
+
+// 生成宿主机一端的 veth 设备名称，网卡名称最长为 15 个字符
+func newVethName() (string, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate veth name: %v", err)
+	}
+	return "veth" + hex.EncodeToString(buf)[:7], nil
+}
+
+// veth 设备在容器一端的临时名称，移动到容器中后会被重命名
+func peerName(hostVeth string) string {
+	return "c" + hostVeth[1:]
+}
+
+// 与 docker 一致，根据 IP 地址生成 MAC 地址，避免容器重启后 ARP 缓存失效
+func macFromIP(ip net.IP) net.HardwareAddr {
+	mac := net.HardwareAddr{0x02, 0x42, 0, 0, 0, 0}
+	copy(mac[2:], ip.To4())
+	return mac
+}
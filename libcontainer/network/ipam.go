@@ -0,0 +1,132 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"m-docker/libcontainer/constant"
+	"net"
+	"os"
+	"path"
+)
+
+// 网络中的 IP 地址分配情况，持久化到 IPAMPath/[name].json
+type ipamStore struct {
+	// 已分配的 IP 地址到容器 ID 的映射
+	Allocations map[string]string `json:"allocations"`
+}
+
+// 从网络的 IPv4 或 IPv6 子网中为容器分配一个 IP 地址，跳过网络地址、网关和广播地址
+// IPv6 没有广播地址，跳过子网中的最后一个地址不影响使用
+// 调用者需要持有网络的锁
+func allocateIP(nw *Network, subnet string, gateway string, containerID string) (net.IP, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %v", subnet, err)
+	}
+	store, err := loadIPAM(nw.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	broadcast := broadcastIP(ipNet)
+	for ip := nextIP(ipNet.IP); ipNet.Contains(ip) && !ip.Equal(broadcast); ip = nextIP(ip) {
+		if ip.String() == gateway {
+			continue
+		}
+		if _, ok := store.Allocations[ip.String()]; ok {
+			continue
+		}
+		store.Allocations[ip.String()] = containerID
+		if err := saveIPAM(nw.Name, store); err != nil {
+			return nil, err
+		}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no available IP address in network %s", nw.Name)
+}
+
+// 释放容器所占用的 IP 地址，地址已经分配给其他容器时不做处理
+// 调用者需要持有网络的锁
+func releaseIP(nw *Network, ip net.IP, containerID string) error {
+	store, err := loadIPAM(nw.Name)
+	if err != nil {
+		return err
+	}
+	if owner, ok := store.Allocations[ip.String()]; !ok || owner != containerID {
+		return nil
+	}
+	delete(store.Allocations, ip.String())
+	return saveIPAM(nw.Name, store)
+}
+
+// 读取网络的 IP 地址分配情况，文件不存在时表示还没有分配过地址
+func loadIPAM(name string) (*ipamStore, error) {
+	store := &ipamStore{Allocations: map[string]string{}}
+	content, err := os.ReadFile(ipamFile(name))
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ipam of network %s: %v", name, err)
+	}
+	if err := json.Unmarshal(content, store); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ipam of network %s: %v", name, err)
+	}
+	if store.Allocations == nil {
+		store.Allocations = map[string]string{}
+	}
+	return store, nil
+}
+
+// 将网络的 IP 地址分配情况写入磁盘，先写入临时文件再重命名，避免中途失败损坏已有的记录
+func saveIPAM(name string, store *ipamStore) error {
+	if err := os.MkdirAll(constant.IPAMPath, 0755); err != nil {
+		return fmt.Errorf("failed to create dir %s: %v", constant.IPAMPath, err)
+	}
+	data, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	tmp := ipamFile(name) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write ipam of network %s: %v", name, err)
+	}
+	if err := os.Rename(tmp, ipamFile(name)); err != nil {
+		return fmt.Errorf("failed to write ipam of network %s: %v", name, err)
+	}
+	return nil
+}
+
+// IP 地址分配记录的路径
+func ipamFile(name string) string {
+	return path.Join(constant.IPAMPath, name+".json")
+}
+
+// 返回 ip 的下一个地址
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	if v4 := next.To4(); v4 != nil {
+		next = v4
+	}
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// 子网的广播地址
+func broadcastIP(ipNet *net.IPNet) net.IP {
+	ip := ipNet.IP.To4()
+	if ip == nil {
+		ip = ipNet.IP
+	}
+	broadcast := make(net.IP, len(ip))
+	for i := range ip {
+		broadcast[i] = ip[i] | ^ipNet.Mask[i]
+	}
+	return broadcast
+}
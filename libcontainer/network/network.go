@@ -0,0 +1,527 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"m-docker/libcontainer/constant"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 网络的驱动类型，目前只支持网桥
+const DriverBridge = "bridge"
+
+// 通过 CNI 插件管理的网络的驱动类型
+const DriverCNI = "cni"
+
+// 网络中 IPv6 流量的转发方式
+const (
+	// 对发往外部的流量做 NAT66，与 IPv4 一致，默认使用该方式
+	IPv6ModeNAT = "nat"
+
+	// 不做地址转换，直接路由，外部网络需要有指向该子网的路由
+	IPv6ModeRouted = "routed"
+)
+
+// 网络名称的格式，与 docker 一致
+var networkNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// 网络的配置
+// 连接到同一个网络的容器通过网桥互相通信，并通过网桥所在的宿主机访问外部网络，不同网络之间相互隔离
+type Network struct {
+	// 网络的唯一标识符
+	ID string `json:"id"`
+
+	// 网络名称
+	Name string `json:"name"`
+
+	// 网络的驱动类型
+	Driver string `json:"driver"`
+
+	// 网桥设备的名称
+	Bridge string `json:"bridge"`
+
+	// 网络的子网，如 172.29.0.0/16
+	Subnet string `json:"subnet"`
+
+	// 网关地址，即网桥的 IP 地址
+	Gateway string `json:"gateway"`
+
+	// IPv6 子网，为空时网络只使用 IPv4
+	Subnet6 string `json:"subnet6,omitempty"`
+
+	// IPv6 网关地址，即网桥的 IPv6 地址
+	Gateway6 string `json:"gateway6,omitempty"`
+
+	// IPv6 流量的转发方式，nat 或 routed
+	IPv6Mode string `json:"ipv6Mode,omitempty"`
+
+	// 网络的创建时间
+	Created time.Time `json:"created"`
+}
+
+// 根据名称获取网络的配置，默认网络不存在时自动创建
+func GetNetwork(name string) (*Network, error) {
+	if !networkNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name: %s", name)
+	}
+
+	content, err := os.ReadFile(networkFile(name))
+	if err == nil {
+		nw := new(Network)
+		if err := json.Unmarshal(content, nw); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal network %s: %v", name, err)
+		}
+		return nw, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read network %s: %v", name, err)
+	}
+	if name != constant.DefaultNetwork {
+		// 没有通过 network create 创建的网络时，查找 CNI 配置目录中的同名网络
+		if _, ok, err := loadCNIConfigList(name); err != nil {
+			return nil, err
+		} else if ok {
+			return &Network{Name: name, Driver: DriverCNI}, nil
+		}
+		return nil, fmt.Errorf("network %s not found", name)
+	}
+
+	nw, err := newNetwork(constant.DefaultNetwork, constant.DefaultBridge, constant.DefaultSubnet, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := saveNetwork(nw); err != nil {
+		return nil, err
+	}
+	return nw, nil
+}
+
+// 创建网络的参数，为空的字段使用默认值
+type NetworkOptions struct {
+	// IPv4 子网和网关
+	Subnet  string
+	Gateway string
+
+	// 是否启用 IPv6，指定了 IPv6 子网时自动启用
+	IPv6 bool
+
+	// IPv6 子网和网关
+	Subnet6  string
+	Gateway6 string
+
+	// IPv6 流量的转发方式
+	IPv6Mode string
+}
+
+// 创建网络，没有指定子网时从地址池中选择一个未被使用的子网
+func CreateNetwork(name string, opts *NetworkOptions) (*Network, error) {
+	if !networkNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name: %s", name)
+	}
+	// 这些名称是 --network 的网络模式
+	if name == constant.NetworkModeNone || name == constant.NetworkModeHost || name == "container" {
+		return nil, fmt.Errorf("network name %s is reserved", name)
+	}
+
+	// 选择子网和检查冲突时需要与其它创建网络的进程互斥
+	unlock, err := lockFile("networks")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := GetNetwork(name); err == nil {
+		return nil, fmt.Errorf("network with name %s already exists", name)
+	}
+	networks, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	subnet := opts.Subnet
+	if subnet == "" {
+		if opts.Gateway != "" {
+			return nil, fmt.Errorf("gateway requires a subnet")
+		}
+		if subnet, err = allocateSubnet(networks); err != nil {
+			return nil, err
+		}
+	}
+
+	nw, err := newNetwork(name, "", subnet, opts.Gateway)
+	if err != nil {
+		return nil, err
+	}
+	if opts.IPv6 || opts.Subnet6 != "" {
+		subnet6 := opts.Subnet6
+		if subnet6 == "" {
+			if opts.Gateway6 != "" {
+				return nil, fmt.Errorf("ipv6 gateway requires an ipv6 subnet")
+			}
+			if subnet6, err = allocateSubnet6(networks); err != nil {
+				return nil, err
+			}
+		}
+		if err := nw.setIPv6(subnet6, opts.Gateway6, opts.IPv6Mode); err != nil {
+			return nil, err
+		}
+	} else if opts.Gateway6 != "" || opts.IPv6Mode != "" {
+		return nil, fmt.Errorf("ipv6 options require --ipv6")
+	}
+
+	for _, other := range networks {
+		if overlap, ok := networksOverlap(nw.Subnet, other.Subnet); ok {
+			return nil, fmt.Errorf("subnet %s overlaps with network %s (%s)", nw.Subnet, other.Name, overlap)
+		}
+		if overlap, ok := networksOverlap(nw.Subnet6, other.Subnet6); ok {
+			return nil, fmt.Errorf("subnet %s overlaps with network %s (%s)", nw.Subnet6, other.Name, overlap)
+		}
+	}
+	if err := saveNetwork(nw); err != nil {
+		return nil, err
+	}
+	return nw, nil
+}
+
+// 列出所有网络，默认网络不存在时自动创建
+func ListNetworks() ([]*Network, error) {
+	if _, err := GetNetwork(constant.DefaultNetwork); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(constant.NetworkPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dir %s: %v", constant.NetworkPath, err)
+	}
+	var networks []*Network
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		nw, err := GetNetwork(name)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, nw)
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].Created.Before(networks[j].Created)
+	})
+
+	// CNI 网络排在最后，与已有网络同名的 CNI 网络不会被使用
+	cniNetworks, err := listCNINetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, nw := range cniNetworks {
+		if _, err := os.Stat(networkFile(nw.Name)); os.IsNotExist(err) && nw.Name != constant.DefaultNetwork {
+			networks = append(networks, nw)
+		}
+	}
+	return networks, nil
+}
+
+// 删除网络，默认网络不能删除，仍有容器连接到网络时拒绝删除
+func DeleteNetwork(name string) error {
+	if name == constant.DefaultNetwork {
+		return fmt.Errorf("%s is a pre-defined network and cannot be removed", name)
+	}
+	unlock, err := lockNetwork(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	nw, err := GetNetwork(name)
+	if err != nil {
+		return err
+	}
+	if nw.Driver == DriverCNI {
+		return fmt.Errorf("%s is a cni network, remove its config from %s instead", name, cniConfigDir)
+	}
+	store, err := loadIPAM(name)
+	if err != nil {
+		return err
+	}
+	if len(store.Allocations) > 0 {
+		return fmt.Errorf("network %s has active endpoints", name)
+	}
+
+	if err := removeBridge(nw); err != nil {
+		return err
+	}
+	if err := os.Remove(ipamFile(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove ipam of network %s: %v", name, err)
+	}
+	if err := os.Remove(networkFile(name)); err != nil {
+		return fmt.Errorf("failed to remove network %s: %v", name, err)
+	}
+	return nil
+}
+
+// 从地址池中选择一个与已有网络以及宿主机上的地址都不冲突的子网
+// 与 docker 一致，先使用 172.17.0.0/16 ~ 172.31.0.0/16，再使用 192.168.0.0/16 中的 /20
+func allocateSubnet(networks []*Network) (string, error) {
+	var used []*net.IPNet
+	for _, nw := range networks {
+		if _, ipNet, err := net.ParseCIDR(nw.Subnet); err == nil {
+			used = append(used, ipNet)
+		}
+	}
+	used = append(used, hostNetworks()...)
+
+	var candidates []string
+	for i := 17; i <= 31; i++ {
+		candidates = append(candidates, fmt.Sprintf("172.%d.0.0/16", i))
+	}
+	for i := 0; i < 256; i += 16 {
+		candidates = append(candidates, fmt.Sprintf("192.168.%d.0/20", i))
+	}
+	for _, candidate := range candidates {
+		_, ipNet, _ := net.ParseCIDR(candidate)
+		conflict := false
+		for _, u := range used {
+			if subnetsOverlap(ipNet, u) {
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no available subnet for new network")
+}
+
+// 从 DefaultIPv6Pool 中选择一个与已有网络以及宿主机上的地址都不冲突的 /64 子网
+func allocateSubnet6(networks []*Network) (string, error) {
+	var used []*net.IPNet
+	for _, nw := range networks {
+		if _, ipNet, err := net.ParseCIDR(nw.Subnet6); err == nil {
+			used = append(used, ipNet)
+		}
+	}
+	used = append(used, hostNetworks()...)
+
+	_, pool, _ := net.ParseCIDR(constant.DefaultIPv6Pool)
+	for i := 0; i < 1<<16; i++ {
+		candidate := &net.IPNet{IP: make(net.IP, net.IPv6len), Mask: net.CIDRMask(64, 128)}
+		copy(candidate.IP, pool.IP)
+		candidate.IP[6], candidate.IP[7] = byte(i>>8), byte(i)
+		conflict := false
+		for _, u := range used {
+			if subnetsOverlap(candidate, u) {
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			return candidate.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no available ipv6 subnet for new network")
+}
+
+// 两个子网是否有重叠，任意一个为空时视为不重叠，重叠时返回另一个子网
+func networksOverlap(subnet string, other string) (string, bool) {
+	_, a, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", false
+	}
+	_, b, err := net.ParseCIDR(other)
+	if err != nil {
+		return "", false
+	}
+	return other, subnetsOverlap(a, b)
+}
+
+// 宿主机上网卡所在的子网，不包括回环地址和 IPv6 链路本地地址
+func hostNetworks() []*net.IPNet {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			networks = append(networks, &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask})
+		}
+	}
+	return networks
+}
+
+// 两个子网是否有重叠
+func subnetsOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// 生成网络的配置，没有指定网关时使用子网中的第一个地址
+func newNetwork(name string, bridge string, subnet string, gateway string) (*Network, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %v", subnet, err)
+	}
+	if ipNet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid subnet %s: only IPv4 is supported", subnet)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("subnet %s is too small", subnet)
+	}
+
+	gatewayIP := nextIP(ipNet.IP)
+	if gateway != "" {
+		gatewayIP = net.ParseIP(gateway)
+		if gatewayIP == nil || !ipNet.Contains(gatewayIP) || gatewayIP.Equal(ipNet.IP) || gatewayIP.Equal(broadcastIP(ipNet)) {
+			return nil, fmt.Errorf("invalid gateway %s for subnet %s", gateway, ipNet)
+		}
+	}
+
+	id, err := generateID()
+	if err != nil {
+		return nil, err
+	}
+	if bridge == "" {
+		bridge = "br-" + id[:12]
+	}
+	return &Network{
+		ID:      id,
+		Name:    name,
+		Driver:  DriverBridge,
+		Bridge:  bridge,
+		Subnet:  ipNet.String(),
+		Gateway: gatewayIP.To4().String(),
+		Created: time.Now(),
+	}, nil
+}
+
+// 为网络启用 IPv6，没有指定网关时使用子网中的第一个地址
+func (nw *Network) setIPv6(subnet6 string, gateway6 string, mode string) error {
+	_, ipNet, err := net.ParseCIDR(subnet6)
+	if err != nil {
+		return fmt.Errorf("invalid ipv6 subnet %s: %v", subnet6, err)
+	}
+	if ipNet.IP.To4() != nil {
+		return fmt.Errorf("invalid ipv6 subnet %s: not an IPv6 subnet", subnet6)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones < 2 {
+		return fmt.Errorf("ipv6 subnet %s is too small", subnet6)
+	}
+
+	gatewayIP := nextIP(ipNet.IP)
+	if gateway6 != "" {
+		gatewayIP = net.ParseIP(gateway6)
+		if gatewayIP == nil || gatewayIP.To4() != nil || !ipNet.Contains(gatewayIP) || gatewayIP.Equal(ipNet.IP) {
+			return fmt.Errorf("invalid ipv6 gateway %s for subnet %s", gateway6, ipNet)
+		}
+	}
+
+	switch mode {
+	case "":
+		mode = IPv6ModeNAT
+	case IPv6ModeNAT, IPv6ModeRouted:
+	default:
+		return fmt.Errorf("invalid ipv6 mode %s, must be %s or %s", mode, IPv6ModeNAT, IPv6ModeRouted)
+	}
+
+	nw.Subnet6 = ipNet.String()
+	nw.Gateway6 = gatewayIP.String()
+	nw.IPv6Mode = mode
+	return nil
+}
+
+// 将网络的配置写入 NetworkPath/[name].json
+func saveNetwork(nw *Network) error {
+	if err := os.MkdirAll(constant.NetworkPath, 0755); err != nil {
+		return fmt.Errorf("failed to create dir %s: %v", constant.NetworkPath, err)
+	}
+	data, err := json.Marshal(nw)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(networkFile(nw.Name), data, 0644); err != nil {
+		return fmt.Errorf("failed to write network %s: %v", nw.Name, err)
+	}
+	return nil
+}
+
+// 网络配置文件的路径
+func networkFile(name string) string {
+	return path.Join(constant.NetworkPath, name+".json")
+}
+
+// 网关地址及子网掩码，如 172.29.0.1/16
+func (nw *Network) gatewayNet() (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(nw.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %v", nw.Subnet, err)
+	}
+	gateway := net.ParseIP(nw.Gateway)
+	if gateway == nil {
+		return nil, fmt.Errorf("invalid gateway %s", nw.Gateway)
+	}
+	return &net.IPNet{IP: gateway, Mask: ipNet.Mask}, nil
+}
+
+// IPv6 网关地址及前缀长度，如 fd6d:646f:636b::1/64，网络没有启用 IPv6 时返回 nil
+func (nw *Network) gatewayNet6() (*net.IPNet, error) {
+	if nw.Subnet6 == "" {
+		return nil, nil
+	}
+	_, ipNet, err := net.ParseCIDR(nw.Subnet6)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipv6 subnet %s: %v", nw.Subnet6, err)
+	}
+	gateway := net.ParseIP(nw.Gateway6)
+	if gateway == nil {
+		return nil, fmt.Errorf("invalid ipv6 gateway %s", nw.Gateway6)
+	}
+	return &net.IPNet{IP: gateway, Mask: ipNet.Mask}, nil
+}
+
+// 对网络加文件锁，在多个 m-docker 进程之间互斥地修改网桥和 IP 地址分配，返回用于解锁的函数
+func lockNetwork(name string) (func(), error) {
+	if !networkNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name: %s", name)
+	}
+	return lockFile("network-" + name)
+}
+
+// 对 LockPath 下的文件加锁，返回用于解锁的函数
+func lockFile(name string) (func(), error) {
+	if err := os.MkdirAll(constant.LockPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dir %s: %v", constant.LockPath, err)
+	}
+	lockPath := path.Join(constant.LockPath, name)
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %v", lockPath, err)
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", lockPath, err)
+	}
+	return func() {
+		_ = unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// 生成随机的网络 ID
+func generateID() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate network id: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
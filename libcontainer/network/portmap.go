@@ -0,0 +1,238 @@
+package network
+
+import (
+	"fmt"
+	"m-docker/libcontainer/config"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// nat 表中存放端口映射 DNAT 规则的链
+const portChain = "M-DOCKER"
+
+// 规则的注释前缀，注释中记录了规则所属的容器 ID，用于删除容器的规则以及清理残留的规则
+const ruleCommentPrefix = "m-docker:"
+
+var (
+	proxiesMu sync.Mutex
+
+	// 当前进程中运行的端口代理，按容器 ID 分组
+	proxies = make(map[string][]portProxy)
+)
+
+// 将容器的端口发布到宿主机上：启动用户态代理占用宿主机端口，并添加 DNAT 规则
+// 没有指定宿主机地址时，容器有 IPv6 地址的端口同时发布到宿主机的 IPv4 和 IPv6 地址上，使用相同的端口
+// 随机分配的宿主机端口会回写到 ports 中，失败时撤销已经发布的端口
+func PublishPorts(containerID string, ep *config.Endpoint, ports []*config.PortMapping) (err error) {
+	if len(ports) == 0 {
+		return nil
+	}
+	var containerIP, containerIP6 net.IP
+	if ep.IPAddress != "" {
+		if containerIP, _, err = net.ParseCIDR(ep.IPAddress); err != nil {
+			return fmt.Errorf("invalid ip address %s: %v", ep.IPAddress, err)
+		}
+	}
+	if ep.IPv6Address != "" {
+		if containerIP6, _, err = net.ParseCIDR(ep.IPv6Address); err != nil {
+			return fmt.Errorf("invalid ipv6 address %s: %v", ep.IPv6Address, err)
+		}
+	}
+	nw, err := GetNetwork(ep.Network)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			UnpublishPorts(containerID)
+		}
+	}()
+
+	for _, pm := range ports {
+		hostIP := net.ParseIP(pm.HostIP)
+		published := false
+		if containerIP != nil && (hostIP == nil || hostIP.To4() != nil) {
+			if err := publishPort(containerID, nw.Bridge, iptables, containerIP, pm); err != nil {
+				return err
+			}
+			published = true
+		}
+		if containerIP6 != nil && (hostIP == nil || hostIP.To4() == nil) {
+			if err := publishPort(containerID, nw.Bridge, ip6tables, containerIP6, pm); err != nil {
+				return err
+			}
+			published = true
+		}
+		if !published {
+			return fmt.Errorf("container has no address of the same family as %s in network %s", pm.HostIP, ep.Network)
+		}
+	}
+	return nil
+}
+
+// 通过 iptables 或 ip6tables 将端口发布到宿主机的一种地址族上
+func publishPort(containerID string, bridge string, ipt string, containerIP net.IP, pm *config.PortMapping) error {
+	backend := net.JoinHostPort(containerIP.String(), strconv.Itoa(pm.ContainerPort))
+	proxy, err := newPortProxy(pm.Protocol, ipt == ip6tables, pm.HostIP, pm.HostPort, backend)
+	if err != nil {
+		return err
+	}
+	proxiesMu.Lock()
+	proxies[containerID] = append(proxies[containerID], proxy)
+	proxiesMu.Unlock()
+	pm.HostPort = proxy.Port()
+
+	if iptablesAvailable(ipt) {
+		if err := ensurePortChain(ipt); err != nil {
+			return err
+		}
+		if err := ensureRule(ipt, append([]string{"-t", "nat", portChain}, dnatRule(containerID, bridge, containerIP, pm)...)); err != nil {
+			return err
+		}
+	} else {
+		log.Warnf("%s not found, published port %s is only served by the userland proxy", ipt, pm)
+	}
+	log.Debugf("Published port %s of container %s to %s", pm, containerID, backend)
+	return nil
+}
+
+// 撤销容器发布的端口：关闭当前进程中的代理，并删除属于该容器的 DNAT 规则
+// 规则通过注释中的容器 ID 查找，因此也能删除管理容器的进程异常退出后残留的规则
+func UnpublishPorts(containerID string) {
+	proxiesMu.Lock()
+	for _, proxy := range proxies[containerID] {
+		proxy.Close()
+	}
+	delete(proxies, containerID)
+	proxiesMu.Unlock()
+
+	for _, ipt := range []string{iptables, ip6tables} {
+		if !iptablesAvailable(ipt) {
+			continue
+		}
+		rules, err := listPortRules(ipt)
+		if err != nil {
+			log.Warnf("failed to list port rules: %v", err)
+			continue
+		}
+		for _, rule := range rules {
+			if ruleOwner(rule) != containerID {
+				continue
+			}
+			args := append([]string{"-t", "nat", "-D", portChain}, rule...)
+			if output, err := exec.Command(ipt, args...).CombinedOutput(); err != nil {
+				log.Warnf("failed to delete port rule of container %s: %v: %s", containerID, err, strings.TrimSpace(string(output)))
+			}
+		}
+	}
+}
+
+// 列出所有端口映射规则所属的容器 ID
+func PublishedContainers() ([]string, error) {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, ipt := range []string{iptables, ip6tables} {
+		if !iptablesAvailable(ipt) {
+			continue
+		}
+		rules, err := listPortRules(ipt)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			if id := ruleOwner(rule); id != "" && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// 创建端口映射的链，并从 PREROUTING 和 OUTPUT 跳转到该链，只处理目的地址为本机的流量
+// OUTPUT 中排除了回环地址，发往回环地址的流量由用户态代理处理
+func ensurePortChain(ipt string) error {
+	if err := ensureChain(ipt, "nat", portChain); err != nil {
+		return err
+	}
+	loopback := "127.0.0.0/8"
+	if ipt == ip6tables {
+		loopback = "::1/128"
+	}
+	rules := [][]string{
+		{"-t", "nat", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", portChain},
+		{"-t", "nat", "OUTPUT", "!", "-d", loopback, "-m", "addrtype", "--dst-type", "LOCAL", "-j", portChain},
+	}
+	for _, rule := range rules {
+		if err := ensureRule(ipt, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 生成端口映射的 DNAT 规则，来自网桥的流量不做处理，由代理转发
+// CNI 网络没有由 m-docker 管理的网桥，不排除入口设备
+func dnatRule(containerID string, bridge string, containerIP net.IP, pm *config.PortMapping) []string {
+	rule := []string{"-p", pm.Protocol}
+	if hostIP := net.ParseIP(pm.HostIP); hostIP != nil {
+		if hostIP.To4() != nil {
+			rule = append(rule, "-d", pm.HostIP+"/32")
+		} else {
+			rule = append(rule, "-d", pm.HostIP+"/128")
+		}
+	}
+	if bridge != "" {
+		rule = append(rule, "!", "-i", bridge)
+	}
+	rule = append(rule, "-m", pm.Protocol, "--dport", strconv.Itoa(pm.HostPort),
+		"-m", "comment", "--comment", ruleCommentPrefix+containerID,
+		"-j", "DNAT", "--to-destination", net.JoinHostPort(containerIP.String(), strconv.Itoa(pm.ContainerPort)))
+	return rule
+}
+
+// 列出端口映射链中的所有规则，每条规则为去掉 -A [chain] 之后的参数
+func listPortRules(ipt string) ([][]string, error) {
+	output, err := exec.Command(ipt, "-t", "nat", "-S", portChain).CombinedOutput()
+	if err != nil {
+		// 链不存在说明还没有发布过端口
+		if strings.Contains(string(output), "No chain") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s -S %s: %v: %s", ipt, portChain, err, strings.TrimSpace(string(output)))
+	}
+	var rules [][]string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" || fields[1] != portChain {
+			continue
+		}
+		rule := fields[2:]
+		for i := range rule {
+			rule[i] = strings.Trim(rule[i], `"`)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// 根据规则的注释获取规则所属的容器 ID
+func ruleOwner(rule []string) string {
+	for i := 0; i+1 < len(rule); i++ {
+		if rule[i] == "--comment" && strings.HasPrefix(rule[i+1], ruleCommentPrefix) {
+			return strings.TrimPrefix(rule[i+1], ruleCommentPrefix)
+		}
+	}
+	return ""
+}
+
+// 宿主机上是否有 iptables 或 ip6tables
+func iptablesAvailable(ipt string) bool {
+	_, err := exec.LookPath(ipt)
+	return err == nil
+}
@@ -0,0 +1,188 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UDP 会话在没有流量后保留的时间
+const udpConnTimeout = 90 * time.Second
+
+// 用户态的端口代理，将宿主机端口上收到的流量转发到容器中
+// 发往 127.0.0.1 的流量不会经过 iptables 的 DNAT，宿主机没有 iptables 时也只能通过代理访问容器
+// 代理运行在管理容器生命周期的 m-docker 进程中，该进程退出时监听的端口随之释放
+type portProxy interface {
+	// 代理实际监听的端口
+	Port() int
+
+	Close() error
+}
+
+// 在宿主机上监听 hostIP:hostPort 并转发到 backend，hostPort 为 0 时由内核随机分配
+// ipv6 为 true 时只监听 IPv6 地址，hostIP 为空时 IPv4 和 IPv6 分别使用一个代理监听同一个端口
+func newPortProxy(protocol string, ipv6 bool, hostIP string, hostPort int, backend string) (portProxy, error) {
+	addr := net.JoinHostPort(hostIP, fmt.Sprint(hostPort))
+	family := "4"
+	if ipv6 {
+		family = "6"
+	}
+	switch protocol {
+	case "tcp":
+		listener, err := net.Listen("tcp"+family, addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s/tcp: %v", addr, err)
+		}
+		p := &tcpProxy{listener: listener, backend: backend}
+		go p.run()
+		return p, nil
+	case "udp":
+		udpAddr, err := net.ResolveUDPAddr("udp"+family, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp"+family, udpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s/udp: %v", addr, err)
+		}
+		p := &udpProxy{conn: conn, backend: backend, sessions: make(map[string]*net.UDPConn)}
+		go p.run()
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+}
+
+// TCP 代理，为每个连接建立到容器的连接并双向拷贝数据
+type tcpProxy struct {
+	listener net.Listener
+	backend  string
+}
+
+func (p *tcpProxy) Port() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (p *tcpProxy) Close() error {
+	return p.listener.Close()
+}
+
+func (p *tcpProxy) run() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			// 监听的端口被关闭
+			return
+		}
+		go p.serve(client)
+	}
+}
+
+func (p *tcpProxy) serve(client net.Conn) {
+	defer client.Close()
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		log.Debugf("proxy: failed to connect to %s: %v", p.backend, err)
+		return
+	}
+	defer backend.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		// 一端读完后关闭另一端的写方向，让对方感知到 EOF
+		if conn, ok := dst.(*net.TCPConn); ok {
+			_ = conn.CloseWrite()
+		}
+	}
+	go pipe(backend, client)
+	go pipe(client, backend)
+	wg.Wait()
+}
+
+// UDP 代理，为每个客户端地址建立一个到容器的 UDP 会话
+type udpProxy struct {
+	conn    *net.UDPConn
+	backend string
+
+	mu       sync.Mutex
+	sessions map[string]*net.UDPConn
+}
+
+func (p *udpProxy) Port() int {
+	return p.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (p *udpProxy) Close() error {
+	err := p.conn.Close()
+	p.mu.Lock()
+	for key, session := range p.sessions {
+		session.Close()
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+	return err
+}
+
+func (p *udpProxy) run() {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		session, err := p.session(client)
+		if err != nil {
+			log.Debugf("proxy: failed to connect to %s: %v", p.backend, err)
+			continue
+		}
+		_ = session.SetReadDeadline(time.Now().Add(udpConnTimeout))
+		_, _ = session.Write(buf[:n])
+	}
+}
+
+// 获取客户端对应的会话，不存在时新建，并将容器的回复转发给客户端
+func (p *udpProxy) session(client *net.UDPAddr) (*net.UDPConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if session, ok := p.sessions[client.String()]; ok {
+		return session, nil
+	}
+
+	backend, err := net.ResolveUDPAddr("udp", p.backend)
+	if err != nil {
+		return nil, err
+	}
+	session, err := net.DialUDP("udp", nil, backend)
+	if err != nil {
+		return nil, err
+	}
+	p.sessions[client.String()] = session
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			_ = session.SetReadDeadline(time.Now().Add(udpConnTimeout))
+			n, err := session.Read(buf)
+			if err != nil {
+				break
+			}
+			if _, err := p.conn.WriteToUDP(buf[:n], client); err != nil {
+				break
+			}
+		}
+		p.mu.Lock()
+		if p.sessions[client.String()] == session {
+			delete(p.sessions, client.String())
+		}
+		p.mu.Unlock()
+		session.Close()
+	}()
+	return session, nil
+}
@@ -9,14 +9,40 @@
 #include <sys/syscall.h>
 
 char ENV_SETNS_PID[] = "SETNS_PID";
+char ENV_SETNS_NET_PID[] = "SETNS_NET_PID";
 
 // 打开指定进程的进程文件描述符（pidfd）
 static int pidfd_open(pid_t pid, unsigned int flags){
     return syscall(SYS_pidfd_open, pid, flags);
 }
 
+// 将当前进程加入到指定进程的 network namespace 中，用于 container:[id] 网络模式
+// 只切换 network namespace 不需要 fork，其它 namespace 仍由 clone 创建
+static void netnsenter(){
+    char *pid = getenv(ENV_SETNS_NET_PID);
+    if (!pid) {
+        return;
+    }
+
+    int pidfd = pidfd_open(atoi(pid), 0);
+    if (pidfd < 0){
+        fprintf(stderr, "pidfd_open failed: %s\n", strerror(errno));
+        exit(EXIT_FAILURE);
+    }
+    if (setns(pidfd, CLONE_NEWNET) != 0) {
+        fprintf(stderr, "setns to netns of pid %s failed: %s\n", pid, strerror(errno));
+        exit(EXIT_FAILURE);
+    }
+    close(pidfd);
+
+    // 不再传递给容器中运行的命令
+    unsetenv(ENV_SETNS_NET_PID);
+}
+
 // nsenter() 函数将当前进程加入到指定的 namespace 中
 void nsenter(){
+    netnsenter();
+
     char *pid;
     pid = getenv(ENV_SETNS_PID);
     if(pid){
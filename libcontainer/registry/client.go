@@ -0,0 +1,219 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/image"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+)
+
+// registry 客户端，实现 OCI distribution 规范中拉取和推送镜像所需的接口
+type Client struct {
+	// 发送请求所使用的 http 客户端
+	HTTPClient *http.Client
+
+	// 使用 http 而不是 https 访问 registry
+	PlainHTTP bool
+
+	// basic 认证以及获取 bearer token 时使用的用户名和密码，为空时匿名访问
+	Username string
+	Password string
+
+	// 从 manifest list 中选择镜像时使用的平台
+	Platform image.Platform
+
+	// 拉取和推送的进度输出
+	Out io.Writer
+
+	// 各个仓库已经获取到的 Authorization 头，避免每个请求都重新认证
+	authorizations map[string]string
+}
+
+// 创建 registry 客户端，默认选择与当前系统相同的平台
+func NewClient() *Client {
+	return &Client{
+		HTTPClient: http.DefaultClient,
+		Platform: image.Platform{
+			OS:           runtime.GOOS,
+			Architecture: runtime.GOARCH,
+		},
+		Out:            io.Discard,
+		authorizations: make(map[string]string),
+	}
+}
+
+// 拼接 registry API 的 url
+func (c *Client) url(ref *Reference, format string, a ...interface{}) string {
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, ref.apiHost(), ref.Repository, fmt.Sprintf(format, a...))
+}
+
+// 发送请求，registry 要求认证时根据 WWW-Authenticate 头完成认证后重试一次
+// actions 为请求所需的仓库权限，如 pull 或 pull,push
+func (c *Client) do(ref *Reference, req *http.Request, actions string) (*http.Response, error) {
+	key := ref.apiHost() + "/" + ref.Repository
+	if auth, ok := c.authorizations[key]; ok {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	auth, err := c.authorize(challenge, fmt.Sprintf("repository:%s:%s", ref.Repository, actions))
+	if err != nil {
+		return nil, fmt.Errorf("failed to authorize to %s: %v", ref.apiHost(), err)
+	}
+	c.authorizations[key] = auth
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("can not retry %s %s", req.Method, req.URL)
+		}
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", auth)
+	return c.HTTPClient.Do(retry)
+}
+
+// 根据 WWW-Authenticate 头生成 Authorization 头
+// Basic 认证直接使用用户名和密码，Bearer 认证则需要先从认证服务获取 token
+func (c *Client) authorize(challenge string, scope string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.Username == "" {
+			return "", fmt.Errorf("username and password required")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)), nil
+	case "bearer":
+		token, err := c.fetchToken(params, scope)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge: %q", challenge)
+	}
+}
+
+// 从认证服务获取 bearer token
+func (c *Client) fetchToken(params map[string]string, scope string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm: %q", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Add("scope", scope)
+	if s := params["scope"]; s != "" && s != scope {
+		query.Add("scope", s)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch token: %v", responseError(resp))
+	}
+
+	// 不同的认证服务可能使用 token 或 access_token 字段
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %v", err)
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", fmt.Errorf("no token in response")
+}
+
+// 解析 WWW-Authenticate 头，如 Bearer realm="https://auth.example.com/token",service="registry"
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := make(map[string]string)
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			// 带引号的值中可能包含 ',' 和转义字符
+			var sb strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				sb.WriteByte(value[i])
+			}
+			params[key] = sb.String()
+			if i < len(value) {
+				i++
+			}
+			rest = value[i:]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(value)
+		}
+	}
+	return scheme, params
+}
+
+// registry 返回的错误信息
+type errorResponse struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// 将非预期的响应转换为错误，尽量带上 registry 返回的错误信息
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	errResp := new(errorResponse)
+	if json.Unmarshal(body, errResp) == nil && len(errResp.Errors) > 0 {
+		msgs := make([]string, 0, len(errResp.Errors))
+		for _, e := range errResp.Errors {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL, resp.Status, strings.Join(msgs, "; "))
+	}
+	return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+}
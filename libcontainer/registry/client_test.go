@@ -0,0 +1,408 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testRepository = "test/app"
+	testUsername   = "user"
+	testPassword   = "secret"
+	testToken      = "test-token"
+)
+
+// 测试使用的 registry，在内存中保存 manifest 和 blob，按需要求 Basic 或 Bearer 认证
+type fakeRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	auth      string
+	manifests map[string]fakeManifest
+	blobs     map[string][]byte
+	uploads   map[string][]byte
+	nextID    int
+
+	// 对返回的内容做修改，用于模拟内容或 Docker-Content-Digest 头与摘要不一致的 registry
+	corrupt      bool
+	digestHeader string
+
+	// 收到的请求，如 "PATCH /v2/test/app/blobs/uploads/1 0-9"，PATCH 请求带有 Content-Range
+	requests []string
+
+	// 认证服务收到的 scope
+	scopes []string
+}
+
+type fakeManifest struct {
+	mediaType string
+	data      []byte
+}
+
+// 启动测试使用的 registry，auth 为 ""、"basic" 或 "bearer"
+func newFakeRegistry(t *testing.T, auth string) *fakeRegistry {
+	r := &fakeRegistry{
+		auth:      auth,
+		manifests: make(map[string]fakeManifest),
+		blobs:     make(map[string][]byte),
+		uploads:   make(map[string][]byte),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", r.serveToken)
+	mux.HandleFunc("/v2/", r.serveRegistry)
+	r.Server = httptest.NewServer(mux)
+	t.Cleanup(r.Close)
+	return r
+}
+
+// 创建访问测试 registry 的客户端
+func (r *fakeRegistry) client() *Client {
+	c := NewClient()
+	c.PlainHTTP = true
+	c.Platform = image.Platform{OS: "linux", Architecture: "amd64"}
+	return c
+}
+
+// 测试 registry 中 reference 对应的镜像引用
+func (r *fakeRegistry) ref(t *testing.T, reference string) *Reference {
+	sep := ":"
+	if strings.Contains(reference, ":") {
+		sep = "@"
+	}
+	ref, err := ParseReference(strings.TrimPrefix(r.URL, "http://") + "/" + testRepository + sep + reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func (r *fakeRegistry) addManifest(mediaType string, data []byte, tags ...string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	digest := image.DigestBytes(data)
+	for _, ref := range append(tags, digest) {
+		r.manifests[ref] = fakeManifest{mediaType: mediaType, data: data}
+	}
+	return digest
+}
+
+func (r *fakeRegistry) addBlob(data []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	digest := image.DigestBytes(data)
+	r.blobs[digest] = data
+	return digest
+}
+
+func (r *fakeRegistry) blob(digest string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, ok := r.blobs[digest]
+	return data, ok
+}
+
+func (r *fakeRegistry) requestLog() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.requests...)
+}
+
+// 认证服务，校验用户名和密码后为 scope 签发 token
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.scopes = append(r.scopes, req.URL.Query()["scope"]...)
+	r.mu.Unlock()
+	if user, pass, ok := req.BasicAuth(); !ok || user != testUsername || pass != testPassword {
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Query().Get("service") != "fake-registry" {
+		http.Error(w, "unknown service", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+}
+
+// 校验请求的认证信息，失败时返回 401 和对应的 WWW-Authenticate 头
+func (r *fakeRegistry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	switch r.auth {
+	case "basic":
+		if user, pass, ok := req.BasicAuth(); ok && user == testUsername && pass == testPassword {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake-registry"`)
+	case "bearer":
+		if req.Header.Get("Authorization") == "Bearer "+testToken {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry"`, r.URL))
+	default:
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprint(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`)
+	return false
+}
+
+func (r *fakeRegistry) serveRegistry(w http.ResponseWriter, req *http.Request) {
+	entry := req.Method + " " + req.URL.Path
+	if req.Method == http.MethodPatch {
+		entry += " " + req.Header.Get("Content-Range")
+	}
+	r.mu.Lock()
+	r.requests = append(r.requests, entry)
+	r.mu.Unlock()
+	if !r.authorized(w, req) {
+		return
+	}
+
+	prefix := "/v2/" + testRepository + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		http.NotFound(w, req)
+		return
+	}
+	rest := strings.TrimPrefix(req.URL.Path, prefix)
+	switch {
+	case strings.HasPrefix(rest, "manifests/"):
+		r.serveManifest(w, req, strings.TrimPrefix(rest, "manifests/"))
+	case strings.HasPrefix(rest, "blobs/uploads/"):
+		r.serveUpload(w, req, strings.TrimPrefix(rest, "blobs/uploads/"))
+	case strings.HasPrefix(rest, "blobs/"):
+		r.serveBlob(w, req, strings.TrimPrefix(rest, "blobs/"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, reference string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch req.Method {
+	case http.MethodGet:
+		m, ok := r.manifests[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		data := m.data
+		if r.corrupt {
+			data = append(append([]byte{}, data...), ' ')
+		}
+		digest := image.DigestBytes(m.data)
+		if r.digestHeader != "" {
+			digest = r.digestHeader
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write(data)
+	case http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		digest := image.DigestBytes(data)
+		r.manifests[reference] = fakeManifest{mediaType: req.Header.Get("Content-Type"), data: data}
+		r.manifests[digest] = r.manifests[reference]
+		if r.digestHeader != "" {
+			digest = r.digestHeader
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, digest string) {
+	r.mu.Lock()
+	data, ok := r.blobs[digest]
+	r.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.corrupt {
+		data = append([]byte{data[0] ^ 0xff}, data[1:]...)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Docker-Content-Digest", digest)
+	switch req.Method {
+	case http.MethodHead:
+	case http.MethodGet:
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// 上传会话，返回的 Location 都是不带 scheme 和 host 的相对地址
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	location := func(id string) string {
+		return fmt.Sprintf("/v2/%s/blobs/uploads/%s?_state=%d", testRepository, id, len(r.uploads[id]))
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		r.nextID++
+		id := strconv.Itoa(r.nextID)
+		r.uploads[id] = nil
+		w.Header().Set("Location", location(id))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case http.MethodPatch, http.MethodPut:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data, ok := r.uploads[id]
+	if !ok || req.URL.Query().Get("_state") != strconv.Itoa(len(data)) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"code":"BLOB_UPLOAD_UNKNOWN","message":"blob upload unknown"}]}`)
+		return
+	}
+	chunk, _ := io.ReadAll(req.Body)
+
+	if req.Method == http.MethodPatch {
+		// 每块的 Content-Range 必须紧接着已经上传的数据
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil ||
+			start != len(data) || end != start+len(chunk)-1 {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.uploads[id] = append(data, chunk...)
+		w.Header().Set("Location", location(id))
+		w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	data = append(data, chunk...)
+	digest := req.URL.Query().Get("digest")
+	if image.DigestBytes(data) != digest {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"provided digest did not match uploaded content"}]}`)
+		return
+	}
+	delete(r.uploads, id)
+	r.blobs[digest] = data
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// 生成随机内容，保证测试写入本地内容存储的 blob 不会与已有的 blob 相同
+func randomBytes(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// 测试结束后从本地内容存储中删除 blob
+// 内容存储位于 m-docker 的数据目录中，写入需要 root 权限
+func cleanupBlob(t *testing.T, digest string) {
+	t.Cleanup(func() {
+		os.Remove(image.BlobPath(digest))
+	})
+}
+
+func requireRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to write the content store")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a/b:pull,push"`)
+	if scheme != "Bearer" {
+		t.Errorf("scheme = %q", scheme)
+	}
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:a/b:pull,push",
+	}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("%s = %q, want %q", k, params[k], v)
+		}
+	}
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	if scheme != "Basic" || params["realm"] != "registry" {
+		t.Errorf("scheme = %q, params = %v", scheme, params)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "basic")
+	data := randomBytes(t, 64)
+	digest := r.addBlob(data)
+	cleanupBlob(t, digest)
+	desc := image.Descriptor{Digest: digest, Size: int64(len(data))}
+
+	c := r.client()
+	if err := c.fetchBlob(r.ref(t, "latest"), desc); err == nil || !strings.Contains(err.Error(), "username and password required") {
+		t.Fatalf("anonymous fetch error = %v", err)
+	}
+
+	c.Username, c.Password = testUsername, testPassword
+	if err := c.fetchBlob(r.ref(t, "latest"), desc); err != nil {
+		t.Fatalf("fetchBlob: %v", err)
+	}
+	if !image.HasBlob(digest) {
+		t.Fatal("blob is not stored")
+	}
+	// 认证后的 Authorization 头会被缓存，之后的请求不再收到 401
+	if exists, err := c.blobExists(r.ref(t, "latest"), digest); err != nil || !exists {
+		t.Fatalf("blobExists = %v, %v", exists, err)
+	}
+	want := []string{
+		"GET /v2/test/app/blobs/" + digest,
+		"GET /v2/test/app/blobs/" + digest,
+		"GET /v2/test/app/blobs/" + digest,
+		"HEAD /v2/test/app/blobs/" + digest,
+	}
+	if got := r.requestLog(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests = %v, want %v", got, want)
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "bearer")
+	data := randomBytes(t, 64)
+	digest := r.addBlob(data)
+	cleanupBlob(t, digest)
+
+	c := r.client()
+	c.Username, c.Password = testUsername, testPassword
+	if exists, err := c.blobExists(r.ref(t, "latest"), digest); err != nil || !exists {
+		t.Fatalf("blobExists = %v, %v", exists, err)
+	}
+	if err := c.fetchBlob(r.ref(t, "latest"), image.Descriptor{Digest: digest, Size: int64(len(data))}); err != nil {
+		t.Fatalf("fetchBlob: %v", err)
+	}
+	// token 只获取一次，scope 为第一个请求所需的权限
+	if len(r.scopes) != 1 || r.scopes[0] != "repository:test/app:pull,push" {
+		t.Errorf("scopes = %v", r.scopes)
+	}
+
+	c = r.client()
+	c.Username, c.Password = testUsername, "wrong"
+	if _, err := c.blobExists(r.ref(t, "latest"), digest); err == nil || !strings.Contains(err.Error(), "failed to fetch token") {
+		t.Errorf("blobExists with wrong password error = %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/image"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// manifest 的大小上限，避免恶意的 registry 返回过大的响应
+const maxManifestSize = 4 * 1024 * 1024
+
+// 拉取 manifest 时接受的所有格式
+var manifestMediaTypes = []string{
+	image.MediaTypeOCIManifest,
+	image.MediaTypeOCIIndex,
+	image.MediaTypeDockerManifest,
+	image.MediaTypeDockerManifestList,
+}
+
+// 从 registry 拉取镜像，写入本地的内容存储，并以 name 作为镜像名称保存
+// manifest list 会根据 Platform 选择对应的镜像，所有内容在写入时都会校验摘要
+func (c *Client) Pull(name string) (*image.Image, error) {
+	ref, err := ParseReference(name)
+	if err != nil {
+		return nil, err
+	}
+	// 镜像层在保存镜像之前没有被引用，需要一直持有镜像存储的共享锁
+	unlock, err := image.LockStore()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	fmt.Fprintf(c.Out, "%s: Pulling from %s\n", ref.manifestRef(), ref.Repository)
+
+	desc, err := c.fetchManifest(ref, ref.manifestRef())
+	if err != nil {
+		return nil, err
+	}
+	topDigest := desc.Digest
+	if desc.MediaType == image.MediaTypeOCIIndex || desc.MediaType == image.MediaTypeDockerManifestList {
+		if desc, err = c.selectManifest(ref, desc); err != nil {
+			return nil, err
+		}
+	}
+	if desc.MediaType != image.MediaTypeOCIManifest && desc.MediaType != image.MediaTypeDockerManifest {
+		return nil, fmt.Errorf("unsupported manifest media type: %s", desc.MediaType)
+	}
+
+	manifest := new(image.Manifest)
+	if err := image.ReadJSONBlob(desc, manifest); err != nil {
+		return nil, err
+	}
+	if err := c.fetchBlob(ref, manifest.Config); err != nil {
+		return nil, fmt.Errorf("failed to fetch config: %v", err)
+	}
+	config := new(image.OCIConfig)
+	if err := image.ReadJSONBlob(manifest.Config, config); err != nil {
+		return nil, err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("config has %d diff_ids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	// 依次下载并解压各个镜像层，已经存在的镜像层直接复用
+	img := &image.Image{
+		Name:    name,
+		Config:  config.Config,
+		Created: config.Created,
+		History: config.History,
+	}
+	parent := ""
+	for i, layerDesc := range manifest.Layers {
+		diffID := config.RootFS.DiffIDs[i]
+		id := shortDigest(layerDesc.Digest)
+		if layer, err := image.GetLayer(image.ChainID(parent, diffID)); err == nil {
+			fmt.Fprintf(c.Out, "%s: Already exists\n", id)
+			img.Layers = append(img.Layers, layer.DiffID)
+			parent = layer.ChainID
+			continue
+		}
+
+		switch layerDesc.MediaType {
+		case image.MediaTypeOCILayer, image.MediaTypeOCILayerGz, image.MediaTypeDockerLayer:
+		default:
+			return nil, fmt.Errorf("unsupported layer media type: %s", layerDesc.MediaType)
+		}
+		if err := c.fetchBlob(ref, layerDesc); err != nil {
+			return nil, fmt.Errorf("failed to fetch layer %s: %v", layerDesc.Digest, err)
+		}
+		fmt.Fprintf(c.Out, "%s: Download complete\n", id)
+		layer, err := image.CreateLayerFromBlob(parent, layerDesc, diffID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract layer %s: %v", layerDesc.Digest, err)
+		}
+		fmt.Fprintf(c.Out, "%s: Pull complete\n", id)
+		img.Layers = append(img.Layers, layer.DiffID)
+		parent = layer.ChainID
+	}
+
+	if err := image.SaveImage(img); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(c.Out, "Digest: %s\n", topDigest)
+	return img, nil
+}
+
+// 拉取 manifest 或 manifest list 并写入内容存储，返回其描述符
+// reference 为 tag 或摘要，为摘要时校验内容是否一致
+func (c *Client) fetchManifest(ref *Reference, reference string) (image.Descriptor, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url(ref, "manifests/%s", reference), nil)
+	if err != nil {
+		return image.Descriptor{}, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := c.do(ref, req, "pull")
+	if err != nil {
+		return image.Descriptor{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return image.Descriptor{}, fmt.Errorf("failed to fetch manifest %s: %v", reference, responseError(resp))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("failed to read manifest %s: %v", reference, err)
+	}
+	if len(data) > maxManifestSize {
+		return image.Descriptor{}, fmt.Errorf("manifest %s is too large", reference)
+	}
+
+	digest := image.DigestBytes(data)
+	if strings.Contains(reference, ":") && reference != digest {
+		return image.Descriptor{}, fmt.Errorf("manifest digest mismatch: expected %s, got %s", reference, digest)
+	}
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" && header != digest {
+		return image.Descriptor{}, fmt.Errorf("manifest digest mismatch: registry reported %s, got %s", header, digest)
+	}
+
+	// 优先使用 manifest 中的 mediaType 字段，没有时使用响应的 Content-Type
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return image.Descriptor{}, fmt.Errorf("failed to decode manifest %s: %v", reference, err)
+	}
+	mediaType := versioned.MediaType
+	if mediaType == "" {
+		mediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	}
+
+	if _, err := image.WriteBlobBytes(data); err != nil {
+		return image.Descriptor{}, err
+	}
+	return image.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest,
+		Size:      int64(len(data)),
+	}, nil
+}
+
+// 从 manifest list 中选择与 Platform 一致的镜像，并拉取其 manifest
+func (c *Client) selectManifest(ref *Reference, desc image.Descriptor) (image.Descriptor, error) {
+	index := new(image.Index)
+	if err := image.ReadJSONBlob(desc, index); err != nil {
+		return image.Descriptor{}, err
+	}
+	for _, m := range index.Manifests {
+		p := m.Platform
+		if p == nil || p.OS != c.Platform.OS || p.Architecture != c.Platform.Architecture {
+			continue
+		}
+		if c.Platform.Variant != "" && p.Variant != c.Platform.Variant {
+			continue
+		}
+		return c.fetchManifest(ref, m.Digest)
+	}
+	return image.Descriptor{}, fmt.Errorf("no manifest for platform %s/%s in %s", c.Platform.OS, c.Platform.Architecture, desc.Digest)
+}
+
+// 下载 blob 并写入内容存储，写入时校验其摘要和大小，已经存在的 blob 不会重复下载
+func (c *Client) fetchBlob(ref *Reference, desc image.Descriptor) error {
+	if image.HasBlob(desc.Digest) {
+		return nil
+	}
+	if _, err := image.ParseDigest(desc.Digest); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, c.url(ref, "blobs/%s", desc.Digest), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ref, req, "pull")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	// 多读取一个字节，以便发现比描述符中更大的 blob
+	_, size, err := image.WriteBlob(io.LimitReader(resp.Body, desc.Size+1), desc.Digest)
+	if err != nil {
+		return err
+	}
+	if size != desc.Size {
+		return fmt.Errorf("size mismatch: expected %d, got %d", desc.Size, size)
+	}
+	return nil
+}
+
+// 获取摘要十六进制部分的前 12 位，用于输出
+func shortDigest(digest string) string {
+	hexStr, err := image.ParseDigest(digest)
+	if err != nil {
+		return digest
+	}
+	return hexStr[:12]
+}
@@ -0,0 +1,193 @@
+package registry
+
+import (
+	"encoding/json"
+	"m-docker/libcontainer/image"
+	"os"
+	"strings"
+	"testing"
+)
+
+// 在测试 registry 中添加 manifest，并在测试结束后从本地内容存储中删除
+func addTestManifest(t *testing.T, r *fakeRegistry, mediaType string, v interface{}, tags ...string) (string, []byte) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := r.addManifest(mediaType, data, tags...)
+	cleanupBlob(t, digest)
+	return digest, data
+}
+
+// 带有一个随机 config 的 manifest，保证每个测试的 manifest 摘要都不同
+func testManifest(t *testing.T, r *fakeRegistry) *image.Manifest {
+	config := randomBytes(t, 32)
+	return &image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIManifest,
+		Config:        image.Descriptor{MediaType: image.MediaTypeOCIConfig, Digest: r.addBlob(config), Size: int64(len(config))},
+	}
+}
+
+func TestFetchManifest(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	digest, data := addTestManifest(t, r, image.MediaTypeOCIManifest, testManifest(t, r), "1.0")
+
+	desc, err := r.client().fetchManifest(r.ref(t, "1.0"), "1.0")
+	if err != nil {
+		t.Fatalf("fetchManifest: %v", err)
+	}
+	if desc.Digest != digest || desc.Size != int64(len(data)) || desc.MediaType != image.MediaTypeOCIManifest {
+		t.Errorf("descriptor = %+v", desc)
+	}
+	stored, err := os.ReadFile(image.BlobPath(digest))
+	if err != nil || string(stored) != string(data) {
+		t.Errorf("manifest is not stored: %v", err)
+	}
+}
+
+func TestFetchManifestMediaTypeFromHeader(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	m := testManifest(t, r)
+	m.MediaType = ""
+	addTestManifest(t, r, image.MediaTypeDockerManifest+"; charset=utf-8", m, "1.0")
+
+	desc, err := r.client().fetchManifest(r.ref(t, "1.0"), "1.0")
+	if err != nil {
+		t.Fatalf("fetchManifest: %v", err)
+	}
+	if desc.MediaType != image.MediaTypeDockerManifest {
+		t.Errorf("media type = %q", desc.MediaType)
+	}
+}
+
+func TestFetchManifestDigestMismatch(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	digest, _ := addTestManifest(t, r, image.MediaTypeOCIManifest, testManifest(t, r), "1.0")
+	r.corrupt = true
+
+	_, err := r.client().fetchManifest(r.ref(t, digest), digest)
+	if err == nil || !strings.Contains(err.Error(), "manifest digest mismatch") {
+		t.Fatalf("fetchManifest error = %v", err)
+	}
+	if image.HasBlob(digest) {
+		t.Error("mismatched manifest is stored")
+	}
+}
+
+func TestFetchManifestHeaderMismatch(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	digest, _ := addTestManifest(t, r, image.MediaTypeOCIManifest, testManifest(t, r), "1.0")
+	r.digestHeader = image.DigestBytes([]byte("something else"))
+
+	_, err := r.client().fetchManifest(r.ref(t, "1.0"), "1.0")
+	if err == nil || !strings.Contains(err.Error(), "registry reported "+r.digestHeader) {
+		t.Fatalf("fetchManifest error = %v", err)
+	}
+	if image.HasBlob(digest) {
+		t.Error("mismatched manifest is stored")
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	armDigest, _ := addTestManifest(t, r, image.MediaTypeOCIManifest, testManifest(t, r))
+	amdDigest, amdData := addTestManifest(t, r, image.MediaTypeOCIManifest, testManifest(t, r))
+	index := &image.Index{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIIndex,
+		Manifests: []image.Descriptor{
+			{MediaType: image.MediaTypeOCIManifest, Digest: armDigest, Platform: &image.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+			{MediaType: image.MediaTypeOCIManifest, Digest: amdDigest, Platform: &image.Platform{OS: "linux", Architecture: "amd64"}},
+		},
+	}
+	indexDigest, _ := addTestManifest(t, r, image.MediaTypeOCIIndex, index, "1.0")
+
+	c := r.client()
+	indexDesc, err := c.fetchManifest(r.ref(t, "1.0"), "1.0")
+	if err != nil {
+		t.Fatalf("fetchManifest: %v", err)
+	}
+	if indexDesc.Digest != indexDigest || indexDesc.MediaType != image.MediaTypeOCIIndex {
+		t.Fatalf("index descriptor = %+v", indexDesc)
+	}
+	desc, err := c.selectManifest(r.ref(t, "1.0"), indexDesc)
+	if err != nil {
+		t.Fatalf("selectManifest: %v", err)
+	}
+	if desc.Digest != amdDigest || desc.Size != int64(len(amdData)) {
+		t.Errorf("selected %+v, want linux/amd64 manifest %s", desc, amdDigest)
+	}
+	if image.HasBlob(armDigest) {
+		t.Error("manifest of another platform is fetched")
+	}
+
+	c.Platform = image.Platform{OS: "linux", Architecture: "s390x"}
+	if _, err := c.selectManifest(r.ref(t, "1.0"), indexDesc); err == nil || !strings.Contains(err.Error(), "no manifest for platform linux/s390x") {
+		t.Errorf("selectManifest for a missing platform error = %v", err)
+	}
+}
+
+func TestFetchBlob(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	data := randomBytes(t, 1024)
+	digest := r.addBlob(data)
+	cleanupBlob(t, digest)
+
+	c := r.client()
+	desc := image.Descriptor{Digest: digest, Size: int64(len(data))}
+	if err := c.fetchBlob(r.ref(t, "latest"), desc); err != nil {
+		t.Fatalf("fetchBlob: %v", err)
+	}
+	stored, err := os.ReadFile(image.BlobPath(digest))
+	if err != nil || string(stored) != string(data) {
+		t.Fatalf("blob is not stored: %v", err)
+	}
+	// 已经存在的 blob 不会重复下载
+	if err := c.fetchBlob(r.ref(t, "latest"), desc); err != nil {
+		t.Fatalf("fetchBlob: %v", err)
+	}
+	if n := len(r.requestLog()); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+}
+
+func TestFetchBlobDigestMismatch(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	data := randomBytes(t, 1024)
+	digest := r.addBlob(data)
+	cleanupBlob(t, digest)
+	r.corrupt = true
+
+	err := r.client().fetchBlob(r.ref(t, "latest"), image.Descriptor{Digest: digest, Size: int64(len(data))})
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("fetchBlob error = %v", err)
+	}
+	if image.HasBlob(digest) {
+		t.Error("mismatched blob is stored")
+	}
+}
+
+func TestFetchBlobSizeMismatch(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	data := randomBytes(t, 1024)
+	digest := r.addBlob(data)
+	cleanupBlob(t, digest)
+
+	// 描述符中的大小比实际的小时，只读取 Size+1 个字节，摘要无法匹配
+	err := r.client().fetchBlob(r.ref(t, "latest"), image.Descriptor{Digest: digest, Size: 512})
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("fetchBlob error = %v", err)
+	}
+	if image.HasBlob(digest) {
+		t.Error("truncated blob is stored")
+	}
+}
@@ -0,0 +1,213 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"m-docker/libcontainer/image"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// 分块上传 blob 时每块的默认大小
+const defaultChunkSize = 5 * 1024 * 1024
+
+// 将本地镜像推送到 registry，镜像名称即为推送的目标，如 registry.example.com:5000/app:1.0
+// 依次上传各个镜像层和 config，registry 中已经存在的 blob 会被跳过，最后上传 manifest
+func (c *Client) Push(name string) error {
+	ref, err := ParseReference(name)
+	if err != nil {
+		return err
+	}
+	// 镜像的 config 和 manifest 是临时生成的，上传完成之前不能被清理
+	unlock, err := image.LockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	img, err := image.GetImage(name)
+	if err != nil {
+		return err
+	}
+	manifestDesc, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	manifest := new(image.Manifest)
+	if err := image.ReadJSONBlob(manifestDesc, manifest); err != nil {
+		return err
+	}
+	if ref.Digest != "" && ref.Digest != manifestDesc.Digest {
+		return fmt.Errorf("manifest digest %s does not match reference %s", manifestDesc.Digest, name)
+	}
+
+	fmt.Fprintf(c.Out, "The push refers to repository [%s/%s]\n", ref.Domain, ref.Repository)
+	blobs := append([]image.Descriptor{}, manifest.Layers...)
+	blobs = append(blobs, manifest.Config)
+	for _, desc := range blobs {
+		if err := c.pushBlob(ref, desc); err != nil {
+			return fmt.Errorf("failed to push blob %s: %v", desc.Digest, err)
+		}
+	}
+
+	if err := c.pushManifest(ref, manifestDesc); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.Out, "%s: digest: %s size: %d\n", ref.manifestRef(), manifestDesc.Digest, manifestDesc.Size)
+	return nil
+}
+
+// 上传内容存储中的 blob
+func (c *Client) pushBlob(ref *Reference, desc image.Descriptor) error {
+	id := shortDigest(desc.Digest)
+	exists, err := c.blobExists(ref, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		fmt.Fprintf(c.Out, "%s: Layer already exists\n", id)
+		return nil
+	}
+
+	// 开始一次上传会话
+	req, err := http.NewRequest(http.MethodPost, c.url(ref, "blobs/uploads/"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ref, req, "pull,push")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return responseError(resp)
+	}
+	location, err := uploadLocation(resp)
+	if err != nil {
+		return err
+	}
+	chunkSize := defaultChunkSize
+	if minLength, err := strconv.Atoi(resp.Header.Get("OCI-Chunk-Min-Length")); err == nil && minLength > chunkSize {
+		chunkSize = minLength
+	}
+
+	blob, err := image.OpenBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	// 分块上传，每块都通过 Content-Range 指明其在 blob 中的位置
+	buf := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(blob, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPatch, location.String(), bytes.NewReader(buf[:n]))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(n)-1))
+		resp, err := c.do(ref, req, "pull,push")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return responseError(resp)
+		}
+		if location, err = uploadLocation(resp); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+	if offset != desc.Size {
+		return fmt.Errorf("size mismatch: expected %d, got %d", desc.Size, offset)
+	}
+
+	// 通过摘要完成上传，registry 会校验 blob 的内容
+	query := location.Query()
+	query.Set("digest", desc.Digest)
+	location.RawQuery = query.Encode()
+	req, err = http.NewRequest(http.MethodPut, location.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err = c.do(ref, req, "pull,push")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	fmt.Fprintf(c.Out, "%s: Pushed\n", id)
+	return nil
+}
+
+// 判断 registry 中是否已经存在 blob
+func (c *Client) blobExists(ref *Reference, digest string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, c.url(ref, "blobs/%s", digest), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(ref, req, "pull,push")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError(resp)
+	}
+}
+
+// 上传 manifest，使用引用中的 tag 或摘要
+func (c *Client) pushManifest(ref *Reference, desc image.Descriptor) error {
+	data, err := os.ReadFile(image.BlobPath(desc.Digest))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.url(ref, "manifests/%s", ref.manifestRef()), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", desc.MediaType)
+	resp, err := c.do(ref, req, "pull,push")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to push manifest: %v", responseError(resp))
+	}
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" && header != desc.Digest {
+		return fmt.Errorf("manifest digest mismatch: registry reported %s, expected %s", header, desc.Digest)
+	}
+	return nil
+}
+
+// 获取上传会话的地址，registry 返回的 Location 可能是相对路径
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("missing Location header in upload response")
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload location %q: %v", location, err)
+	}
+	return resp.Request.URL.ResolveReference(u), nil
+}
@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"fmt"
+	"m-docker/libcontainer/image"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 将数据写入本地内容存储，测试结束后删除
+func storeTestBlob(t *testing.T, data []byte) image.Descriptor {
+	digest, err := image.WriteBlobBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanupBlob(t, digest)
+	return image.Descriptor{MediaType: image.MediaTypeOCILayer, Digest: digest, Size: int64(len(data))}
+}
+
+func TestPushBlobChunked(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	// 超过一块的大小，需要分两块上传
+	data := randomBytes(t, defaultChunkSize+100)
+	desc := storeTestBlob(t, data)
+
+	if err := r.client().pushBlob(r.ref(t, "latest"), desc); err != nil {
+		t.Fatalf("pushBlob: %v", err)
+	}
+	stored, ok := r.blob(desc.Digest)
+	if !ok || string(stored) != string(data) {
+		t.Fatal("blob is not uploaded")
+	}
+	want := []string{
+		"HEAD /v2/test/app/blobs/" + desc.Digest,
+		"POST /v2/test/app/blobs/uploads/",
+		fmt.Sprintf("PATCH /v2/test/app/blobs/uploads/1 0-%d", defaultChunkSize-1),
+		fmt.Sprintf("PATCH /v2/test/app/blobs/uploads/1 %d-%d", defaultChunkSize, defaultChunkSize+99),
+		"PUT /v2/test/app/blobs/uploads/1",
+	}
+	if got := r.requestLog(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %v, want %v", got, want)
+	}
+}
+
+func TestPushBlobExists(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	data := randomBytes(t, 64)
+	desc := storeTestBlob(t, data)
+	r.addBlob(data)
+
+	if err := r.client().pushBlob(r.ref(t, "latest"), desc); err != nil {
+		t.Fatalf("pushBlob: %v", err)
+	}
+	if got := r.requestLog(); !reflect.DeepEqual(got, []string{"HEAD /v2/test/app/blobs/" + desc.Digest}) {
+		t.Errorf("requests = %v", got)
+	}
+}
+
+func TestPushBlobWithBearerAuth(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "bearer")
+	desc := storeTestBlob(t, randomBytes(t, 64))
+
+	c := r.client()
+	c.Username, c.Password = testUsername, testPassword
+	if err := c.pushBlob(r.ref(t, "latest"), desc); err != nil {
+		t.Fatalf("pushBlob: %v", err)
+	}
+	if _, ok := r.blob(desc.Digest); !ok {
+		t.Fatal("blob is not uploaded")
+	}
+	if !reflect.DeepEqual(r.scopes, []string{"repository:test/app:pull,push"}) {
+		t.Errorf("scopes = %v", r.scopes)
+	}
+}
+
+func TestPushManifest(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	data := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":%q}`, image.MediaTypeOCIManifest, randomBytes(t, 16)))
+	desc := storeTestBlob(t, data)
+	desc.MediaType = image.MediaTypeOCIManifest
+
+	if err := r.client().pushManifest(r.ref(t, "1.0"), desc); err != nil {
+		t.Fatalf("pushManifest: %v", err)
+	}
+	m, ok := r.manifests["1.0"]
+	if !ok || string(m.data) != string(data) || m.mediaType != image.MediaTypeOCIManifest {
+		t.Errorf("manifest = %+v", m)
+	}
+}
+
+func TestPushManifestDigestMismatch(t *testing.T) {
+	requireRoot(t)
+	r := newFakeRegistry(t, "")
+	desc := storeTestBlob(t, []byte(fmt.Sprintf(`{"schemaVersion":2,"config":%q}`, randomBytes(t, 16))))
+	desc.MediaType = image.MediaTypeOCIManifest
+	r.digestHeader = image.DigestBytes([]byte("something else"))
+
+	err := r.client().pushManifest(r.ref(t, "1.0"), desc)
+	if err == nil || !strings.Contains(err.Error(), "registry reported "+r.digestHeader) {
+		t.Fatalf("pushManifest error = %v", err)
+	}
+}
+
+func TestUploadLocation(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "https://registry.example.com/v2/test/app/blobs/uploads/", nil)
+	tests := map[string]string{
+		"/v2/test/app/blobs/uploads/1?_state=abc": "https://registry.example.com/v2/test/app/blobs/uploads/1?_state=abc",
+		"1?_state=abc": "https://registry.example.com/v2/test/app/blobs/uploads/1?_state=abc",
+		"https://storage.example.com/upload/1?_state=abc": "https://storage.example.com/upload/1?_state=abc",
+	}
+	for location, want := range tests {
+		resp := &http.Response{Header: http.Header{"Location": {location}}, Request: req}
+		u, err := uploadLocation(resp)
+		if err != nil {
+			t.Fatalf("uploadLocation(%q): %v", location, err)
+		}
+		if u.String() != want {
+			t.Errorf("uploadLocation(%q) = %s, want %s", location, u, want)
+		}
+	}
+
+	if _, err := uploadLocation(&http.Response{Header: http.Header{}, Request: req}); err == nil {
+		t.Error("uploadLocation succeeded without a Location header")
+	}
+}
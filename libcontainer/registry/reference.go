@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"fmt"
+	"m-docker/libcontainer/image"
+	"regexp"
+	"strings"
+)
+
+const (
+	// 没有指定 registry 时使用 docker hub
+	defaultDomain = "docker.io"
+
+	// docker hub 的 API 地址与其域名不同
+	defaultAPIHost = "registry-1.docker.io"
+
+	// docker hub 上的官方镜像位于 library 下
+	officialRepoPrefix = "library/"
+
+	defaultTag = "latest"
+)
+
+var (
+	// 仓库名称由若干个以 '/' 分隔的部分组成，每部分只能包含小写字母、数字和分隔符
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRegexp        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// 镜像引用，如 registry.example.com:5000/team/app:1.0 或 ubuntu@sha256:[hex]
+type Reference struct {
+	// registry 的地址，可以带有端口
+	Domain string
+
+	// registry 中的仓库名称
+	Repository string
+
+	Tag    string
+	Digest string
+}
+
+// 解析镜像引用
+// 第一部分包含 '.' 或 ':' 或者为 localhost 时视为 registry 地址，否则使用 docker hub
+// 既没有 tag 也没有摘要时，使用 latest
+func ParseReference(s string) (*Reference, error) {
+	ref := new(Reference)
+	remainder := s
+	if name, digest, ok := strings.Cut(remainder, "@"); ok {
+		if _, err := image.ParseDigest(digest); err != nil {
+			return nil, fmt.Errorf("invalid reference %s: %v", s, err)
+		}
+		ref.Digest = digest
+		remainder = name
+	}
+	if i := strings.LastIndex(remainder, ":"); i > strings.LastIndex(remainder, "/") {
+		ref.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return nil, fmt.Errorf("invalid tag in reference %s", s)
+		}
+	}
+
+	if domain, repo, ok := strings.Cut(remainder, "/"); ok &&
+		(strings.ContainsAny(domain, ".:") || domain == "localhost") {
+		ref.Domain = domain
+		ref.Repository = repo
+	} else {
+		ref.Domain = defaultDomain
+		ref.Repository = remainder
+		if !strings.Contains(remainder, "/") {
+			ref.Repository = officialRepoPrefix + remainder
+		}
+	}
+	if !repositoryRegexp.MatchString(ref.Repository) {
+		return nil, fmt.Errorf("invalid repository name in reference %s", s)
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	return ref, nil
+}
+
+// 获取 registry API 的地址
+func (ref *Reference) apiHost() string {
+	if ref.Domain == defaultDomain {
+		return defaultAPIHost
+	}
+	return ref.Domain
+}
+
+// 获取拉取 manifest 时使用的引用，优先使用摘要
+func (ref *Reference) manifestRef() string {
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+	return ref.Tag
+}
+
+func (ref *Reference) String() string {
+	s := ref.Domain + "/" + ref.Repository
+	if ref.Tag != "" {
+		s += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		s += "@" + ref.Digest
+	}
+	return s
+}
@@ -4,125 +4,126 @@ import (
 	"fmt"
 	"m-docker/libcontainer/config"
 	"m-docker/libcontainer/constant"
+	"m-docker/libcontainer/image"
+	"m-docker/libcontainer/storage"
 	"os"
-	"os/exec"
 	"path"
-	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // 创建容器的 rootfs 目录
 func CreateRootfs(conf *config.Config) error {
-	imagePath := path.Join(constant.RootPath, "images", "ubuntu.tar")
-	imageLayerPath := path.Join(constant.RootPath, "layers", "ubuntu")
+	// 构建镜像时的临时容器没有对应的镜像，而是直接指定了镜像层
+	if len(conf.Layers) == 0 {
+		img, err := image.GetImage(conf.Image)
+		if err != nil {
+			return fmt.Errorf("fail to get image %s: %v", conf.Image, err)
+		}
 
-	// 首先解压镜像
-	if err := unzipImageLayer(imagePath, imageLayerPath); err != nil {
-		return fmt.Errorf("fail to unzip image layer: %v", err)
+		// 镜像层在导入镜像时就已经解压到了 LayerPath 下，这里直接使用
+		layers, err := img.LayerDirs()
+		if err != nil {
+			return fmt.Errorf("fail to get image layers: %v", err)
+		}
+		conf.Layers = layers
 	}
 
-	// 之后准备 overlay 所需要的目录
-	if err := prepareOverlayDir(conf.RwLayer, conf.Rootfs); err != nil {
-		return fmt.Errorf("fail to prepare overlay dir:  %v", err)
+	driver, err := storage.NewStorageDriver(conf.StorageDriver)
+	if err != nil {
+		return err
 	}
 
-	// 最后使用 overlay 将镜像层读写层叠加到 rootfs 上
-	if err := mountRootfs([]string{imageLayerPath}, conf.RwLayer, conf.Rootfs); err != nil {
-		return fmt.Errorf("fail to mount rootfs: %v", err)
+	// 之后由存储驱动准备读写层
+	if err := driver.Create(conf.RwLayer, conf.Layers); err != nil {
+		return fmt.Errorf("fail to create rw layer: %v", err)
 	}
 
-	return nil
-}
-
-// 将镜像解压到指定目录下
-func unzipImageLayer(imagePath string, dest string) error {
-	exist, err := pathExists(dest)
-	if err != nil {
-		return fmt.Errorf("unable to judge whether dir %s exists. %v", dest, err)
+	// 挂载点的父目录由所有容器共享，不存在时创建即可
+	if err := os.MkdirAll(path.Dir(conf.Rootfs), 0755); err != nil {
+		return fmt.Errorf("fail to create dir %s: %v", path.Dir(conf.Rootfs), err)
+	}
+	if err := os.Mkdir(conf.Rootfs, 0755); err != nil {
+		return fmt.Errorf("fail to create dir %s: %v", conf.Rootfs, err)
 	}
 
-	// 镜像不存在
-	if !exist {
-		// 新建目录
-		if err = os.Mkdir(dest, 0755); err != nil {
-			return fmt.Errorf("fail to create dir %s:  %v", dest, err)
-		}
-		// tar -xvf 命令解压镜像
-		if err = exec.Command("tar", "-xvf", imagePath, "-C", dest).Run(); err != nil {
-			return fmt.Errorf("fail to unzip image %v: %v", imagePath, err)
-		}
+	// 最后将镜像层和读写层合并后的文件系统挂载到 rootfs 上
+	if err := driver.Mount(conf.RwLayer, conf.Layers, conf.Rootfs, false); err != nil {
+		return fmt.Errorf("fail to mount rootfs: %v", err)
 	}
-	// 若镜像已经存在，则无需解压，直接返回
-	return nil
-}
 
-// 创建 overlay 所需要的目录
-func prepareOverlayDir(rwLayerPath string, rootfsPath string) error {
-	// 要创建的目录有 4 个
-	// rwLayerPath，upper 和 work 的父目录
-	// rwLayerPath/fs，作为 upper 目录
-	// rwLayerPath/work，作为 work 目录
-	// rootfsPath, 联合挂载点
-	dirs := []string{
-		rwLayerPath,
-		path.Join(rwLayerPath, "fs"),
-		path.Join(rwLayerPath, "work"),
-		rootfsPath,
-	}
-
-	for _, dir := range dirs {
-		if err := os.Mkdir(dir, 0755); err != nil {
-			return fmt.Errorf("fail to create dir %s: %v", dir, err)
-		}
+	// 挂载为容器生成的 hosts、hostname 和 resolv.conf
+	if err := mountContainerFiles(conf); err != nil {
+		return fmt.Errorf("fail to mount container files: %v", err)
 	}
 
 	return nil
 }
 
-// 使用 overlay 进行联合挂载
-func mountRootfs(lowerDir []string, rwLayerDir string, rootfs string) error {
-	// 拼接参数
-	overlayArgs := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
-		strings.Join(lowerDir, ":"),
-		path.Join(rwLayerDir, "fs"),
-		path.Join(rwLayerDir, "work"))
-
-	// 完整命令：mount -t overlay m-docker-overlay lowerdir=xxx,upperdir=xxx,workdir=xxx xxx
-	cmd := exec.Command("mount", "-t", "overlay", "m-docker-overlay", "-o", overlayArgs, rootfs)
-	log.Debugf("Mount overlay command: %v", cmd.String())
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("fail to overlay mount: %v", err)
+// 获取容器的文件系统，即镜像层和读写层合并后的视图，返回其所在的目录以及用于释放的函数
+// 运行中的容器直接使用已经挂载的 rootfs；已经停止的容器则临时挂载到 TmpPath 下
+// readOnly 为 true 时挂载为只读，不会修改容器的读写层
+func MountContainerFS(conf *config.Config, readOnly bool) (string, func(), error) {
+	if conf.Status == constant.ContainerRunning {
+		return conf.Rootfs, func() {}, nil
 	}
 
-	return nil
-}
+	driver, err := storage.NewStorageDriver(conf.StorageDriver)
+	if err != nil {
+		return "", nil, err
+	}
 
-// 当容器退出后，删除 rootfs 相关的目录
-func DeleteRootfs(conf *config.Config) {
-	umountRootfs(conf.Rootfs)
-	deleteOverlayDir(conf.RwLayer, conf.Rootfs)
-}
+	if err := os.MkdirAll(constant.TmpPath, 0755); err != nil {
+		return "", nil, fmt.Errorf("fail to create dir %s: %v", constant.TmpPath, err)
+	}
+	target, err := os.MkdirTemp(constant.TmpPath, "mnt-")
+	if err != nil {
+		return "", nil, fmt.Errorf("fail to create mount point: %v", err)
+	}
+	if err := driver.Mount(conf.RwLayer, conf.Layers, target, readOnly); err != nil {
+		os.Remove(target)
+		return "", nil, err
+	}
 
-// 解除 overlay 挂载
-func umountRootfs(mountPoint string) {
-	_ = exec.Command("umount", mountPoint).Run()
+	release := func() {
+		if err := driver.Unmount(target); err != nil {
+			log.Warnf("%v", err)
+		}
+		os.Remove(target)
+	}
+	return target, release, nil
 }
 
-// 删除 overlay 所准备的目录
-func deleteOverlayDir(rwLayerPath string, rootfsPath string) {
-	_ = os.RemoveAll(rootfsPath)
-	_ = os.RemoveAll(rwLayerPath)
+// 当容器退出后，卸载容器的 rootfs，但保留读写层
+func UmountRootfs(conf *config.Config) {
+	driver, err := storage.NewStorageDriver(conf.StorageDriver)
+	if err != nil {
+		log.Errorf("failed to umount rootfs: %v", err)
+		return
+	}
+	umountContainerFiles(conf)
+	if err := driver.Unmount(conf.Rootfs); err != nil {
+		log.Errorf("failed to umount rootfs: %v", err)
+		return
+	}
+	_ = os.Remove(conf.Rootfs)
 }
 
-// 判断路径目标是否存在
-func pathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true, nil
+// 删除容器时，删除 rootfs 相关的目录
+func DeleteRootfs(conf *config.Config) {
+	driver, err := storage.NewStorageDriver(conf.StorageDriver)
+	if err != nil {
+		log.Errorf("failed to delete rootfs: %v", err)
+		return
+	}
+	umountContainerFiles(conf)
+	// 卸载失败时不能删除挂载点，否则会删除镜像层中的文件
+	if err := driver.Unmount(conf.Rootfs); err != nil {
+		log.Errorf("failed to umount rootfs: %v", err)
+		return
 	}
-	if os.IsNotExist(err) {
-		return false, nil
+	_ = os.RemoveAll(conf.Rootfs)
+	if err := driver.Remove(conf.RwLayer); err != nil {
+		log.Errorf("failed to remove rw layer %s: %v", conf.RwLayer, err)
 	}
-	return false, err
 }
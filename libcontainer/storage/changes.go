@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"m-docker/libcontainer/archive"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 容器中文件的变化类型
+const (
+	ChangeAdd    = "A"
+	ChangeModify = "C"
+	ChangeDelete = "D"
+)
+
+// 容器中的一个文件相对于镜像的变化
+type Change struct {
+	// 文件在容器中的绝对路径
+	Path string `json:"path"`
+
+	// 变化类型，为 A、C 或 D
+	Kind string `json:"kind"`
+}
+
+// 按路径对变化排序
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+}
+
+// 获取路径在镜像中可见的文件，即最上层包含该路径的镜像层中的文件，layers 按照自底向上的顺序排列
+// 从最上层开始查找，途中遇到 whiteout 或 opaque 目录时，下层的同名文件不再可见
+func lookupInLayers(layers []string, rel string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(rel, "/"), "/")
+	for i := len(layers) - 1; i >= 0; i-- {
+		opaque := false
+		cur := layers[i]
+		for j, part := range parts {
+			cur = filepath.Join(cur, part)
+			fi, err := os.Lstat(cur)
+			if err != nil {
+				break
+			}
+			if archive.IsWhiteout(fi) {
+				return "", false
+			}
+			if j == len(parts)-1 {
+				return cur, true
+			}
+			if !fi.IsDir() {
+				return "", false
+			}
+			if archive.IsOpaqueDir(cur) {
+				opaque = true
+			}
+		}
+		// 当前层中的 opaque 目录屏蔽了下层的内容
+		if opaque {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// 判断路径在镜像中是否存在
+func existsInLayers(layers []string, rel string) bool {
+	_, ok := lookupInLayers(layers, rel)
+	return ok
+}
+
+// 获取镜像中目录 rel 下的所有文件名
+func lowerEntries(layers []string, rel string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, layer := range layers {
+		entries, err := os.ReadDir(filepath.Join(layer, rel))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if existsInLayers(layers, filepath.Join(rel, name)) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
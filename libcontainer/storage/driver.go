@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"m-docker/libcontainer/constant"
+	"os"
+	"path"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 支持的存储驱动
+const (
+	// 使用 overlay 将镜像层和读写层联合挂载，镜像层由所有容器共享
+	DriverOverlay = "overlay"
+
+	// 将镜像层完整地复制到读写层中，不依赖 overlay，但每个容器都会占用完整的镜像空间
+	DriverVFS = "vfs"
+)
+
+// StorageDriver 是容器文件系统的抽象接口
+// rwLayer 为容器的读写层目录，layers 为容器所使用的镜像层目录，按照自底向上的顺序排列
+type StorageDriver interface {
+	// 驱动名称
+	Name() string
+
+	// 创建容器的读写层
+	Create(rwLayer string, layers []string) error
+
+	// 将镜像层和读写层合并后的文件系统挂载到 target
+	// readOnly 为 true 时挂载为只读，不会修改容器的读写层
+	Mount(rwLayer string, layers []string, target string, readOnly bool) error
+
+	// 卸载 Mount 所挂载的文件系统
+	Unmount(target string) error
+
+	// 删除容器的读写层
+	Remove(rwLayer string) error
+
+	// 获取读写层相对于镜像层的变化，按路径排序
+	Diff(rwLayer string, layers []string) ([]Change, error)
+
+	// 将读写层相对于镜像层的变化打包为 OCI 格式的镜像层 tar 流写入 w
+	Commit(rwLayer string, layers []string, w io.Writer) error
+}
+
+var (
+	// 通过全局参数指定的存储驱动，为空时自动检测
+	defaultDriver string
+
+	detectOnce     sync.Once
+	detectedDriver string
+)
+
+// 根据名称创建存储驱动
+// 名称为空的容器是在引入存储驱动之前创建的，它们都使用 overlay
+func NewStorageDriver(name string) (StorageDriver, error) {
+	switch name {
+	case DriverOverlay, "":
+		return &overlayDriver{}, nil
+	case DriverVFS:
+		return &vfsDriver{}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %s", name)
+	}
+}
+
+// 设置新建容器所使用的存储驱动，为空时自动检测
+func SetDefaultDriver(name string) error {
+	if name != "" {
+		if _, err := NewStorageDriver(name); err != nil {
+			return err
+		}
+	}
+	defaultDriver = name
+	return nil
+}
+
+// 获取新建容器所使用的存储驱动名称
+// 没有指定时检测当前环境是否支持 overlay，不支持时（如 overlay 之上不能再作为 upperdir）使用 vfs
+func DefaultDriver() string {
+	if defaultDriver != "" {
+		return defaultDriver
+	}
+	detectOnce.Do(func() {
+		detectedDriver = DriverOverlay
+		if err := checkOverlay(); err != nil {
+			log.Warnf("overlay is not supported, falling back to vfs: %v", err)
+			detectedDriver = DriverVFS
+		}
+	})
+	return detectedDriver
+}
+
+// 在读写层所在的文件系统上尝试进行一次 overlay 挂载
+func checkOverlay() error {
+	if err := os.MkdirAll(constant.ContainerPath, 0755); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(constant.ContainerPath, ".check-overlay-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"lower1", "lower2", "merged"} {
+		if err := os.Mkdir(path.Join(dir, name), 0755); err != nil {
+			return err
+		}
+	}
+	layers := []string{path.Join(dir, "lower1"), path.Join(dir, "lower2")}
+	rwLayer := path.Join(dir, "rw")
+	driver := &overlayDriver{}
+	if err := driver.Create(rwLayer, layers); err != nil {
+		return err
+	}
+	merged := path.Join(dir, "merged")
+	if err := driver.Mount(rwLayer, layers, merged, false); err != nil {
+		return err
+	}
+	return Unmount(merged)
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// fsconfig 的命令，当前依赖的 x/sys 版本中没有定义
+const (
+	fsconfigCmdSetString = 1
+	fsconfigCmdCreate    = 6
+)
+
+// 内核不支持 fsopen 或逐个添加 lowerdir 时返回该错误，此时回退到 mount(2)
+var errFsconfigUnsupported = errors.New("fsconfig lowerdir+ is not supported")
+
+// 使用 overlay 将镜像层和读写层叠加到 target 上，lowerDir 按照自底向上的顺序排列，rwLayer 为空时挂载为只读
+// 优先使用 fsopen/fsconfig 逐个添加 lowerdir（需要 Linux 6.8），不受 mount(2) 挂载参数长度为一个内存页的限制
+func mountOverlay(lowerDir []string, rwLayer string, target string) error {
+	if err := checkLowerDirs(lowerDir, rwLayer); err != nil {
+		return err
+	}
+
+	err := mountOverlayFsconfig(lowerDir, rwLayer, target)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, errFsconfigUnsupported) {
+		return err
+	}
+	log.Debugf("%v, falling back to mount(2)", err)
+
+	data, err := overlayMountData(lowerDir, rwLayer)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Mount overlay on %s: %s", target, data)
+	if err := unix.Mount("m-docker-overlay", target, "overlay", 0, data); err != nil {
+		return fmt.Errorf("fail to overlay mount %s: %v", target, err)
+	}
+	return nil
+}
+
+// 通过 fsopen、fsconfig、fsmount 和 move_mount 挂载 overlay
+func mountOverlayFsconfig(lowerDir []string, rwLayer string, target string) error {
+	fd, err := unix.Fsopen("overlay", unix.FSOPEN_CLOEXEC)
+	if err != nil {
+		if err == unix.ENOSYS || err == unix.EPERM {
+			return fmt.Errorf("%w: fsopen: %v", errFsconfigUnsupported, err)
+		}
+		return fmt.Errorf("fail to open overlay fs context: %v", err)
+	}
+	defer unix.Close(fd)
+
+	if err := fsconfigString(fd, "source", "m-docker-overlay"); err != nil {
+		return fsconfigError(fd, "source", err)
+	}
+	// 与 lowerdir 参数的顺序一致，先添加的 lowerdir 位于上层
+	for i := len(lowerDir) - 1; i >= 0; i-- {
+		if err := fsconfigString(fd, "lowerdir+", lowerDir[i]); err != nil {
+			// 旧版本的内核不认识 lowerdir+ 参数
+			if err == unix.EINVAL && i == len(lowerDir)-1 {
+				return fmt.Errorf("%w: %s", errFsconfigUnsupported, fsconfigError(fd, "lowerdir+", err))
+			}
+			return fsconfigError(fd, "lowerdir+ "+lowerDir[i], err)
+		}
+	}
+	if rwLayer != "" {
+		if err := fsconfigString(fd, "upperdir", upperDir(rwLayer)); err != nil {
+			return fsconfigError(fd, "upperdir", err)
+		}
+		if err := fsconfigString(fd, "workdir", path.Join(rwLayer, "work")); err != nil {
+			return fsconfigError(fd, "workdir", err)
+		}
+	}
+	if err := fsconfig(fd, fsconfigCmdCreate, nil, nil); err != nil {
+		return fsconfigError(fd, "create", err)
+	}
+
+	mountFd, err := unix.Fsmount(fd, unix.FSMOUNT_CLOEXEC, 0)
+	if err != nil {
+		return fsconfigError(fd, "fsmount", err)
+	}
+	defer unix.Close(mountFd)
+	if err := unix.MoveMount(mountFd, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("fail to move overlay mount to %s: %v", target, err)
+	}
+	log.Debugf("Mounted overlay on %s with %d lower dirs", target, len(lowerDir))
+	return nil
+}
+
+// 设置 fs context 的字符串参数
+func fsconfigString(fd int, key string, value string) error {
+	keyPtr, err := unix.BytePtrFromString(key)
+	if err != nil {
+		return err
+	}
+	valuePtr, err := unix.BytePtrFromString(value)
+	if err != nil {
+		return err
+	}
+	return fsconfig(fd, fsconfigCmdSetString, keyPtr, valuePtr)
+}
+
+// 调用 fsconfig 系统调用
+func fsconfig(fd int, cmd int, key *byte, value *byte) error {
+	_, _, errno := unix.Syscall6(unix.SYS_FSCONFIG, uintptr(fd), uintptr(cmd),
+		uintptr(unsafe.Pointer(key)), uintptr(unsafe.Pointer(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// 生成 fsconfig 失败时的错误，内核的详细错误信息可以从 fs context 中读取
+func fsconfigError(fd int, op string, err error) error {
+	var messages []string
+	buf := make([]byte, 4096)
+	for {
+		n, readErr := unix.Read(fd, buf)
+		if readErr != nil || n <= 0 {
+			break
+		}
+		messages = append(messages, strings.TrimSpace(string(buf[:n])))
+	}
+	if len(messages) > 0 {
+		return fmt.Errorf("fail to overlay mount: %s: %v: %s", op, err, strings.Join(messages, "; "))
+	}
+	return fmt.Errorf("fail to overlay mount: %s: %v", op, err)
+}
+
+// 卸载挂载点，挂载点正忙时使用 MNT_DETACH 延迟卸载
+// 挂载点不存在或没有挂载时视为已经卸载
+func Unmount(target string) error {
+	err := unix.Unmount(target, 0)
+	if err == unix.EBUSY {
+		log.Warnf("mount point %s is busy, detaching it", target)
+		err = unix.Unmount(target, unix.MNT_DETACH)
+	}
+	if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("fail to umount %s: %v", target, err)
+	}
+	return nil
+}
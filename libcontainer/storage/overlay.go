@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"m-docker/libcontainer/archive"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// overlay 最多支持叠加的 lowerdir 数量，对应内核中的 OVL_MAX_STACK
+const maxOverlayLowerDirs = 500
+
+// 使用 overlay 联合挂载的存储驱动
+// 读写层目录下的 fs 作为 upperdir，work 作为 workdir
+type overlayDriver struct{}
+
+func (d *overlayDriver) Name() string {
+	return DriverOverlay
+}
+
+// 创建 overlay 所需要的 upper 和 work 目录
+func (d *overlayDriver) Create(rwLayer string, layers []string) error {
+	// 读写层的父目录由所有容器共享，不存在时创建即可
+	if err := os.MkdirAll(path.Dir(rwLayer), 0755); err != nil {
+		return fmt.Errorf("fail to create dir %s: %v", path.Dir(rwLayer), err)
+	}
+	for _, dir := range []string{rwLayer, upperDir(rwLayer), path.Join(rwLayer, "work")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return fmt.Errorf("fail to create dir %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// 使用 overlay 将镜像层和读写层叠加到 target 上
+// 只读挂载时读写层也作为 lowerdir，此时不需要 workdir
+func (d *overlayDriver) Mount(rwLayer string, layers []string, target string, readOnly bool) error {
+	if readOnly {
+		layers = append(append([]string{}, layers...), upperDir(rwLayer))
+		rwLayer = ""
+	}
+	return mountOverlay(layers, rwLayer, target)
+}
+
+func (d *overlayDriver) Unmount(target string) error {
+	return Unmount(target)
+}
+
+func (d *overlayDriver) Remove(rwLayer string) error {
+	return os.RemoveAll(rwLayer)
+}
+
+// 读写层中的文件在镜像中存在时为修改，否则为新增；overlay 的 whiteout 以及 opaque 目录所屏蔽的文件为删除
+func (d *overlayDriver) Diff(rwLayer string, layers []string) ([]Change, error) {
+	upper := upperDir(rwLayer)
+	var changes []Change
+
+	err := filepath.Walk(upper, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = "/" + rel
+
+		// whiteout 表示删除了镜像中的文件
+		if archive.IsWhiteout(fi) {
+			if existsInLayers(layers, rel) {
+				changes = append(changes, Change{Path: rel, Kind: ChangeDelete})
+			}
+			return nil
+		}
+
+		kind := ChangeAdd
+		if existsInLayers(layers, rel) {
+			kind = ChangeModify
+		}
+		changes = append(changes, Change{Path: rel, Kind: kind})
+
+		// opaque 目录会屏蔽镜像中的同名目录，其中没有出现在读写层中的文件都被删除了
+		if fi.IsDir() && kind == ChangeModify && archive.IsOpaqueDir(p) {
+			for _, name := range lowerEntries(layers, rel) {
+				if _, err := os.Lstat(filepath.Join(p, name)); os.IsNotExist(err) {
+					changes = append(changes, Change{Path: filepath.Join(rel, name), Kind: ChangeDelete})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortChanges(changes)
+	return changes, nil
+}
+
+// upper 目录即为容器对文件系统的修改，打包时将 overlay 格式的 whiteout 转换为 OCI 格式
+func (d *overlayDriver) Commit(rwLayer string, layers []string, w io.Writer) error {
+	return archive.Tar(upperDir(rwLayer), w)
+}
+
+// 读写层中作为 upperdir 的目录
+func upperDir(rwLayer string) string {
+	return path.Join(rwLayer, "fs")
+}
+
+// 校验 lowerdir 的数量是否满足内核的限制
+func checkLowerDirs(lowerDir []string, rwLayerDir string) error {
+	if len(lowerDir) == 0 {
+		return fmt.Errorf("overlay needs at least one lower dir")
+	}
+	if len(lowerDir) > maxOverlayLowerDirs {
+		return fmt.Errorf("too many image layers: %d, overlay supports at most %d", len(lowerDir), maxOverlayLowerDirs)
+	}
+
+	// 没有读写层时 overlay 是只读的，此时至少需要两个 lowerdir
+	if rwLayerDir == "" && len(lowerDir) < 2 {
+		return fmt.Errorf("read-only overlay needs at least two lower dirs")
+	}
+	return nil
+}
+
+// 生成 mount(2) 所使用的 overlay 挂载参数，并校验其是否满足内核的限制
+// lowerDir 中的镜像层按照自底向上的顺序排列，rwLayerDir 为空时挂载为只读
+func overlayMountData(lowerDir []string, rwLayerDir string) (string, error) {
+	if err := checkLowerDirs(lowerDir, rwLayerDir); err != nil {
+		return "", err
+	}
+
+	// overlay 的 lowerdir 参数要求最上层的目录在最左边，因此需要倒序拼接
+	lowers := make([]string, 0, len(lowerDir))
+	for i := len(lowerDir) - 1; i >= 0; i-- {
+		// ':' 和 ',' 分别是 lowerdir 和挂载参数的分隔符，不能出现在路径中
+		if strings.ContainsAny(lowerDir[i], ":,") {
+			return "", fmt.Errorf("invalid lower dir %s: must not contain ':' or ','", lowerDir[i])
+		}
+		lowers = append(lowers, lowerDir[i])
+	}
+
+	data := "lowerdir=" + strings.Join(lowers, ":")
+	if rwLayerDir != "" {
+		data += fmt.Sprintf(",upperdir=%s,workdir=%s",
+			upperDir(rwLayerDir),
+			path.Join(rwLayerDir, "work"))
+	}
+
+	// mount 系统调用最多只会拷贝一个内存页大小的挂载参数，超出的部分会被截断
+	if len(data) >= os.Getpagesize() {
+		return "", fmt.Errorf("overlay mount options too long: %d bytes, the limit is %d bytes", len(data), os.Getpagesize()-1)
+	}
+
+	return data, nil
+}
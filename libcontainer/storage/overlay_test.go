@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Diff 只读取读写层的 upper 目录，不需要真正挂载 overlay
+func TestOverlayDiff(t *testing.T) {
+	layers := makeLayers(t)
+	rwLayer := filepath.Join(t.TempDir(), "rw")
+	driver := &overlayDriver{}
+	if err := driver.Create(rwLayer, layers); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, dir := range []string{upperDir(rwLayer), filepath.Join(rwLayer, "work")} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("Create: %v", err)
+		}
+	}
+	if changes, err := driver.Diff(rwLayer, layers); err != nil || len(changes) != 0 {
+		t.Fatalf("Diff of a new rw layer = %v, %v", changes, err)
+	}
+
+	upper := upperDir(rwLayer)
+	makeFiles(t, upper, map[string]string{
+		"new":     "new",
+		"a/file1": "whiteout",
+		"a/file2": "changed",
+		// 镜像中已经不存在的文件的 whiteout 不是变化
+		"gone":     "whiteout",
+		"dir/z":    "changed",
+		"other/x":  "x",
+		"other/y/": "",
+	})
+	// 重新创建的 opaque 目录中只有 z，镜像中 dir 下的其他文件都被删除
+	makeOpaque(t, filepath.Join(upper, "dir"))
+	makeFiles(t, layers[1], map[string]string{"dir/w": "w"})
+
+	changes, err := driver.Diff(rwLayer, layers)
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	want := []Change{
+		{Path: "/a", Kind: ChangeModify},
+		{Path: "/a/file1", Kind: ChangeDelete},
+		{Path: "/a/file2", Kind: ChangeModify},
+		{Path: "/dir", Kind: ChangeModify},
+		{Path: "/dir/w", Kind: ChangeDelete},
+		{Path: "/dir/z", Kind: ChangeModify},
+		{Path: "/new", Kind: ChangeAdd},
+		{Path: "/other", Kind: ChangeAdd},
+		{Path: "/other/x", Kind: ChangeAdd},
+		{Path: "/other/y", Kind: ChangeAdd},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Diff = %v, want %v", changes, want)
+	}
+
+	// 打包时 whiteout 和 opaque 目录转换为 OCI 格式
+	var buf bytes.Buffer
+	if err := driver.Commit(rwLayer, layers, &buf); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	wantNames := []string{".wh.gone", "a/", "a/.wh.file1", "a/file2", "dir/", "dir/.wh..wh..opq", "dir/z", "new", "other/", "other/x", "other/y/"}
+	if got := tarNames(t, &buf); !reflect.DeepEqual(got, wantNames) {
+		t.Errorf("Commit entries = %q, want %q", got, wantNames)
+	}
+}
+
+func TestNewStorageDriver(t *testing.T) {
+	tests := map[string]string{
+		DriverOverlay: DriverOverlay,
+		DriverVFS:     DriverVFS,
+		// 引入存储驱动之前创建的容器
+		"": DriverOverlay,
+	}
+	for name, want := range tests {
+		driver, err := NewStorageDriver(name)
+		if err != nil || driver.Name() != want {
+			t.Errorf("NewStorageDriver(%q) = %v, %v, want %s", name, driver, err, want)
+		}
+	}
+	if _, err := NewStorageDriver("btrfs"); err == nil {
+		t.Error("NewStorageDriver of an unknown driver succeeded")
+	}
+	if err := SetDefaultDriver("btrfs"); err == nil {
+		t.Error("SetDefaultDriver of an unknown driver succeeded")
+	}
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"m-docker/libcontainer/archive"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// 不依赖联合文件系统的存储驱动
+// 创建容器时将所有镜像层依次复制到读写层的 fs 目录下，得到完整的文件系统，挂载时直接 bind mount 该目录
+type vfsDriver struct{}
+
+func (d *vfsDriver) Name() string {
+	return DriverVFS
+}
+
+// 将镜像层自底向上依次应用到读写层中，镜像层中 overlay 格式的 whiteout 会删除下层的文件
+func (d *vfsDriver) Create(rwLayer string, layers []string) error {
+	if err := os.MkdirAll(path.Dir(rwLayer), 0755); err != nil {
+		return fmt.Errorf("fail to create dir %s: %v", path.Dir(rwLayer), err)
+	}
+	for _, dir := range []string{rwLayer, upperDir(rwLayer)} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return fmt.Errorf("fail to create dir %s: %v", dir, err)
+		}
+	}
+
+	for _, layer := range layers {
+		if err := applyLayer(layer, upperDir(rwLayer)); err != nil {
+			return fmt.Errorf("fail to copy layer %s: %v", layer, err)
+		}
+	}
+	return nil
+}
+
+// 将读写层 bind mount 到 target
+func (d *vfsDriver) Mount(rwLayer string, layers []string, target string, readOnly bool) error {
+	if err := syscall.Mount(upperDir(rwLayer), target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("fail to bind mount %s: %v", upperDir(rwLayer), err)
+	}
+	if readOnly {
+		// bind mount 时会忽略 MS_RDONLY，需要重新挂载一次
+		if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			_ = Unmount(target)
+			return fmt.Errorf("fail to remount %s read-only: %v", target, err)
+		}
+	}
+	return nil
+}
+
+func (d *vfsDriver) Unmount(target string) error {
+	return Unmount(target)
+}
+
+func (d *vfsDriver) Remove(rwLayer string) error {
+	return os.RemoveAll(rwLayer)
+}
+
+// 比较读写层和镜像中的文件：只在读写层中存在的为新增，元数据不同的为修改，只在镜像中存在的为删除
+// 与 docker 的 vfs 驱动一致，文件内容的变化通过大小和修改时间判断
+func (d *vfsDriver) Diff(rwLayer string, layers []string) ([]Change, error) {
+	root := upperDir(rwLayer)
+	var changes []Change
+
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = "/" + rel
+
+		lower, ok := lookupInLayers(layers, rel)
+		if !ok {
+			changes = append(changes, Change{Path: rel, Kind: ChangeAdd})
+			return nil
+		}
+		lowerInfo, err := os.Lstat(lower)
+		if err != nil {
+			return err
+		}
+		if !sameFile(p, fi, lower, lowerInfo) {
+			changes = append(changes, Change{Path: rel, Kind: ChangeModify})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	changes = append(changes, deletedFiles(root, layers, "/")...)
+	sortChanges(changes)
+	return changes, nil
+}
+
+// 只打包发生变化的文件，删除的文件则写入 OCI 格式的 whiteout
+func (d *vfsDriver) Commit(rwLayer string, layers []string, w io.Writer) error {
+	changes, err := d.Diff(rwLayer, layers)
+	if err != nil {
+		return err
+	}
+	// IncludePaths 不为 nil 时只打包其中的路径，没有任何变化时得到空的 tar 包
+	opts := &archive.TarOptions{IncludePaths: []string{}}
+	for _, change := range changes {
+		if change.Kind == ChangeDelete {
+			opts.Whiteouts = append(opts.Whiteouts, change.Path)
+		} else {
+			opts.IncludePaths = append(opts.IncludePaths, change.Path)
+		}
+	}
+	return archive.TarWithOptions(upperDir(rwLayer), w, opts)
+}
+
+// 将镜像层打包后解压到 dest，打包时 whiteout 转换为 OCI 格式，解压时再将其应用到 dest 上
+func applyLayer(layer string, dest string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.Tar(layer, pw))
+	}()
+	err := archive.UntarWithOptions(pr, dest, &archive.UntarOptions{ApplyWhiteouts: true})
+	pr.CloseWithError(err)
+	return err
+}
+
+// 查找镜像中的目录 rel 下在读写层中已经不存在的文件，被删除的目录不再列出其中的文件
+func deletedFiles(root string, layers []string, rel string) []Change {
+	var changes []Change
+	for _, name := range lowerEntries(layers, rel) {
+		child := filepath.Join(rel, name)
+		fi, err := os.Lstat(filepath.Join(root, child))
+		if err != nil {
+			changes = append(changes, Change{Path: child, Kind: ChangeDelete})
+			continue
+		}
+		if lower, ok := lookupInLayers(layers, child); ok && fi.IsDir() {
+			if lowerInfo, err := os.Lstat(lower); err == nil && lowerInfo.IsDir() {
+				changes = append(changes, deletedFiles(root, layers, child)...)
+			}
+		}
+	}
+	return changes
+}
+
+// 通过元数据判断读写层中的文件与镜像中的文件是否相同
+// 镜像层解压时只保留了秒级的修改时间，因此只比较到秒；目录的大小与内容无关，不做比较
+func sameFile(p string, fi os.FileInfo, lower string, lowerInfo os.FileInfo) bool {
+	st, ok1 := fi.Sys().(*syscall.Stat_t)
+	lowerSt, ok2 := lowerInfo.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 {
+		return false
+	}
+	if st.Mode != lowerSt.Mode || st.Uid != lowerSt.Uid || st.Gid != lowerSt.Gid || st.Rdev != lowerSt.Rdev {
+		return false
+	}
+	if fi.ModTime().Unix() != lowerInfo.ModTime().Unix() {
+		return false
+	}
+	if !fi.IsDir() && fi.Size() != lowerInfo.Size() {
+		return false
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err1 := os.Readlink(p)
+		lowerLink, err2 := os.Readlink(lower)
+		return err1 == nil && err2 == nil && link == lowerLink
+	}
+	return true
+}
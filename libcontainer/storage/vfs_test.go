@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"m-docker/libcontainer/archive"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 镜像层中文件的修改时间，修改读写层后的时间一定与其不同
+var layerTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// 创建和读取 overlay 格式的 whiteout 需要 root 权限以及支持 trusted.* xattr 的文件系统
+func requireWhiteoutSupport(t *testing.T, dir string) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create whiteouts")
+	}
+	if err := unix.Setxattr(dir, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("trusted xattrs are not supported: %v", err)
+	}
+	if err := unix.Removexattr(dir, "trusted.overlay.opaque"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 在 dir 下创建文件，以 / 结尾的为目录，内容为 "whiteout" 的为 overlay 格式的 whiteout
+func makeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		switch {
+		case name[len(name)-1] == '/':
+			err = os.MkdirAll(p, 0755)
+		case content == "whiteout":
+			err = unix.Mknod(p, unix.S_IFCHR, 0)
+		default:
+			err = os.WriteFile(p, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 将目录标记为 opaque
+func makeOpaque(t *testing.T, dir string) {
+	if err := unix.Setxattr(dir, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 将目录下所有文件的修改时间设置为 layerTime
+func setLayerTime(t *testing.T, dir string) {
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, layerTime, layerTime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 创建两个镜像层：上层删除了下层的 gone，并将 dir 标记为 opaque
+func makeLayers(t *testing.T) []string {
+	lower := t.TempDir()
+	requireWhiteoutSupport(t, lower)
+	makeFiles(t, lower, map[string]string{
+		"a/file1": "1",
+		"a/file2": "2",
+		"dir/x":   "x",
+		"dir/y":   "y",
+		"gone":    "gone",
+	})
+	upper := t.TempDir()
+	makeFiles(t, upper, map[string]string{
+		"gone":  "whiteout",
+		"dir/z": "z",
+	})
+	makeOpaque(t, filepath.Join(upper, "dir"))
+	setLayerTime(t, lower)
+	setLayerTime(t, upper)
+	return []string{lower, upper}
+}
+
+// 目录下的所有文件，按字典序排列
+func listFiles(t *testing.T, dir string) []string {
+	var names []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel, _ := filepath.Rel(dir, p); rel != "." {
+			names = append(names, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// tar 流中所有条目的名称，按字典序排列
+func tarNames(t *testing.T, r io.Reader) []string {
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestVFSCreate(t *testing.T) {
+	layers := makeLayers(t)
+	rwLayer := filepath.Join(t.TempDir(), "rw")
+	driver := &vfsDriver{}
+	if err := driver.Create(rwLayer, layers); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// whiteout 和 opaque 目录屏蔽的文件都不会复制到读写层中
+	want := []string{"a", "a/file1", "a/file2", "dir", "dir/z"}
+	if got := listFiles(t, upperDir(rwLayer)); !reflect.DeepEqual(got, want) {
+		t.Errorf("rw layer = %q, want %q", got, want)
+	}
+	if archive.IsOpaqueDir(filepath.Join(upperDir(rwLayer), "dir")) {
+		t.Error("opaque xattr is copied to the rw layer")
+	}
+
+	if err := driver.Create(rwLayer, layers); err == nil {
+		t.Error("Create of an existing rw layer succeeded")
+	}
+}
+
+func TestVFSDiff(t *testing.T) {
+	layers := makeLayers(t)
+	rwLayer := filepath.Join(t.TempDir(), "rw")
+	driver := &vfsDriver{}
+	if err := driver.Create(rwLayer, layers); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if changes, err := driver.Diff(rwLayer, layers); err != nil || len(changes) != 0 {
+		t.Fatalf("Diff of a new rw layer = %v, %v", changes, err)
+	}
+
+	fs := upperDir(rwLayer)
+	makeFiles(t, fs, map[string]string{"new": "new", "dir/z": "changed"})
+	if err := os.RemoveAll(filepath.Join(fs, "a")); err != nil {
+		t.Fatal(err)
+	}
+	// 只修改了修改时间的文件同样视为修改
+	if err := os.Chtimes(filepath.Join(fs, "dir"), time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := driver.Diff(rwLayer, layers)
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	// 被删除的目录不再列出其中的文件
+	want := []Change{
+		{Path: "/a", Kind: ChangeDelete},
+		{Path: "/dir", Kind: ChangeModify},
+		{Path: "/dir/z", Kind: ChangeModify},
+		{Path: "/new", Kind: ChangeAdd},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Diff = %v, want %v", changes, want)
+	}
+
+	var buf bytes.Buffer
+	if err := driver.Commit(rwLayer, layers, &buf); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	wantNames := []string{".wh.a", "dir/", "dir/z", "new"}
+	if got := tarNames(t, &buf); !reflect.DeepEqual(got, wantNames) {
+		t.Errorf("Commit entries = %q, want %q", got, wantNames)
+	}
+}
+
+func TestVFSCommitWithoutChanges(t *testing.T) {
+	layers := makeLayers(t)
+	rwLayer := filepath.Join(t.TempDir(), "rw")
+	driver := &vfsDriver{}
+	if err := driver.Create(rwLayer, layers); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Commit(rwLayer, layers, &buf); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if got := tarNames(t, &buf); len(got) != 0 {
+		t.Errorf("Commit entries = %q, want an empty layer", got)
+	}
+}
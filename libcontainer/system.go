@@ -0,0 +1,377 @@
+package libcontainer
+
+import (
+	"fmt"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/constant"
+	"m-docker/libcontainer/image"
+	"m-docker/libcontainer/storage"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 某一类数据的磁盘占用情况
+type DiskUsage struct {
+	// 数据类型，如 Images、Containers
+	Type string `json:"type"`
+
+	// 总数量
+	Total int `json:"total"`
+
+	// 正在使用的数量
+	Active int `json:"active"`
+
+	// 占用的磁盘空间
+	Size int64 `json:"size"`
+
+	// 可以通过 prune 回收的磁盘空间
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+// prune 的选项
+type PruneOptions struct {
+	// 是否删除所有未被容器使用的镜像，否则只删除悬空镜像
+	All bool
+
+	// 只删除在该时间之前创建的容器和镜像，为零值时不做限制
+	Until time.Time
+}
+
+// prune 的结果
+type PruneReport struct {
+	// 被删除的容器 ID
+	Containers []string `json:"containers"`
+
+	// 被删除的镜像名称
+	Images []string `json:"images"`
+
+	// 被删除的镜像层数量
+	Layers int `json:"layers"`
+
+	// 被删除的 blob 数量
+	Blobs int `json:"blobs"`
+
+	// 回收的磁盘空间
+	SpaceReclaimed int64 `json:"spaceReclaimed"`
+}
+
+// 统计镜像、容器、volume 和构建缓存的磁盘占用情况
+// 镜像的大小包括解压后的镜像层以及内容存储中的 blob，由于镜像层被多个镜像共享，这里不区分单个镜像的大小
+// volume 都是通过 -v 绑定挂载的宿主机目录，不由 m-docker 管理，prune 不会删除，因此不可回收
+func GetDiskUsage() ([]DiskUsage, error) {
+	confs, err := config.ListConfigs()
+	if err != nil {
+		return nil, err
+	}
+	images, err := image.ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	// 镜像：被容器使用的镜像层及其 blob 不能回收
+	usedNames, usedLayers := containerReferences(confs)
+	imageUsage := DiskUsage{
+		Type:  "Images",
+		Total: len(images),
+		Size:  entriesSize(constant.LayerPath) + entriesSize(constant.BlobPath),
+	}
+	for _, img := range images {
+		if imageInUse(img, usedNames, usedLayers) {
+			imageUsage.Active++
+		}
+	}
+	var usedSize int64
+	for chainID := range usedLayers {
+		usedSize += dirSize(path.Dir(image.LayerDir(chainID)))
+		if layer, err := image.GetLayer(chainID); err == nil && layer.Blob != nil {
+			if fi, err := os.Stat(image.BlobPath(layer.Blob.Digest)); err == nil {
+				usedSize += fi.Size()
+			}
+		}
+	}
+	imageUsage.Reclaimable = max64(imageUsage.Size-usedSize, 0)
+
+	// 容器：运行中容器的读写层不能回收
+	containerUsage := DiskUsage{
+		Type:  "Containers",
+		Total: len(confs),
+		Size:  entriesSize(constant.ContainerPath),
+	}
+	var runningSize int64
+	for _, conf := range confs {
+		if conf.Status == constant.ContainerRunning {
+			containerUsage.Active++
+			runningSize += dirSize(conf.RwLayer)
+		}
+	}
+	containerUsage.Reclaimable = max64(containerUsage.Size-runningSize, 0)
+
+	// volume：同一个宿主机目录被多个容器挂载时只统计一次
+	volumeUsage := DiskUsage{Type: "Local Volumes"}
+	volumes := make(map[string]bool)
+	activeVolumes := make(map[string]bool)
+	for _, conf := range confs {
+		for _, mount := range conf.Mounts {
+			if !volumes[mount.Source] {
+				volumes[mount.Source] = true
+				volumeUsage.Size += entriesSize(mount.Source)
+			}
+			if conf.Status == constant.ContainerRunning {
+				activeVolumes[mount.Source] = true
+			}
+		}
+	}
+	volumeUsage.Total = len(volumes)
+	volumeUsage.Active = len(activeVolumes)
+
+	// 构建缓存：只记录构建步骤与镜像层的对应关系，镜像层本身计入镜像
+	cacheUsage := DiskUsage{
+		Type: "Build Cache",
+		Size: entriesSize(constant.BuildCachePath),
+	}
+	cacheUsage.Reclaimable = cacheUsage.Size
+	if entries, err := os.ReadDir(constant.BuildCachePath); err == nil {
+		cacheUsage.Total = len(entries)
+	}
+
+	return []DiskUsage{imageUsage, containerUsage, volumeUsage, cacheUsage}, nil
+}
+
+// 清理不再使用的数据，依次删除：
+// 1. 已经停止的容器
+// 2. 没有被容器使用的悬空镜像，指定 All 时为所有没有被容器使用的镜像
+// 3. 没有被镜像和容器引用的镜像层和 blob，以及各种中断操作残留的临时文件
+// 4. 没有对应容器的读写层和挂载点
+// 同时清理管理容器的 m-docker 进程异常退出后残留的端口映射规则
+// 指定 All 时还会清空构建缓存；通过 -v 绑定挂载的 volume 是宿主机上的目录，不会被删除
+func Prune(opts PruneOptions) (*PruneReport, error) {
+	before := dirSize(constant.RootPath)
+	report := new(PruneReport)
+
+	confs, err := config.ListConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	// 删除已经停止的容器
+	remaining := make([]*config.Config, 0, len(confs))
+	for _, conf := range confs {
+		if conf.Status == constant.ContainerRunning || !createdBefore(containerCreated(conf), opts.Until) {
+			remaining = append(remaining, conf)
+			continue
+		}
+		container, err := NewContainer(conf, false)
+		if err != nil {
+			log.Warnf("failed to remove container %s: %v", conf.ID, err)
+			remaining = append(remaining, conf)
+			continue
+		}
+		container.Remove()
+		report.Containers = append(report.Containers, conf.ID)
+	}
+	// 清理异常退出的容器残留的端口映射规则
+	CleanupStalePorts()
+
+	// 删除没有被容器使用的镜像，以及没有被引用的镜像层和 blob
+	// 持有镜像存储的排他锁，等待正在进行的 pull、load、build 等操作完成，它们创建的镜像层此时都已经被镜像引用
+	unlock, err := image.LockStoreExclusive()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	images, err := image.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	usedNames, keep := containerReferences(remaining)
+	var kept []*image.Image
+	for _, img := range images {
+		if (opts.All || img.Dangling()) && !imageInUse(img, usedNames, keep) && createdBefore(img.Created, opts.Until) {
+			if err := image.DeleteImage(img.Name); err != nil {
+				return nil, err
+			}
+			report.Images = append(report.Images, img.Name)
+			continue
+		}
+		kept = append(kept, img)
+	}
+
+	// 删除没有被引用的镜像层和 blob
+	for _, img := range kept {
+		for _, chainID := range img.ChainIDs() {
+			keep[chainID] = true
+		}
+	}
+	if report.Layers, err = image.PruneLayers(keep); err != nil {
+		return nil, err
+	}
+	keepBlobs := make(map[string]bool)
+	for chainID := range keep {
+		if layer, err := image.GetLayer(chainID); err == nil && layer.Blob != nil {
+			keepBlobs[layer.Blob.Digest] = true
+		}
+	}
+	if report.Blobs, err = image.PruneBlobs(keepBlobs); err != nil {
+		return nil, err
+	}
+
+	// 删除残留的读写层和挂载点
+	pruneOrphanDirs(remaining)
+
+	if opts.All {
+		if err := os.RemoveAll(constant.BuildCachePath); err != nil {
+			return nil, fmt.Errorf("failed to remove build cache: %v", err)
+		}
+	}
+
+	report.SpaceReclaimed = max64(before-dirSize(constant.RootPath), 0)
+	return report, nil
+}
+
+// 统计容器所使用的镜像名称，以及容器所使用的镜像层及其所有下层的 chainID
+func containerReferences(confs []*config.Config) (map[string]bool, map[string]bool) {
+	names := make(map[string]bool)
+	layers := make(map[string]bool)
+	for _, conf := range confs {
+		if conf.Image != "" {
+			names[conf.Image] = true
+		}
+		for _, dir := range conf.Layers {
+			layer, err := image.LayerFromDir(dir)
+			if err != nil {
+				continue
+			}
+			for chainID := layer.ChainID; chainID != "" && !layers[chainID]; {
+				layers[chainID] = true
+				parent, err := image.GetLayer(chainID)
+				if err != nil {
+					break
+				}
+				chainID = parent.Parent
+			}
+		}
+	}
+	return names, layers
+}
+
+// 判断镜像是否被容器使用，容器可能通过名称引用镜像，也可能直接使用了镜像的所有镜像层
+func imageInUse(img *image.Image, usedNames map[string]bool, usedLayers map[string]bool) bool {
+	chainIDs := img.ChainIDs()
+	return usedNames[img.Name] || usedLayers[chainIDs[len(chainIDs)-1]]
+}
+
+// 删除没有对应容器的读写层，以及没有运行中容器的挂载点
+func pruneOrphanDirs(confs []*config.Config) {
+	known := make(map[string]bool)
+	running := make(map[string]bool)
+	for _, conf := range confs {
+		known[conf.ID] = true
+		if conf.Status == constant.ContainerRunning {
+			running[conf.ID] = true
+		}
+	}
+
+	if entries, err := os.ReadDir(constant.ContainerPath); err == nil {
+		for _, entry := range entries {
+			if known[entry.Name()] {
+				continue
+			}
+			if err := os.RemoveAll(path.Join(constant.ContainerPath, entry.Name())); err != nil {
+				log.Warnf("failed to remove rw layer %s: %v", entry.Name(), err)
+			}
+		}
+	}
+
+	// 挂载点可能仍然挂载着 overlay，只能删除空目录，删除失败时先卸载再重试
+	rootfsPath := path.Join(constant.RootPath, "rootfs")
+	if entries, err := os.ReadDir(rootfsPath); err == nil {
+		for _, entry := range entries {
+			if running[entry.Name()] {
+				continue
+			}
+			mountPoint := path.Join(rootfsPath, entry.Name())
+			if os.Remove(mountPoint) == nil {
+				continue
+			}
+			if err := storage.Unmount(mountPoint); err != nil {
+				log.Warnf("%v", err)
+				continue
+			}
+			if err := os.Remove(mountPoint); err != nil {
+				log.Warnf("failed to remove mount point %s: %v", mountPoint, err)
+			}
+		}
+	}
+}
+
+// 解析容器的创建时间，容器的创建时间以 UTC+8 记录
+func containerCreated(conf *config.Config) *time.Time {
+	utcPlus8 := time.FixedZone("UTC+8", 8*60*60)
+	created, err := time.ParseInLocation("2006-01-02 15:04:05", conf.CreatedTime, utcPlus8)
+	if err != nil {
+		return nil
+	}
+	return &created
+}
+
+// 判断创建时间是否早于 until，until 为零值或创建时间未知时视为满足条件
+func createdBefore(created *time.Time, until time.Time) bool {
+	return until.IsZero() || created == nil || created.Before(until)
+}
+
+// 统计目录占用的磁盘空间，硬链接的文件只计算一次，不跨越文件系统
+func dirSize(dir string) int64 {
+	root, err := os.Lstat(dir)
+	if err != nil {
+		return 0
+	}
+	rootDev := root.Sys().(*syscall.Stat_t).Dev
+
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+	seen := make(map[inode]bool)
+	var size int64
+	_ = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if uint64(stat.Dev) != uint64(rootDev) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		key := inode{uint64(stat.Dev), stat.Ino}
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		size += stat.Blocks * 512
+		return nil
+	})
+	return size
+}
+
+// 统计目录下的内容占用的磁盘空间，不包括目录本身，空目录的大小为 0
+func entriesSize(dir string) int64 {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return 0
+	}
+	return max64(dirSize(dir)-info.Sys().(*syscall.Stat_t).Blocks*512, 0)
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,43 @@
+package libcontainer
+
+import (
+	"fmt"
+	"m-docker/libcontainer/cgroup"
+	"m-docker/libcontainer/config"
+	"m-docker/libcontainer/constant"
+)
+
+// 修改容器的资源限制，运行中的容器立即生效，已经停止的容器只修改配置
+// cpu 和内存限制写入容器的 cgroup，网络带宽限制通过 tc 设置在容器的 veth 设备上
+func UpdateContainer(conf *config.Config, res *config.Resources) error {
+	if conf.Cgroup == nil {
+		return fmt.Errorf("container %s has no cgroup config", conf.Name)
+	}
+	if (res.NetIngressRate > 0 || res.NetEgressRate > 0) && len(conf.Endpoints) == 0 {
+		return fmt.Errorf("network bandwidth limits are not supported in network mode %s", conf.NetworkMode)
+	}
+	old := conf.Cgroup.Resources
+	conf.Cgroup.Resources = res
+
+	// 任意一项限制设置失败时恢复原来的限制，并且不记录新的配置
+	if conf.Status == constant.ContainerRunning {
+		manager, err := cgroup.NewCgroupManager(conf.Cgroup.Path)
+		if err != nil {
+			conf.Cgroup.Resources = old
+			return err
+		}
+		err = manager.Set(res)
+		if err == nil {
+			err = SetBandwidth(conf)
+		}
+		if err != nil {
+			conf.Cgroup.Resources = old
+			if old != nil {
+				_ = manager.Set(old)
+				_ = SetBandwidth(conf)
+			}
+			return err
+		}
+	}
+	return config.RecordContainerConfig(conf)
+}
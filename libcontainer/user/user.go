@@ -0,0 +1,130 @@
+package user
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 容器内的用户和用户组数据库
+	passwdPath = "/etc/passwd"
+	groupPath  = "/etc/group"
+)
+
+// 解析后的用户信息
+type ExecUser struct {
+	Uid  int
+	Gid  int
+	Home string
+
+	// 用户所属的附加用户组
+	Sgids []int
+}
+
+// 根据 user[:group] 形式的用户描述解析出用户信息，user 和 group 可以是名称或者 ID
+// 需要在容器的根文件系统中调用，因为它读取的是容器内的 /etc/passwd 和 /etc/group
+// 纯数字的 ID 即使在数据库中不存在也是合法的，这与 docker 的行为一致
+func GetExecUser(spec string) (*ExecUser, error) {
+	userSpec, groupSpec, hasGroup := strings.Cut(spec, ":")
+	if userSpec == "" {
+		return nil, fmt.Errorf("invalid user: %s", spec)
+	}
+
+	execUser := &ExecUser{Home: "/"}
+	uid, uidErr := strconv.Atoi(userSpec)
+	name := ""
+	for _, entry := range readDatabase(passwdPath) {
+		// 格式：name:password:uid:gid:gecos:home:shell
+		if len(entry) < 7 {
+			continue
+		}
+		if entry[0] != userSpec && (uidErr != nil || entry[2] != userSpec) {
+			continue
+		}
+		execUser.Uid, _ = strconv.Atoi(entry[2])
+		execUser.Gid, _ = strconv.Atoi(entry[3])
+		execUser.Home = entry[5]
+		name = entry[0]
+		break
+	}
+	if name == "" {
+		if uidErr != nil {
+			return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userSpec)
+		}
+		// 与 docker 一致，数据库中不存在的 uid 使用 root 用户组
+		execUser.Uid = uid
+		execUser.Gid = 0
+	}
+
+	// 指定了用户组时，使用指定的用户组作为主用户组
+	if hasGroup {
+		gid, err := lookupGroup(groupSpec)
+		if err != nil {
+			return nil, err
+		}
+		execUser.Gid = gid
+	}
+
+	// 获取用户所属的附加用户组
+	if name != "" {
+		for _, entry := range readDatabase(groupPath) {
+			// 格式：name:password:gid:members
+			if len(entry) < 4 {
+				continue
+			}
+			for _, member := range strings.Split(entry[3], ",") {
+				if member == name {
+					if gid, err := strconv.Atoi(entry[2]); err == nil {
+						execUser.Sgids = append(execUser.Sgids, gid)
+					}
+				}
+			}
+		}
+	}
+
+	return execUser, nil
+}
+
+// 根据用户组名称或 ID 获取 gid
+func lookupGroup(spec string) (int, error) {
+	if spec == "" {
+		return 0, fmt.Errorf("invalid group: %s", spec)
+	}
+	gid, gidErr := strconv.Atoi(spec)
+	for _, entry := range readDatabase(groupPath) {
+		if len(entry) < 3 {
+			continue
+		}
+		if entry[0] == spec || (gidErr == nil && entry[2] == spec) {
+			return strconv.Atoi(entry[2])
+		}
+	}
+	if gidErr != nil {
+		return 0, fmt.Errorf("unable to find group %s: no matching entries in group file", spec)
+	}
+	return gid, nil
+}
+
+// 读取 passwd 或 group 格式的文件，返回按 ':' 分割后的各行
+// 文件不存在时返回空，此时只能使用数字形式的 ID
+func readDatabase(filePath string) [][]string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries
+}
@@ -8,6 +8,10 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"m-docker/cmd"
+	"m-docker/libcontainer"
+	"m-docker/libcontainer/constant"
+	"m-docker/libcontainer/network"
+	"m-docker/libcontainer/storage"
 )
 
 const (
@@ -31,6 +35,25 @@ func main() {
 		cmd.ContainerListCommand,
 		cmd.LogsCommand,
 		cmd.ExecCommand,
+		cmd.SaveCommand,
+		cmd.LoadCommand,
+		cmd.BuildCommand,
+		cmd.PullCommand,
+		cmd.PushCommand,
+		cmd.ExportCommand,
+		cmd.ImportCommand,
+		cmd.RemoveCommand,
+		cmd.DiffCommand,
+		cmd.CopyCommand,
+		cmd.CopyHelperCommand,
+		cmd.CommitCommand,
+		cmd.TagCommand,
+		cmd.ImageCommand,
+		cmd.InspectCommand,
+		cmd.SystemCommand,
+		cmd.PortCommand,
+		cmd.NetworkCommand,
+		cmd.UpdateCommand,
 	}
 	// 全局 flag
 	app.Flags = []cli.Flag{
@@ -38,6 +61,20 @@ func main() {
 			Name:  "debug", // 启用 debug 模式
 			Usage: "enable debug mode",
 		},
+		cli.StringFlag{
+			Name:  "storage-driver", // 新建容器所使用的存储驱动
+			Usage: "storage driver for new containers (overlay or vfs), detected automatically if not set",
+		},
+		cli.StringFlag{
+			Name:  "cni-config-dir", // CNI 网络配置所在的目录
+			Usage: "directory of cni network configs",
+			Value: constant.DefaultCNIConfigDir,
+		},
+		cli.StringFlag{
+			Name:  "cni-bin-dir", // CNI 插件所在的目录
+			Usage: "directories of cni plugins, separated by ':'",
+			Value: constant.DefaultCNIBinDir,
+		},
 	}
 	app.Before = func(context *cli.Context) error {
 		// 设置日志格式
@@ -51,6 +88,17 @@ func main() {
 		}
 
 		log.SetOutput(os.Stdout)
+
+		// 设置 CNI 网络配置和插件所在的目录
+		network.SetCNIPaths(context.String("cni-config-dir"), context.String("cni-bin-dir"))
+
+		// 设置新建容器所使用的存储驱动
+		if err := storage.SetDefaultDriver(context.String("storage-driver")); err != nil {
+			return err
+		}
+
+		// 宿主机重启后恢复已经停止的容器
+		libcontainer.RestoreContainers()
 		return nil
 	}
 